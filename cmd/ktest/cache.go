@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/VKCOM/ktest/internal/buildcache"
+)
+
+func cmdCache(args []string) error {
+	const usageHelp = `
+Usage: ktest cache stats|clean
+
+* stats prints the build cache location and size
+* clean removes all cached executables
+
+Cache location can be changed with KTEST_CACHE_DIR env variable;
+KTEST_CACHE_MAX_SIZE sets the cache size limit (like "500M" or "10G")
+`
+
+	fs := flag.NewFlagSet("ktest cache", flag.ExitOnError)
+	fs.Usage = func() {
+		log.Print(strings.TrimSpace(usageHelp))
+	}
+	fs.Parse(args)
+
+	if len(fs.Args()) != 1 {
+		fs.Usage()
+		return errors.New("expected exactly 1 argument")
+	}
+
+	cache, err := buildcache.Open()
+	if err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "stats":
+		stats, err := cache.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("dir: %s\n", cache.Dir)
+		fmt.Printf("entries: %d\n", stats.Entries)
+		fmt.Printf("size: %s (limit: %s)\n", formatSize(stats.TotalSize), formatSize(cache.MaxSize))
+		return nil
+	case "clean":
+		return cache.Clean()
+	default:
+		fs.Usage()
+		return fmt.Errorf("unexpected command %q", fs.Arg(0))
+	}
+}
+
+func openBuildCache(enabled bool) *buildcache.Cache {
+	if !enabled {
+		return nil
+	}
+	cache, err := buildcache.Open()
+	if err != nil {
+		log.Printf("WARNING: build cache is disabled: %v", err)
+		return nil
+	}
+	return cache
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
@@ -9,15 +9,18 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/cespare/subcmd"
 	"github.com/google/go-cmp/cmp"
 
+	"github.com/VKCOM/ktest/event"
 	"github.com/VKCOM/ktest/internal/bench"
 	"github.com/VKCOM/ktest/internal/fileutil"
 	"github.com/VKCOM/ktest/internal/kenv"
 	"github.com/VKCOM/ktest/internal/kphpscript"
 	"github.com/VKCOM/ktest/internal/phpscript"
+	"github.com/VKCOM/ktest/internal/phpsyntax"
 	"github.com/VKCOM/ktest/internal/phpunit"
 )
 
@@ -75,6 +78,12 @@ func main() {
 			Do:          benchVsPHPMain,
 		},
 
+		{
+			Name:        "cache",
+			Description: "print build cache stats or clean it",
+			Do:          cacheMain,
+		},
+
 		{
 			Name:        "env",
 			Description: "print ktest-related env variables",
@@ -108,6 +117,9 @@ func envMain(args []string) {
 		"KTEST_KPHP2CPP_BINARY",
 		"KTEST_DISABLE_KPHP_AUTOLOAD",
 		"KTEST_INCLUDE_DIRS",
+		"KTEST_BUILD_CACHE",
+		"KTEST_CACHE_DIR",
+		"KTEST_CACHE_MAX_SIZE",
 	}
 
 	for _, name := range kphpVars {
@@ -116,6 +128,12 @@ func envMain(args []string) {
 	}
 }
 
+func cacheMain(args []string) {
+	if err := cmdCache(args); err != nil {
+		log.Fatalf("ktest cache: error: %v", err)
+	}
+}
+
 func benchstatMain(args []string) {
 	if err := cmdBenchstat(args); err != nil {
 		log.Fatalf("ktest benchstat: error: %v", err)
@@ -175,10 +193,14 @@ func cmdBenchPHP(args []string) error {
 		`PHP command to run the benchmarks`)
 	fs.StringVar(&conf.RunFilter, "run", ".*",
 		`regexp that selects the benchmarks to run`)
+	fs.StringVar(&conf.PHPVersion, "php-version", phpsyntax.DefaultVersion,
+		`PHP version used to parse the benchmark files`)
 	fs.BoolVar(&conf.DisableAutoloadForKPHP, "disable-kphp-autoload", envBool("KTEST_DISABLE_KPHP_AUTOLOAD", false),
 		`disables autoload for KPHP`)
 	fs.BoolVar(&conf.TeamcityOutput, "teamcity", false,
 		`report bench execution progress in TeamCity format`)
+	jsonOutput := fs.Bool("json", false,
+		`print a stream of JSON events instead of the text output`)
 	fs.Parse(args)
 
 	if len(fs.Args()) == 0 {
@@ -195,6 +217,10 @@ func cmdBenchPHP(args []string) error {
 	conf.ComposerRoot = kenv.FindComposerRoot(conf.ProjectRoot)
 	conf.BenchTarget = benchTarget
 	conf.Output = os.Stdout
+	if *jsonOutput {
+		conf.Output = ioutil.Discard
+		conf.Events = event.NewEncoder(os.Stdout)
+	}
 	if *debug {
 		conf.DebugPrint = func(msg string) {
 			log.Print(msg)
@@ -228,16 +254,22 @@ func cmdBench(args []string) error {
 		`comma separated list of additional kphp include-dirs`)
 	fs.StringVar(&conf.RunFilter, "run", ".*",
 		`regexp that selects the benchmarks to run`)
+	fs.StringVar(&conf.PHPVersion, "php-version", phpsyntax.DefaultVersion,
+		`PHP version used to parse the benchmark files`)
 	fs.StringVar(&conf.ProfileDir, "profile", "",
 		`write mem+cpu profiles to the specified folder; profiling is disabled by default`)
 	fs.BoolVar(&conf.DisableAutoloadForKPHP, "disable-kphp-autoload", envBool("KTEST_DISABLE_KPHP_AUTOLOAD", false),
 		`disables autoload for KPHP`)
 	fs.BoolVar(&conf.TeamcityOutput, "teamcity", false,
 		`report bench execution progress in TeamCity format`)
+	jsonOutput := fs.Bool("json", false,
+		`print a stream of JSON events instead of the text output`)
 	fs.BoolVar(&conf.Benchmem, "benchmem", false,
 		`print memory allocation statistics for benchmarks`)
 	fs.BoolVar(&conf.CompileOnly, "compile-only", false,
 		`build executables, but do not run the benchmarks`)
+	buildCache := fs.Bool("build-cache", envBool("KTEST_BUILD_CACHE", true),
+		`reuse previously compiled executables if the sources are unchanged`)
 	fs.Parse(args)
 
 	if len(fs.Args()) == 0 {
@@ -258,6 +290,11 @@ func cmdBench(args []string) error {
 	conf.ComposerRoot = kenv.FindComposerRoot(conf.ProjectRoot)
 	conf.BenchTarget = benchTarget
 	conf.Output = os.Stdout
+	if *jsonOutput {
+		conf.Output = ioutil.Discard
+		conf.Events = event.NewEncoder(os.Stdout)
+	}
+	conf.BuildCache = openBuildCache(*buildCache)
 	if *debug {
 		conf.DebugPrint = func(msg string) {
 			log.Print(msg)
@@ -310,6 +347,8 @@ func cmdCompare(args []string) error {
 	flagProjectRoot := fs.String("project-root", workdir,
 		`project root directory`)
 	fs.StringVar(&kphpCommand, "kphp2cpp-binary", envString("KTEST_KPHP2CPP_BINARY", ""), `kphp binary path; if empty, $KPHP_ROOT/objs/kphp2cpp is used`)
+	flagBuildCache := fs.Bool("build-cache", envBool("KTEST_BUILD_CACHE", true),
+		`reuse previously compiled executables if the sources are unchanged`)
 	fs.Parse(args)
 
 	if len(fs.Args()) == 0 {
@@ -359,6 +398,7 @@ func cmdCompare(args []string) error {
 		ComposerRoot: composerRoot,
 		OutputDir:    kphpBuildDir,
 		Workdir:      workdir,
+		Cache:        openBuildCache(*flagBuildCache),
 	})
 	if err != nil {
 		return fmt.Errorf("build kphp: %v", err)
@@ -378,18 +418,40 @@ func cmdCompare(args []string) error {
 	return nil
 }
 
+// Exit codes of the ktest phpunit command.
+const (
+	phpunitExitTestsFailed = 1
+	phpunitExitError       = 2
+)
+
 func phpunitMain(args []string) {
-	if err := cmdPhpunit(args); err != nil {
-		log.Fatalf("ktest phpunit: error: %v", err)
+	exitCode, err := cmdPhpunit(args)
+	if err != nil {
+		log.Printf("ktest phpunit: error: %v", err)
+		os.Exit(phpunitExitError)
 	}
+	os.Exit(exitCode)
 }
 
-func cmdPhpunit(args []string) error {
+// phpunitExitCode returns phpunitExitError if some test files were not run
+// (build errors, crashes and so on) and phpunitExitTestsFailed if some tests failed.
+func phpunitExitCode(result *phpunit.RunResult) int {
+	switch {
+	case len(result.FileErrors) != 0:
+		return phpunitExitError
+	case len(result.Failures) != 0 || len(result.Errors) != 0 || len(result.Mismatches) != 0:
+		return phpunitExitTestsFailed
+	default:
+		return 0
+	}
+}
+
+func cmdPhpunit(args []string) (int, error) {
 	conf := &phpunit.RunConfig{}
 
 	workdir, err := os.Getwd()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	fs := flag.NewFlagSet("ktest phpunit", flag.ExitOnError)
@@ -403,22 +465,78 @@ func cmdPhpunit(args []string) error {
 		`project sources root`)
 	fs.StringVar(&conf.KphpCommand, "kphp2cpp-binary", envString("KTEST_KPHP2CPP_BINARY", ""),
 		`kphp binary path; if empty, $KPHP_ROOT/objs/kphp2cpp is used`)
+	fs.BoolVar(&conf.VsPHP, "vs-php", false,
+		`run tests with both KPHP and PHP, report the tests with different results`)
+	fs.StringVar(&conf.PhpCommand, "php", "php",
+		`PHP command to run the tests with -vs-php`)
+	fs.StringVar(&conf.Filter, "filter", "",
+		`regexp that selects the tests to run by their Class::method names`)
+	fs.StringVar(&conf.TestSuite, "testsuite", "",
+		`comma separated list of phpunit.xml test suites to run; all suites are run by default`)
+	groups := fs.String("group", "",
+		`comma separated list of @group names; only the tests from these groups are run`)
+	excludeGroups := fs.String("exclude-group", "",
+		`comma separated list of @group names; the tests from these groups are skipped`)
+	fs.StringVar(&conf.PHPVersion, "php-version", phpsyntax.DefaultVersion,
+		`PHP version used to parse the test files`)
+	fs.IntVar(&conf.Jobs, "j", 1,
+		`number of test files to build and run in parallel`)
+	fs.BoolVar(&conf.SingleBinary, "single-binary", false,
+		`compile all test files into one executable`)
+	fs.BoolVar(&conf.ProcessIsolation, "process-isolation", false,
+		`run every test method in a separate process`)
+	fs.DurationVar(&conf.TestTimeout, "timeout", 0,
+		`kill the test process if a single test runs longer than this; 0 means no limit`)
+	fs.DurationVar(&conf.FileTimeout, "file-timeout", 0,
+		`kill the test process if a test file runs longer than this; 0 means no limit`)
+	buildCache := fs.Bool("build-cache", envBool("KTEST_BUILD_CACHE", true),
+		`reuse previously compiled executables if the sources are unchanged`)
+	fs.BoolVar(&conf.TeamcityOutput, "teamcity", false,
+		`report test execution progress in TeamCity format`)
+	junitXML := fs.String("junit-xml", "",
+		`write test results in JUnit XML format to the specified file`)
+	jsonOutput := fs.Bool("json", false,
+		`print a stream of JSON events instead of the text output`)
+	order := fs.String("order", "default",
+		`tests execution order: "default" or "random"`)
+	fs.Int64Var(&conf.Seed, "seed", 0,
+		`random seed for -order random; if 0, the seed is chosen randomly`)
+	lastFailed := fs.Bool("last-failed", false,
+		`run only the tests that failed during the previous run`)
+	failedFirst := fs.Bool("failed-first", false,
+		`run the tests that failed during the previous run first, then the rest`)
+	reportSlowest := fs.Int("report-slowest", 0,
+		`list N slowest tests and test files after the results`)
 	fs.Parse(args)
 
 	if len(fs.Args()) == 0 {
 		// TODO: print command help here?
 		log.Printf("Expected at least 1 positional argument, the test target")
-		return nil
+		return phpunitExitError, nil
 	}
 
 	testTarget, err := filepath.Abs(fs.Args()[0])
 	if err != nil {
-		return fmt.Errorf("resolve test target path: %v", err)
+		return 0, fmt.Errorf("resolve test target path: %v", err)
+	}
+
+	switch *order {
+	case "default":
+	case "random":
+		conf.RandomOrder = true
+		if conf.Seed == 0 {
+			conf.Seed = time.Now().UnixNano()
+		}
+	default:
+		return 0, fmt.Errorf("unexpected -order value %q, expected default or random", *order)
+	}
+	if *lastFailed && *failedFirst {
+		return 0, errors.New("-last-failed and -failed-first can't be used together")
 	}
 
 	conf.ProjectRoot, err = filepath.Abs(conf.ProjectRoot)
 	if err != nil {
-		return fmt.Errorf("resolve project root path: %v", err)
+		return 0, fmt.Errorf("resolve project root path: %v", err)
 	}
 	if !strings.HasSuffix(conf.ProjectRoot, "/") {
 		conf.ProjectRoot += "/"
@@ -426,8 +544,15 @@ func cmdPhpunit(args []string) error {
 
 	conf.ComposerRoot = kenv.FindComposerRoot(conf.ProjectRoot)
 	conf.TestTarget = testTarget
+	conf.Groups = splitList(*groups)
+	conf.ExcludeGroups = splitList(*excludeGroups)
 	conf.TestArgv = fs.Args()[1:]
 	conf.Output = os.Stdout
+	if *jsonOutput {
+		conf.Output = ioutil.Discard
+		conf.Events = event.NewEncoder(os.Stdout)
+	}
+	conf.BuildCache = openBuildCache(*buildCache)
 
 	if *debug {
 		conf.DebugPrint = func(msg string) {
@@ -438,20 +563,66 @@ func cmdPhpunit(args []string) error {
 	if conf.KphpCommand == "" {
 		kphpBinary := kenv.FindKphpBinary()
 		if kphpBinary == "" {
-			return fmt.Errorf("can't locate kphp2cpp binary; please set -kphp2cpp-binary arg")
+			return 0, fmt.Errorf("can't locate kphp2cpp binary; please set -kphp2cpp-binary arg")
 		}
 		conf.KphpCommand = kphpBinary
 	}
 
+	// The state errors are not fatal: it only affects the -last-failed and -failed-first runs.
+	state := &phpunitState{}
+	stateFilename, err := phpunitStateFilename(conf.ProjectRoot)
+	if err != nil {
+		log.Printf("WARNING: can't locate the run state file: %v", err)
+	} else if loaded, err := loadPhpunitState(stateFilename); err != nil {
+		log.Printf("WARNING: can't load the previous run state: %v", err)
+	} else {
+		state = loaded
+	}
+	conf.LastFailed = state.Failed
+	switch {
+	case *lastFailed:
+		conf.Rerun = phpunit.RerunLastFailed
+	case *failedFirst:
+		conf.Rerun = phpunit.RerunFailedFirst
+	}
+
 	result, err := phpunit.Run(conf)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	formatConfig := &phpunit.FormatConfig{
-		PrintTime: true,
+	if stateFilename != "" {
+		state.Failed = phpunit.FailedTests(result, state.Failed)
+		if err := savePhpunitState(stateFilename, state); err != nil {
+			log.Printf("WARNING: can't save the run state: %v", err)
+		}
 	}
-	phpunit.FormatResult(os.Stdout, formatConfig, result)
 
-	return nil
+	if !*jsonOutput {
+		formatConfig := &phpunit.FormatConfig{
+			PrintTime:     true,
+			ReportSlowest: *reportSlowest,
+		}
+		phpunit.FormatResult(os.Stdout, formatConfig, result)
+	}
+
+	if *junitXML != "" {
+		if err := writeJUnitReport(*junitXML, result); err != nil {
+			return 0, fmt.Errorf("write JUnit report: %v", err)
+		}
+	}
+
+	return phpunitExitCode(result), nil
+}
+
+func writeJUnitReport(filename string, result *phpunit.RunResult) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := phpunit.WriteJUnitReport(f, result); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/VKCOM/ktest/internal/phpunit"
+)
+
+func TestPhpunitExitCode(t *testing.T) {
+	failure := phpunit.TestFailure{Name: "FooTest::testFoo", Reason: "Failed asserting that false is true"}
+	fileErr := phpunit.FileError{File: "/tests/BarTest.php", Kind: phpunit.BuildError, Err: errors.New("compilation error")}
+
+	tests := []struct {
+		name   string
+		result phpunit.RunResult
+		want   int
+	}{
+		{"pass", phpunit.RunResult{Tests: 1, Assertions: 1}, 0},
+		{"no tests", phpunit.RunResult{}, 0},
+		{"skipped and risky", phpunit.RunResult{Skipped: []phpunit.TestFailure{failure}, Risky: []phpunit.TestFailure{failure}}, 0},
+		{"failure", phpunit.RunResult{Failures: []phpunit.TestFailure{failure}}, phpunitExitTestsFailed},
+		{"error", phpunit.RunResult{Errors: []phpunit.TestFailure{failure}}, phpunitExitTestsFailed},
+		{"mismatch", phpunit.RunResult{Mismatches: []phpunit.TestMismatch{{Name: "FooTest::testFoo"}}}, phpunitExitTestsFailed},
+		{"file error", phpunit.RunResult{FileErrors: []phpunit.FileError{fileErr}}, phpunitExitError},
+		{"file error and failure", phpunit.RunResult{Failures: []phpunit.TestFailure{failure}, FileErrors: []phpunit.FileError{fileErr}}, phpunitExitError},
+	}
+
+	for _, test := range tests {
+		if have := phpunitExitCode(&test.result); have != test.want {
+			t.Errorf("%s: exit code mismatch: have %d, want %d", test.name, have, test.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/VKCOM/ktest/internal/buildcache"
+	"github.com/VKCOM/ktest/internal/fileutil"
+)
+
+// phpunitState is saved after every `ktest phpunit` run,
+// so the next run can re-run the failed tests only.
+type phpunitState struct {
+	// Failed are the tests to re-run, see phpunit.FailedTests.
+	Failed []string `json:"failed"`
+}
+
+// phpunitStateFilename returns the state file path for the project.
+// The state is stored inside the cache dir, one file per project root.
+func phpunitStateFilename(projectRoot string) (string, error) {
+	dir, err := buildcache.DefaultDir()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(projectRoot))
+	return filepath.Join(dir, "state", hex.EncodeToString(hash[:16])+".json"), nil
+}
+
+// loadPhpunitState returns an empty state if the project was never tested.
+func loadPhpunitState(filename string) (*phpunitState, error) {
+	var state phpunitState
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func savePhpunitState(filename string, state *phpunitState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFile(filename, data)
+}
@@ -0,0 +1,105 @@
+// Package event describes the machine-readable output of ktest commands.
+//
+// When ktest is executed with -json flag, it writes a stream of events
+// to stdout, one JSON-encoded Event per line (like "go test -json" does).
+// Use encoding/json Decoder to read them.
+package event
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+type Action string
+
+const (
+	// BuildStart and BuildEnd surround the compilation of a single KPHP executable.
+	// The BuildEnd Error is set if the compilation failed.
+	BuildStart Action = "build-start"
+	BuildEnd   Action = "build-end"
+
+	// Start is reported when a test (or a benchmark class) starts.
+	Start Action = "start"
+	// Output contains the text that a test has printed.
+	Output Action = "output"
+	// Pass, Fail and Error report the test result.
+	// Fail means a failed assertion, Error is an unexpected exception
+	// or a problem that prevented the test file from running.
+	Pass  Action = "pass"
+	Fail  Action = "fail"
+	Error Action = "error"
+	// Skip and Incomplete report the tests marked with markTestSkipped and markTestIncomplete.
+	// Risky is a passed test that didn't perform any assertions.
+	Skip       Action = "skip"
+	Incomplete Action = "incomplete"
+	Risky      Action = "risky"
+
+	// Bench is a single benchmark sample.
+	Bench Action = "bench"
+
+	// Seed is reported before the tests are run in random order.
+	// Pass the Seed back with -seed to reproduce the order.
+	Seed Action = "seed"
+)
+
+type Event struct {
+	Time   time.Time `json:"time"`
+	Action Action    `json:"action"`
+
+	// Class and Test identify the test method (or a benchmark).
+	// Both are empty for the events that are related to the whole file.
+	File  string `json:"file,omitempty"`
+	Class string `json:"class,omitempty"`
+	Test  string `json:"test,omitempty"`
+
+	// Elapsed is the build, test or benchmark class run time in seconds.
+	Elapsed float64 `json:"elapsed,omitempty"`
+
+	Output string `json:"output,omitempty"`
+
+	// Failure details for the Fail and Error events
+	// (and the reason for the Skip, Incomplete and Risky ones).
+	// Line is the failure location line inside the File.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	// Diff is the expected and actual values diff for the failed comparisons.
+	Diff string `json:"diff,omitempty"`
+
+	// Error is the build error message for the BuildEnd event.
+	Error string `json:"error,omitempty"`
+
+	// Benchmark sample for the Bench event.
+	// BytesPerOp and AllocsPerOp are collected with -benchmem only.
+	Iterations  int64   `json:"iterations,omitempty"`
+	NsPerOp     float64 `json:"ns_per_op,omitempty"`
+	BytesPerOp  int64   `json:"bytes_per_op,omitempty"`
+	AllocsPerOp int64   `json:"allocs_per_op,omitempty"`
+
+	// Seed is the random order seed for the Seed event.
+	Seed int64 `json:"seed,omitempty"`
+}
+
+// Encoder writes the events as JSON lines.
+// It's safe to use it from several goroutines.
+type Encoder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{enc: json.NewEncoder(w)}
+}
+
+// Encode writes a single event.
+// If the event Time is not set, the current time is used.
+func (e *Encoder) Encode(ev Event) error {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(ev)
+}
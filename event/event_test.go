@@ -0,0 +1,47 @@
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	ts := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Time: ts, Action: Start, File: "/tests/FooTest.php", Class: "FooTest", Test: "testFoo"},
+		{Time: ts, Action: Fail, File: "/tests/FooTest.php", Class: "FooTest", Test: "testFoo", Elapsed: 0.5, Reason: "Failed asserting that false is true", Line: 10},
+		{Time: ts, Action: Bench, Class: "Bench", Test: "benchFoo", Iterations: 1000, NsPerOp: 125.5, BytesPerOp: 16, AllocsPerOp: 1},
+		{Time: ts, Action: Seed, Seed: 1614600000},
+	}
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := `{"time":"2021-03-01T12:00:00Z","action":"start","file":"/tests/FooTest.php","class":"FooTest","test":"testFoo"}
+{"time":"2021-03-01T12:00:00Z","action":"fail","file":"/tests/FooTest.php","class":"FooTest","test":"testFoo","elapsed":0.5,"reason":"Failed asserting that false is true","line":10}
+{"time":"2021-03-01T12:00:00Z","action":"bench","class":"Bench","test":"benchFoo","iterations":1000,"ns_per_op":125.5,"bytes_per_op":16,"allocs_per_op":1}
+{"time":"2021-03-01T12:00:00Z","action":"seed","seed":1614600000}
+`
+	if diff := cmp.Diff(buf.String(), want); diff != "" {
+		t.Errorf("output mismatches (-have +want):\n%s", diff)
+	}
+
+	dec := json.NewDecoder(&buf)
+	for _, want := range events {
+		var have Event
+		if err := dec.Decode(&have); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(have, want); diff != "" {
+			t.Errorf("decoded event mismatches (-have +want):\n%s", diff)
+		}
+	}
+}
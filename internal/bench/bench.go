@@ -2,6 +2,9 @@ package bench
 
 import (
 	"io"
+
+	"github.com/VKCOM/ktest/event"
+	"github.com/VKCOM/ktest/internal/buildcache"
 )
 
 type RunConfig struct {
@@ -11,6 +14,10 @@ type RunConfig struct {
 	Preload      string
 	RunFilter    string
 
+	// PHPVersion is the "major.minor" PHP version used to parse the benchmark files.
+	// If empty, phpsyntax.DefaultVersion is used.
+	PHPVersion string
+
 	ProfileDir  string
 	CompileOnly bool
 
@@ -19,6 +26,9 @@ type RunConfig struct {
 	KphpCommand string
 	PhpCommand  string
 
+	// BuildCache is used to avoid the recompilation of unchanged benchmarks, if not nil.
+	BuildCache *buildcache.Cache
+
 	AdditionalKphpIncludeDirs string
 	DisableAutoloadForKPHP    bool
 	TeamcityOutput            bool
@@ -27,6 +37,9 @@ type RunConfig struct {
 
 	Count int
 
+	// Events receives the machine-readable benchmark progress, if not nil.
+	Events *event.Encoder
+
 	Output     io.Writer
 	DebugPrint func(string)
 
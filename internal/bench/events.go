@@ -0,0 +1,94 @@
+package bench
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/VKCOM/ktest/event"
+)
+
+// benchEventsWriter forwards the benchmark stderr to w and
+// reports every complete output line as an event.
+//
+// The benchmark sample lines look like this:
+//
+//	Class::benchmarkFoo	100	1500.0 ns/op	24 B/op	1 allocs/op
+//
+// They are reported as event.Bench, the other lines are reported as event.Output.
+type benchEventsWriter struct {
+	w      io.Writer
+	events *event.Encoder
+
+	file  string
+	class string
+	test  string
+
+	buf []byte
+}
+
+func (w *benchEventsWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			break
+		}
+		w.emitLine(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return w.w.Write(p)
+}
+
+// Flush reports the incomplete last line, if any.
+func (w *benchEventsWriter) Flush() {
+	if len(w.buf) != 0 {
+		w.emitLine(string(w.buf))
+		w.buf = w.buf[:0]
+	}
+}
+
+func (w *benchEventsWriter) emitLine(line string) {
+	ev := event.Event{File: w.file, Class: w.class, Test: w.test}
+	if parseBenchSample(line, &ev) {
+		ev.Action = event.Bench
+	} else {
+		ev.Action = event.Output
+		ev.Output = line + "\n"
+	}
+	w.events.Encode(ev)
+}
+
+func parseBenchSample(line string, ev *event.Event) bool {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 3 || !strings.Contains(fields[0], "::") {
+		return false
+	}
+	iterations, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	nsPerOp, ok := parseBenchValue(fields[2], " ns/op")
+	if !ok {
+		return false
+	}
+	ev.Iterations = iterations
+	ev.NsPerOp = nsPerOp
+	for _, field := range fields[3:] {
+		if v, ok := parseBenchValue(field, " B/op"); ok {
+			ev.BytesPerOp = int64(v)
+		} else if v, ok := parseBenchValue(field, " allocs/op"); ok {
+			ev.AllocsPerOp = int64(v)
+		}
+	}
+	return true
+}
+
+func parseBenchValue(s, unit string) (float64, bool) {
+	if !strings.HasSuffix(s, unit) {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, unit), 64)
+	return v, err == nil
+}
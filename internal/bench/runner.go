@@ -18,12 +18,13 @@ import (
 	"github.com/z7zmey/php-parser/pkg/conf"
 	phperrors "github.com/z7zmey/php-parser/pkg/errors"
 	"github.com/z7zmey/php-parser/pkg/parser"
-	"github.com/z7zmey/php-parser/pkg/version"
 	"github.com/z7zmey/php-parser/pkg/visitor/traverser"
 
+	"github.com/VKCOM/ktest/event"
 	"github.com/VKCOM/ktest/internal/fileutil"
 	"github.com/VKCOM/ktest/internal/kphpscript"
 	"github.com/VKCOM/ktest/internal/phpscript"
+	"github.com/VKCOM/ktest/internal/phpsyntax"
 	"github.com/VKCOM/ktest/internal/teamcity"
 )
 
@@ -193,6 +194,11 @@ func (r *runner) stepPrepareTempBuildDir() error {
 }
 
 func (r *runner) stepParseBenchFiles() error {
+	phpVersion, err := phpsyntax.ParseVersion(r.conf.PHPVersion)
+	if err != nil {
+		return err
+	}
+
 	for _, f := range r.benchFiles {
 		src, err := ioutil.ReadFile(f.fullName)
 		if err != nil {
@@ -202,15 +208,19 @@ func (r *runner) stepParseBenchFiles() error {
 		errorHandler := func(e *phperrors.Error) {
 			parserErrors = append(parserErrors, e)
 		}
+		src, _ = phpsyntax.MaskAttributes(src)
 		rootNode, err := parser.Parse(src, conf.Config{
-			Version:          &version.Version{Major: 7, Minor: 4},
+			Version:          phpVersion,
 			ErrorHandlerFunc: errorHandler,
 		})
-		if err != nil || len(parserErrors) != 0 {
+		if err != nil {
+			return err
+		}
+		if len(parserErrors) != 0 {
 			for _, parseErr := range parserErrors {
 				log.Printf("%s: parse error: %v", f.fullName, parseErr)
 			}
-			return err
+			return fmt.Errorf("can't parse %s", f.fullName)
 		}
 		f.info = &benchParsedInfo{}
 		visitor := &astVisitor{out: f.info, currentFileName: f.shortName}
@@ -427,7 +437,7 @@ __bench_main(intval($count));
 
 func (r *runner) runPhpBench() error {
 	for _, f := range r.benchFiles {
-		r.logger.TestSuiteStarted(f.info.ClassFQN)
+		r.logger.TestSuiteStarted(f.suiteName())
 
 		mainFilename := filepath.Join(r.buildDir, "main.php")
 		if err := fileutil.WriteFile(mainFilename, f.generatedMain); err != nil {
@@ -437,6 +447,7 @@ func (r *runner) runPhpBench() error {
 		fmt.Fprintf(r.conf.Output, "class: %s\n", f.info.ClassFQN)
 		timeTotal := time.Duration(0)
 		for _, m := range f.info.BenchMethods {
+			stderr := r.startBench(f, m)
 			result, err := phpscript.Run(phpscript.RunConfig{
 				PHPCommand: r.conf.PhpCommand,
 				Preload:    r.conf.Preload,
@@ -444,18 +455,19 @@ func (r *runner) runPhpBench() error {
 				Script:     mainFilename,
 				Workdir:    r.buildDir,
 				ScriptArgs: []string{m.Key},
-				Stderr:     r.conf.Output,
+				Stderr:     stderr,
 			})
 			timeTotal += result.Time
+			r.finishBench(f, m, stderr, result.Time, err)
 			if err != nil {
 				log.Printf("%s: %s run error: %v", f.fullName, m.Name, err)
-				r.logger.TestSuiteFinished(f.info.ClassFQN, result.Time)
+				r.logger.TestSuiteFinished(f.suiteName(), result.Time)
 				return fmt.Errorf("error running %s", f.fullName)
 			}
 		}
 
 		fmt.Fprintf(r.conf.Output, "ok %s %v\n", f.info.ClassFQN, timeTotal)
-		r.logger.TestSuiteFinished(f.info.ClassFQN, timeTotal)
+		r.logger.TestSuiteFinished(f.suiteName(), timeTotal)
 	}
 
 	return nil
@@ -476,6 +488,8 @@ func (r *runner) stepRunBench() error {
 			return err
 		}
 
+		r.emit(event.Event{Action: event.BuildStart, File: f.fullName})
+		buildStart := time.Now()
 		buildResult, err := kphpscript.Build(kphpscript.BuildConfig{
 			ProfilingEnabled:          r.conf.ProfileDir != "",
 			KPHPCommand:               r.conf.KphpCommand,
@@ -484,7 +498,13 @@ func (r *runner) stepRunBench() error {
 			OutputDir:                 r.buildDir,
 			Workdir:                   r.buildDir,
 			AdditionalKphpIncludeDirs: r.conf.AdditionalKphpIncludeDirs,
+			Cache:                     r.conf.BuildCache,
 		})
+		buildEnd := event.Event{Action: event.BuildEnd, File: f.fullName, Elapsed: time.Since(buildStart).Seconds()}
+		if err != nil {
+			buildEnd.Error = err.Error()
+		}
+		r.emit(buildEnd)
 		if err != nil {
 			log.Printf("%s: build error: %v", f.fullName, err)
 			return fmt.Errorf("can't build %s", f.fullName)
@@ -499,33 +519,81 @@ func (r *runner) stepRunBench() error {
 			continue
 		}
 
-		r.logger.TestSuiteStarted(f.info.ClassFQN)
+		r.logger.TestSuiteStarted(f.suiteName())
 		fmt.Fprintf(r.conf.Output, "class: %s\n", f.info.ClassFQN)
 
 		timeTotal := time.Duration(0)
 		for _, m := range f.info.BenchMethods {
+			stderr := r.startBench(f, m)
 			runResult, err := kphpscript.Run(kphpscript.RunConfig{
 				ProfilerPrefix: r.profilerPrefix,
 				Executable:     buildResult.Executable,
 				Workdir:        r.buildDir,
 				ScriptArgs:     []string{m.Key},
-				Stderr:         r.conf.Output,
+				Stderr:         stderr,
 			})
 			timeTotal += runResult.Time
+			r.finishBench(f, m, stderr, runResult.Time, err)
 			if err != nil {
 				log.Printf("%s: %s run error: %v", f.fullName, m.Name, err)
-				r.logger.TestSuiteFinished(f.info.ClassFQN, timeTotal)
+				r.logger.TestSuiteFinished(f.suiteName(), timeTotal)
 				return fmt.Errorf("error running %s", f.fullName)
 			}
 		}
 
 		fmt.Fprintf(r.conf.Output, "ok %s %v\n", f.info.ClassFQN, timeTotal)
-		r.logger.TestSuiteFinished(f.info.ClassFQN, timeTotal)
+		r.logger.TestSuiteFinished(f.suiteName(), timeTotal)
 	}
 
 	return nil
 }
 
+func (r *runner) emit(ev event.Event) {
+	if r.conf.Events != nil {
+		r.conf.Events.Encode(ev)
+	}
+}
+
+// suiteName returns the benchmark class name for the TeamCity reports.
+func (f *benchFile) suiteName() string {
+	return strings.TrimPrefix(f.info.ClassFQN, "Benchmark")
+}
+
+// startBench reports the benchmark start and returns the writer
+// that should be used as the benchmark stderr.
+func (r *runner) startBench(f *benchFile, m benchMethod) io.Writer {
+	if r.conf.Events == nil {
+		return r.conf.Output
+	}
+	r.emit(event.Event{Action: event.Start, File: f.fullName, Class: f.info.ClassFQN, Test: m.Name})
+	return &benchEventsWriter{
+		w:      r.conf.Output,
+		events: r.conf.Events,
+		file:   f.fullName,
+		class:  f.info.ClassFQN,
+		test:   m.Name,
+	}
+}
+
+func (r *runner) finishBench(f *benchFile, m benchMethod, stderr io.Writer, elapsed time.Duration, err error) {
+	if r.conf.Events == nil {
+		return
+	}
+	stderr.(*benchEventsWriter).Flush()
+	ev := event.Event{
+		Action:  event.Pass,
+		File:    f.fullName,
+		Class:   f.info.ClassFQN,
+		Test:    m.Name,
+		Elapsed: elapsed.Seconds(),
+	}
+	if err != nil {
+		ev.Action = event.Error
+		ev.Message = err.Error()
+	}
+	r.emit(ev)
+}
+
 func (r *runner) moveProfiles() error {
 	if r.profilerPrefix == "" || r.conf.CompileOnly {
 		return nil
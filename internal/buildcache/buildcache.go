@@ -0,0 +1,221 @@
+package buildcache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VKCOM/ktest/internal/fileutil"
+)
+
+// DefaultMaxSize is used when KTEST_CACHE_MAX_SIZE is not set.
+const DefaultMaxSize = 5 << 30
+
+// Cache is a persistent storage of compiled KPHP executables.
+//
+// Every entry is a single executable file named after its key.
+// Entries are evicted in LRU order when the total size exceeds MaxSize;
+// a cache hit updates the entry modification time.
+type Cache struct {
+	Dir     string
+	MaxSize int64
+}
+
+type Stats struct {
+	Entries   int
+	TotalSize int64
+}
+
+// DefaultDir returns $KTEST_CACHE_DIR or a ktest folder inside
+// the user cache dir ($XDG_CACHE_HOME or ~/.cache on Linux).
+func DefaultDir() (string, error) {
+	if dir := os.Getenv("KTEST_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userCacheDir, "ktest"), nil
+}
+
+// Open returns a cache located at the DefaultDir.
+// The size limit is taken from $KTEST_CACHE_MAX_SIZE (like "500M" or "10G").
+func Open() (*Cache, error) {
+	dir, err := DefaultDir()
+	if err != nil {
+		return nil, err
+	}
+	maxSize := int64(DefaultMaxSize)
+	if v := os.Getenv("KTEST_CACHE_MAX_SIZE"); v != "" {
+		maxSize, err = ParseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("KTEST_CACHE_MAX_SIZE: %v", err)
+		}
+	}
+	return &Cache{Dir: dir, MaxSize: maxSize}, nil
+}
+
+func (c *Cache) buildsDir() string {
+	return filepath.Join(c.Dir, "builds")
+}
+
+// Get copies the executable stored under the key to the dst path.
+// The returned bool is false if there is no such entry.
+func (c *Cache) Get(key, dst string) (bool, error) {
+	filename := filepath.Join(c.buildsDir(), key)
+	if !fileutil.FileExists(filename) {
+		return false, nil
+	}
+	now := time.Now()
+	if err := os.Chtimes(filename, now, now); err != nil {
+		return false, err
+	}
+	if err := copyExecutable(dst, filename); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Put stores a copy of the executable under the key
+// and evicts the least recently used entries if the cache is too big.
+func (c *Cache) Put(key, executable string) error {
+	if err := fileutil.MkdirAll(c.buildsDir()); err != nil {
+		return err
+	}
+	// Copy to a temporary file first, so concurrent readers
+	// never observe a partially written executable.
+	tmp, err := ioutil.TempFile(c.buildsDir(), ".tmp-"+key)
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	if err := copyExecutable(tmp.Name(), executable); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.buildsDir(), key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return c.Trim()
+}
+
+// Trim removes the least recently used entries until
+// the cache size fits into the MaxSize.
+func (c *Cache) Trim() error {
+	if c.MaxSize <= 0 {
+		return nil
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	var totalSize int64
+	for _, e := range entries {
+		totalSize += e.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, e := range entries {
+		if totalSize <= c.MaxSize {
+			break
+		}
+		err := os.Remove(filepath.Join(c.buildsDir(), e.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		totalSize -= e.Size()
+	}
+	return nil
+}
+
+func (c *Cache) Stats() (Stats, error) {
+	var stats Stats
+	entries, err := c.entries()
+	if err != nil {
+		return stats, err
+	}
+	for _, e := range entries {
+		stats.Entries++
+		stats.TotalSize += e.Size()
+	}
+	return stats, nil
+}
+
+// Clean removes all cache entries.
+func (c *Cache) Clean() error {
+	return os.RemoveAll(c.buildsDir())
+}
+
+func (c *Cache) entries() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(c.buildsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := infos[:0]
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			continue
+		}
+		entries = append(entries, info)
+	}
+	return entries, nil
+}
+
+// ParseSize parses sizes like "1024", "500K", "200M" or "10G".
+func ParseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("negative size")
+	}
+	return n * multiplier, nil
+}
+
+func copyExecutable(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Remove the old file instead of truncating it:
+	// it may be used by a running process.
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
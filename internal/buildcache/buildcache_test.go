@@ -0,0 +1,87 @@
+package buildcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheLRU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktest-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	executable := filepath.Join(dir, "cli")
+	if err := ioutil.WriteFile(executable, make([]byte, 100), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &Cache{Dir: filepath.Join(dir, "cache"), MaxSize: 250}
+	for i, key := range []string{"a", "b"} {
+		if err := cache.Put(key, executable); err != nil {
+			t.Fatal(err)
+		}
+		// Make the modification times distinct.
+		mtime := time.Now().Add(time.Duration(i-10) * time.Second)
+		os.Chtimes(filepath.Join(cache.buildsDir(), key), mtime, mtime)
+	}
+
+	// "a" becomes the most recently used entry, so "b" is evicted.
+	dst := filepath.Join(dir, "out")
+	if ok, err := cache.Get("a", dst); !ok || err != nil {
+		t.Fatalf("get a: ok=%v err=%v", ok, err)
+	}
+	if err := cache.Put("c", executable); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		ok, err := cache.Get(key, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("get %s: have %v, want %v", key, ok, want)
+		}
+	}
+
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 2 || stats.TotalSize != 200 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"1024", 1024},
+		{"2K", 2 << 10},
+		{"500M", 500 << 20},
+		{"10G", 10 << 30},
+	}
+	for _, test := range tests {
+		have, err := ParseSize(test.s)
+		if err != nil {
+			t.Errorf("parse %q: %v", test.s, err)
+			continue
+		}
+		if have != test.want {
+			t.Errorf("parse %q: have %d, want %d", test.s, have, test.want)
+		}
+	}
+
+	for _, s := range []string{"", "G", "-1", "10T"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("parse %q: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package kphpscript
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/VKCOM/ktest/internal/fileutil"
+)
+
+var requireRegexp = regexp.MustCompile(`(?:require|include)(?:_once)?\s*\(?\s*'([^']+)'`)
+
+// fileHashes and treeHashes memoize the source hashes between the builds:
+// the sources (like vendor) stay the same during the whole ktest run,
+// only the generated files change (and they are not memoized).
+var (
+	fileHashes sync.Map
+	treeHashes sync.Map
+)
+
+// buildCacheKey computes a key that identifies the build result.
+//
+// The key covers the kphp2cpp binary, build args, the main script
+// with the files it requires (transitively) and the sources
+// that can be autoloaded: the composer vendor and autoload dirs,
+// the include dirs and the project files symlinked into the workdir.
+// Other generated files in the workdir (like the mains of other tests)
+// don't affect the key.
+//
+// Workdir and OutputDir paths are normalized, so temporary build dirs
+// with identical contents produce identical keys.
+func buildCacheKey(config BuildConfig, args []string) (string, error) {
+	normalize := func(data []byte) []byte {
+		data = bytes.ReplaceAll(data, []byte(config.OutputDir), []byte("$OUTPUT"))
+		if config.Workdir != "" {
+			data = bytes.ReplaceAll(data, []byte(config.Workdir), []byte("$WORKDIR"))
+		}
+		return data
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "ktest build cache v2\n")
+
+	kphpBinary, err := exec.LookPath(config.KPHPCommand)
+	if err != nil {
+		return "", err
+	}
+	kphpInfo, err := os.Stat(kphpBinary)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "kphp2cpp %s %d %d\n", kphpBinary, kphpInfo.Size(), kphpInfo.ModTime().UnixNano())
+
+	for _, arg := range args {
+		fmt.Fprintf(h, "arg %s\n", normalize([]byte(arg)))
+	}
+
+	err = walkRequires(fileutil.AbsPath(config.Workdir, config.Script), config.Workdir, func(path string, data []byte) {
+		fmt.Fprintf(h, "require %s %x\n", normalize([]byte(path)), sha256.Sum256(normalize(data)))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var roots []string
+	if config.Workdir != "" {
+		links, err := findSymlinks(config.Workdir)
+		if err != nil {
+			return "", err
+		}
+		roots = append(roots, links...)
+	}
+	roots = append(roots, composerSources(config.ComposerRoot)...)
+	if config.AdditionalKphpIncludeDirs != "" {
+		roots = append(roots, strings.Split(config.AdditionalKphpIncludeDirs, ",")...)
+	}
+	for _, root := range roots {
+		sum, err := hashTree(root)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "tree %s %s\n", normalize([]byte(root)), sum)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// walkRequires visits the script and every file it requires, transitively.
+// Only the string literal paths are followed; the relative ones are resolved
+// against the requiring file dir and then against the workdir.
+func walkRequires(script, workdir string, visit func(path string, data []byte)) error {
+	visited := make(map[string]bool)
+	var walk func(filename string) error
+	walk = func(filename string) error {
+		if visited[filename] {
+			return nil
+		}
+		visited[filename] = true
+		data, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			// Like a require inside a comment or a dead code branch.
+			visit(filename, nil)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		visit(filename, data)
+		for _, m := range requireRegexp.FindAllSubmatch(data, -1) {
+			required := string(m[1])
+			if !filepath.IsAbs(required) {
+				candidate := filepath.Join(filepath.Dir(filename), required)
+				if !fileutil.FileExists(candidate) && workdir != "" {
+					candidate = filepath.Join(workdir, required)
+				}
+				required = candidate
+			}
+			if err := walk(filepath.Clean(required)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(script)
+}
+
+// findSymlinks returns the symlinks inside the workdir.
+// Build dirs consist of the generated files and symlinks to the project sources.
+func findSymlinks(workdir string) ([]string, error) {
+	var links []string
+	err := filepath.Walk(workdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != workdir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink != 0 && fileutil.FileExists(path) {
+			links = append(links, path)
+		}
+		return nil
+	})
+	return links, err
+}
+
+// composerSources returns the composer project files that can affect the build:
+// composer.json, composer.lock, vendor and the autoload paths.
+// The whole composer root is returned if composer.json can't be parsed.
+func composerSources(composerRoot string) []string {
+	if composerRoot == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(composerRoot, "composer.json"))
+	if err != nil {
+		return []string{composerRoot}
+	}
+	type autoload struct {
+		PSR4     map[string]interface{} `json:"psr-4"`
+		PSR0     map[string]interface{} `json:"psr-0"`
+		Classmap []string               `json:"classmap"`
+		Files    []string               `json:"files"`
+	}
+	var composerJSON struct {
+		Autoload    autoload `json:"autoload"`
+		AutoloadDev autoload `json:"autoload-dev"`
+	}
+	if err := json.Unmarshal(data, &composerJSON); err != nil {
+		return []string{composerRoot}
+	}
+
+	sources := []string{filepath.Join(composerRoot, "composer.json")}
+	for _, name := range []string{"composer.lock", "vendor"} {
+		if filename := filepath.Join(composerRoot, name); fileutil.FileExists(filename) {
+			sources = append(sources, filename)
+		}
+	}
+	var paths []string
+	for _, a := range []autoload{composerJSON.Autoload, composerJSON.AutoloadDev} {
+		for _, namespaces := range []map[string]interface{}{a.PSR4, a.PSR0} {
+			for _, dirs := range namespaces {
+				switch dirs := dirs.(type) {
+				case string:
+					paths = append(paths, dirs)
+				case []interface{}:
+					for _, dir := range dirs {
+						if dir, ok := dir.(string); ok {
+							paths = append(paths, dir)
+						}
+					}
+				}
+			}
+		}
+		paths = append(paths, a.Classmap...)
+		paths = append(paths, a.Files...)
+	}
+	for _, p := range paths {
+		if filename := filepath.Join(composerRoot, p); fileutil.FileExists(filename) {
+			sources = append(sources, filename)
+		}
+	}
+	return sources
+}
+
+// hashTree returns a hash of the file or every *.php file inside the dir.
+func hashTree(root string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if sum, ok := treeHashes.Load(realRoot); ok {
+		return sum.(string), nil
+	}
+	info, err := os.Stat(realRoot)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return hashFile(realRoot, info)
+	}
+	h := sha256.New()
+	err = walkPHPFiles(realRoot, func(path string, info os.FileInfo) error {
+		sum, err := hashFile(path, info)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "file %s %s\n", strings.TrimPrefix(path, realRoot), sum)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	treeHashes.Store(realRoot, sum)
+	return sum, nil
+}
+
+func hashFile(path string, info os.FileInfo) (string, error) {
+	memoKey := fmt.Sprintf("%s\x00%d\x00%d", path, info.Size(), info.ModTime().UnixNano())
+	if sum, ok := fileHashes.Load(memoKey); ok {
+		return sum.(string), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	fileHashes.Store(memoKey, sum)
+	return sum, nil
+}
+
+// walkPHPFiles is like filepath.Walk, but it follows symlinks
+// (build dirs consist of them) and only visits *.php files.
+// Hidden directories are skipped.
+func walkPHPFiles(root string, visit func(path string, info os.FileInfo) error) error {
+	visited := make(map[string]bool)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		if visited[realDir] {
+			return nil
+		}
+		visited[realDir] = true
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			path := filepath.Join(dir, info.Name())
+			if info.Mode()&os.ModeSymlink != 0 {
+				info, err = os.Stat(path)
+				if err != nil {
+					continue // A dangling symlink
+				}
+			}
+			if info.IsDir() {
+				if strings.HasPrefix(info.Name(), ".") {
+					continue
+				}
+				if err := walk(path); err != nil {
+					return err
+				}
+				continue
+			}
+			if strings.HasSuffix(info.Name(), ".php") {
+				if err := visit(path, info); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(root)
+}
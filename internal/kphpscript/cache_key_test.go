@@ -0,0 +1,67 @@
+package kphpscript
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VKCOM/ktest/internal/fileutil"
+)
+
+func TestBuildCacheKeyIndependentMains(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "ktest-cache-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+
+	writeFile := func(name, contents string) {
+		t.Helper()
+		if err := fileutil.WriteFile(filepath.Join(workdir, name), []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("mains/0.php", "<?php\nrequire_once '"+filepath.Join(workdir, "suites/0.php")+"';\n")
+	writeFile("mains/1.php", "<?php\nrequire_once '"+filepath.Join(workdir, "suites/1.php")+"';\n")
+	writeFile("suites/0.php", "<?php\nrequire_once '../tests/ATest.php';\n")
+	writeFile("suites/1.php", "<?php\nrequire_once '../tests/BTest.php';\n")
+	writeFile("tests/ATest.php", "<?php\nclass ATest {}\n")
+	writeFile("tests/BTest.php", "<?php\nclass BTest {}\n")
+
+	key := func(main string) string {
+		t.Helper()
+		config := BuildConfig{
+			KPHPCommand: "sh",
+			Script:      main,
+			OutputDir:   filepath.Join(workdir, "out"),
+			Workdir:     workdir,
+		}
+		k, err := buildCacheKey(config, []string{"--mode", "cli", main})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	key0 := key("mains/0.php")
+	key1 := key("mains/1.php")
+	if key0 == key1 {
+		t.Fatalf("different mains have the same key %s", key0)
+	}
+
+	// Changing the test required by the second main must not affect the first one.
+	writeFile("tests/BTest.php", "<?php\nclass BTest { public function testFoo() {} }\n")
+	if k := key("mains/0.php"); k != key0 {
+		t.Errorf("mains/0.php key is changed by a file it doesn't require")
+	}
+	if k := key("mains/1.php"); k == key1 {
+		t.Errorf("mains/1.php key is not changed by its required file")
+	}
+
+	// A new generated main doesn't affect the existing ones either.
+	writeFile("mains/2.php", "<?php\necho 'hello';\n")
+	if k := key("mains/0.php"); k != key0 {
+		t.Errorf("mains/0.php key is changed by another main")
+	}
+}
@@ -2,12 +2,16 @@ package kphpscript
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/VKCOM/ktest/internal/buildcache"
 )
 
 type BuildConfig struct {
@@ -18,10 +22,18 @@ type BuildConfig struct {
 	OutputDir                 string
 	Workdir                   string
 	AdditionalKphpIncludeDirs string
+
+	// Cache is an optional build cache.
+	// If the build result is found there, kphp2cpp is not executed.
+	Cache *buildcache.Cache
 }
 
 type BuildResult struct {
 	Executable string
+	Cached     bool
+
+	// Time is the compilation time; it's zero for the cached builds.
+	Time time.Duration
 }
 
 type RunConfig struct {
@@ -31,6 +43,13 @@ type RunConfig struct {
 	ScriptArgs     []string
 	Stdout         io.Writer
 	Stderr         io.Writer
+
+	// Env is added to the current process environment.
+	Env []string
+
+	// Context kills the executable when it's done, if not nil.
+	// Use it to set the run deadline.
+	Context context.Context
 }
 
 type RunResult struct {
@@ -56,14 +75,33 @@ func Build(config BuildConfig) (*BuildResult, error) {
 		}
 	}
 	args = append(args, config.Script)
+	result := &BuildResult{
+		Executable: filepath.Join(config.OutputDir, "cli"),
+	}
+
+	// Cache errors are not fatal: we can always build the script from scratch.
+	var cacheKey string
+	if config.Cache != nil {
+		key, err := buildCacheKey(config, args)
+		if err == nil {
+			cacheKey = key
+			result.Cached, _ = config.Cache.Get(cacheKey, result.Executable)
+			if result.Cached {
+				return result, nil
+			}
+		}
+	}
+
 	buildCommand := exec.Command(config.KPHPCommand, args...)
 	buildCommand.Dir = config.Workdir
+	start := time.Now()
 	out, err := buildCommand.CombinedOutput()
+	result.Time = time.Since(start)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v: %s", config.KPHPCommand, err, out)
 	}
-	result := &BuildResult{
-		Executable: filepath.Join(config.OutputDir, "cli"),
+	if cacheKey != "" {
+		config.Cache.Put(cacheKey, result.Executable)
 	}
 	return result, nil
 }
@@ -74,8 +112,15 @@ func Run(config RunConfig) (*RunResult, error) {
 	if config.ProfilerPrefix != "" {
 		args = append(args, "--profiler-log-prefix", config.ProfilerPrefix)
 	}
-	runCommand := exec.Command(config.Executable, args...)
+	ctx := config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	runCommand := exec.CommandContext(ctx, config.Executable, args...)
 	runCommand.Dir = config.Workdir
+	if len(config.Env) != 0 {
+		runCommand.Env = append(os.Environ(), config.Env...)
+	}
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	runCommand.Stdout = &stdout
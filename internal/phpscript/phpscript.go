@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"time"
 
@@ -25,6 +26,9 @@ type RunConfig struct {
 	ScriptArgs []string
 	Stdout     io.Writer
 	Stderr     io.Writer
+
+	// Env is added to the current process environment.
+	Env []string
 }
 
 func Run(config RunConfig) (*RunResult, error) {
@@ -51,6 +55,9 @@ func Run(config RunConfig) (*RunResult, error) {
 	args = append(args, config.ScriptArgs...)
 	runCommand := exec.Command(config.PHPCommand, args...)
 	runCommand.Dir = config.Workdir
+	if len(config.Env) != 0 {
+		runCommand.Env = append(os.Environ(), config.Env...)
+	}
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	runCommand.Stdout = &stdout
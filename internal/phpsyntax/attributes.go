@@ -0,0 +1,177 @@
+package phpsyntax
+
+import (
+	"bytes"
+)
+
+// Attribute is a PHP 8 attribute group, like #[DataProvider('provideValues')].
+// Start and End are the byte offsets of the whole group inside the source.
+type Attribute struct {
+	Start int
+	End   int
+	Text  string
+}
+
+// MaskAttributes finds the PHP 8 attribute groups and replaces them with spaces,
+// so the sources with attributes can be parsed by the PHP 7 grammar.
+//
+// The byte offsets and the line numbers are kept: the newlines inside
+// the attributes are not replaced. If there are no attributes, src is returned as is.
+func MaskAttributes(src []byte) ([]byte, []Attribute) {
+	var attrs []Attribute
+	s := &attrScanner{src: src}
+	for {
+		start := s.nextAttribute()
+		if start == -1 {
+			break
+		}
+		end := s.skipGroup(start + len("#"))
+		if end == -1 {
+			break // Unterminated, it's reported by the parser
+		}
+		attrs = append(attrs, Attribute{Start: start, End: end, Text: string(src[start:end])})
+	}
+	if len(attrs) == 0 {
+		return src, nil
+	}
+
+	masked := make([]byte, len(src))
+	copy(masked, src)
+	for _, attr := range attrs {
+		for i := attr.Start; i < attr.End; i++ {
+			if masked[i] != '\n' && masked[i] != '\r' {
+				masked[i] = ' '
+			}
+		}
+	}
+	return masked, attrs
+}
+
+// attrScanner skips the inline HTML, comments and string literals
+// to find the attribute groups in the PHP code.
+type attrScanner struct {
+	src []byte
+	pos int
+	php bool
+}
+
+// nextAttribute returns the next "#[" offset or -1.
+func (s *attrScanner) nextAttribute() int {
+	for s.pos < len(s.src) {
+		if !s.php {
+			i := bytes.Index(s.src[s.pos:], []byte("<?"))
+			if i == -1 {
+				s.pos = len(s.src)
+				return -1
+			}
+			s.pos += i + len("<?")
+			s.php = true
+			continue
+		}
+		rest := s.src[s.pos:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("?>")):
+			s.pos += len("?>")
+			s.php = false
+		case bytes.HasPrefix(rest, []byte("#[")):
+			return s.pos
+		case rest[0] == '#' || bytes.HasPrefix(rest, []byte("//")):
+			s.skipLineComment()
+		case bytes.HasPrefix(rest, []byte("/*")):
+			s.skipTo("*/", s.pos+len("/*"))
+		case bytes.HasPrefix(rest, []byte("<<<")):
+			s.skipHeredoc()
+		case rest[0] == '\'' || rest[0] == '"' || rest[0] == '`':
+			s.skipString()
+		default:
+			s.pos++
+		}
+	}
+	return -1
+}
+
+// skipGroup skips the brackets that start at the pos,
+// it returns the offset after the closing bracket or -1.
+func (s *attrScanner) skipGroup(pos int) int {
+	s.pos = pos
+	depth := 0
+	for s.pos < len(s.src) {
+		switch c := s.src[s.pos]; c {
+		case '[', '(':
+			depth++
+			s.pos++
+		case ']', ')':
+			depth--
+			s.pos++
+			if depth == 0 {
+				return s.pos
+			}
+		case '\'', '"':
+			s.skipString()
+		default:
+			s.pos++
+		}
+	}
+	return -1
+}
+
+func (s *attrScanner) skipLineComment() {
+	for s.pos < len(s.src) && s.src[s.pos] != '\n' {
+		if bytes.HasPrefix(s.src[s.pos:], []byte("?>")) {
+			return
+		}
+		s.pos++
+	}
+}
+
+func (s *attrScanner) skipTo(end string, from int) {
+	i := bytes.Index(s.src[from:], []byte(end))
+	if i == -1 {
+		s.pos = len(s.src)
+		return
+	}
+	s.pos = from + i + len(end)
+}
+
+func (s *attrScanner) skipString() {
+	quote := s.src[s.pos]
+	s.pos++
+	for s.pos < len(s.src) {
+		switch s.src[s.pos] {
+		case '\\':
+			s.pos += 2
+		case quote:
+			s.pos++
+			return
+		default:
+			s.pos++
+		}
+	}
+}
+
+// skipHeredoc skips the heredoc and nowdoc literals;
+// the closing identifier can be indented (PHP 7.3+).
+func (s *attrScanner) skipHeredoc() {
+	lineEnd := bytes.IndexByte(s.src[s.pos:], '\n')
+	if lineEnd == -1 {
+		s.pos = len(s.src)
+		return
+	}
+	label := bytes.TrimSpace(s.src[s.pos+len("<<<") : s.pos+lineEnd])
+	label = bytes.Trim(label, `'"`)
+	s.pos += lineEnd + 1
+	if len(label) == 0 {
+		return
+	}
+	for s.pos < len(s.src) {
+		line := s.src[s.pos:]
+		if end := bytes.IndexByte(line, '\n'); end != -1 {
+			line = line[:end]
+		}
+		if bytes.HasPrefix(bytes.TrimLeft(line, " \t"), label) {
+			s.pos += len(line) - len(bytes.TrimLeft(line, " \t")) + len(label)
+			return
+		}
+		s.pos += len(line) + 1
+	}
+}
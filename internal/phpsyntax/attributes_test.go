@@ -0,0 +1,56 @@
+package phpsyntax
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMaskAttributes(t *testing.T) {
+	tests := []struct {
+		src   string
+		attrs []string
+	}{
+		{
+			src:   "<?php\n#[Test]\nfunction f() {}\n",
+			attrs: []string{"#[Test]"},
+		},
+		{
+			src:   "<?php\n#[\n  A('x]'),\n  B(new C([1, 2])),\n]\nclass D {}\n",
+			attrs: []string{"#[\n  A('x]'),\n  B(new C([1, 2])),\n]"},
+		},
+		{
+			src:   "<?php\nfunction f(#[A] $x, #[B(\"#[\")] $y) {}\n",
+			attrs: []string{"#[A]", `#[B("#[")]`},
+		},
+		{
+			src: "#[html]<?php\n# comment\n// #[A]\n/* #[B] */\n$s = '#[C]' . \"#[D]\" . <<<EOT\n#[E]\nEOT;\n?>#[F]",
+		},
+	}
+
+	for _, test := range tests {
+		masked, attrs := MaskAttributes([]byte(test.src))
+		var have []string
+		for _, attr := range attrs {
+			have = append(have, attr.Text)
+			if test.src[attr.Start:attr.End] != attr.Text {
+				t.Errorf("MaskAttributes(%q): %q offsets point to %q", test.src, attr.Text, test.src[attr.Start:attr.End])
+			}
+		}
+		if diff := cmp.Diff(test.attrs, have); diff != "" {
+			t.Errorf("MaskAttributes(%q) mismatch (-want +have):\n%s", test.src, diff)
+		}
+
+		if len(masked) != len(test.src) {
+			t.Errorf("MaskAttributes(%q): the source length is changed", test.src)
+		}
+		for _, attr := range attrs {
+			for i := attr.Start; i < attr.End; i++ {
+				if c := test.src[i]; (c == '\n') != (masked[i] == '\n') || (c != '\n' && masked[i] != ' ') {
+					t.Errorf("MaskAttributes(%q): byte %d is %q", test.src, i, masked[i])
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Package phpsyntax describes the PHP language versions that ktest can parse.
+package phpsyntax
+
+import (
+	"fmt"
+
+	"github.com/z7zmey/php-parser/pkg/version"
+)
+
+// DefaultVersion is the newest PHP version supported by the parser.
+//
+// The parser has no PHP 8 grammar, so PHP 8 syntax (constructor promotion,
+// named arguments, match, nullsafe calls, attributes and enums) can't be parsed.
+const DefaultVersion = "7.4"
+
+// ParseVersion parses a "major.minor" PHP version and checks
+// that it's supported by the parser. An empty string means DefaultVersion.
+func ParseVersion(s string) (*version.Version, error) {
+	if s == "" {
+		s = DefaultVersion
+	}
+	v, err := version.New(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PHP version %q: expected major.minor", s)
+	}
+	if err := v.Validate(); err != nil {
+		return nil, fmt.Errorf("PHP %s syntax is not supported, the newest supported version is %s", s, DefaultVersion)
+	}
+	return v, nil
+}
@@ -0,0 +1,31 @@
+package phpsyntax
+
+import (
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		ok      bool
+	}{
+		{"", true},
+		{"7.4", true},
+		{"7.0", true},
+		{"5.6", true},
+		{"8.0", false},
+		{"8.1", false},
+		{"7", false},
+		{"php7.4", false},
+	}
+
+	for _, test := range tests {
+		_, err := ParseVersion(test.version)
+		if test.ok && err != nil {
+			t.Errorf("ParseVersion(%q): unexpected error: %v", test.version, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("ParseVersion(%q): expected an error", test.version)
+		}
+	}
+}
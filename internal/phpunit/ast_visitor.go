@@ -4,19 +4,52 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/VKCOM/ktest/internal/phpsyntax"
 	"github.com/z7zmey/php-parser/pkg/ast"
+	"github.com/z7zmey/php-parser/pkg/token"
 	"github.com/z7zmey/php-parser/pkg/visitor"
 )
 
 type astVisitor struct {
 	visitor.Null
+	nameResolver
 	out *testParsedInfo
 
-	currentClass string
+	// attributes are the masked PHP 8 attributes of the file.
+	attributes []phpsyntax.Attribute
+
+	currentClass  *testClass
+	currentMethod *testMethod
+
+	// currentClassEnd is the current class end offset.
+	// The traverser has no leave hooks, so the class scope
+	// is closed by the first node that starts after it.
+	currentClassEnd int
+}
+
+// leaveClass resets the current class if the node is outside of it,
+// so the functions and closures declared after the class are not rewritten.
+func (v *astVisitor) leaveClass(n ast.Vertex) {
+	if v.currentClass == nil {
+		return
+	}
+	if pos := n.GetPosition(); pos != nil && pos.StartPos >= v.currentClassEnd {
+		v.currentClass = nil
+		v.currentMethod = nil
+	}
+}
+
+func (v *astVisitor) StmtNamespace(n *ast.StmtNamespace) {
+	v.enterNamespace(n)
 }
 
 func (v *astVisitor) ExprMethodCall(n *ast.ExprMethodCall) {
-	if v.currentClass != v.out.ClassName {
+	v.leaveClass(n)
+	// Only the classes that extend something can be test cases.
+	if v.currentClass == nil || v.currentClass.Parent == "" {
+		return
+	}
+	if v.rewriteMockConfig(n) {
 		return
 	}
 	object, ok := n.Var.(*ast.ExprVariable)
@@ -32,14 +65,294 @@ func (v *astVisitor) ExprMethodCall(n *ast.ExprMethodCall) {
 		return
 	}
 	switch string(methodName.Value) {
-	case "fail", "assertTrue", "assertFalse", "assertSame", "assertNotSame", "assertEquals", "assertNotEquals":
-		lineMethodName := "_" + string(methodName.Value) + "WithLine"
+	case "assertNull", "assertNotNull":
+		// KPHP can't pass class instances as mixed, so the
+		// null check is done in place: assertNull(__LINE__, ($x) === null).
+		if len(n.Args) == 0 {
+			return
+		}
+		runtimeFunc := "__kphpunit_assert_null"
+		if string(methodName.Value) == "assertNotNull" {
+			runtimeFunc = "__kphpunit_assert_not_null"
+		}
+		argPos := n.Args[0].GetPosition()
+		v.out.fixes = append(v.out.fixes,
+			textEdit{
+				StartPos:    n.Var.GetPosition().StartPos,
+				EndPos:      argPos.StartPos,
+				Replacement: fmt.Sprintf("%s(__LINE__, (", runtimeFunc),
+			},
+			textEdit{
+				StartPos:    argPos.EndPos,
+				EndPos:      argPos.EndPos,
+				Replacement: ") === null",
+			})
+	case "assertInstanceOf":
+		// Same as above, but instanceof also requires a class name literal.
+		if len(n.Args) < 2 {
+			return
+		}
+		className := v.classNameLiteral(n.Args[0])
+		if className == "" {
+			return
+		}
+		argPos := n.Args[1].GetPosition()
+		v.out.fixes = append(v.out.fixes,
+			textEdit{
+				StartPos:    n.Var.GetPosition().StartPos,
+				EndPos:      argPos.StartPos,
+				Replacement: fmt.Sprintf("__kphpunit_assert_instance_of(__LINE__, '%s', (", className),
+			},
+			textEdit{
+				StartPos:    argPos.EndPos,
+				EndPos:      argPos.EndPos,
+				Replacement: fmt.Sprintf(") instanceof \\%s", className),
+			})
+	case "expectException", "expectExceptionMessage", "expectExceptionCode":
+		// Expectations are checked by the generated test suite,
+		// so the calls are redirected to the runtime functions.
+		runtimeFunc := map[string]string{
+			"expectException":        "__kphpunit_expect_exception",
+			"expectExceptionMessage": "__kphpunit_expect_exception_message",
+			"expectExceptionCode":    "__kphpunit_expect_exception_code",
+		}[string(methodName.Value)]
 		v.out.fixes = append(v.out.fixes, textEdit{
-			StartPos:    methodName.GetPosition().StartPos,
+			StartPos:    n.Var.GetPosition().StartPos,
 			EndPos:      n.OpenParenthesisTkn.GetPosition().EndPos,
-			Replacement: fmt.Sprintf("%s(__LINE__, ", lineMethodName),
+			Replacement: fmt.Sprintf("%s(__LINE__, ", runtimeFunc),
+		})
+		if string(methodName.Value) == "expectException" && v.currentMethod != nil && len(n.Args) == 1 {
+			v.addExpectedException(v.currentMethod, n.Args[0])
+		}
+	case "markTestSkipped", "markTestIncomplete":
+		// The runtime reports the test status and interrupts the test.
+		replacement := "__kphpunit_mark_test_skipped(__LINE__"
+		if string(methodName.Value) == "markTestIncomplete" {
+			replacement = "__kphpunit_mark_test_incomplete(__LINE__"
+		}
+		if len(n.Args) != 0 {
+			replacement += ", "
+		}
+		v.out.fixes = append(v.out.fixes, textEdit{
+			StartPos:    n.Var.GetPosition().StartPos,
+			EndPos:      n.OpenParenthesisTkn.GetPosition().EndPos,
+			Replacement: replacement,
+		})
+	case "createMock", "createStub":
+		// Test doubles are generated before the compilation (see mockGenerator).
+		if len(n.Args) != 1 {
+			return
+		}
+		className := v.classNameLiteral(n.Args[0])
+		if className == "" {
+			return
+		}
+		v.addMock(className)
+		pos := n.GetPosition()
+		v.out.fixes = append(v.out.fixes, textEdit{
+			StartPos:    pos.StartPos,
+			EndPos:      pos.EndPos,
+			Replacement: fmt.Sprintf("(new \\%s())", mockClassName(className)),
 		})
+	default:
+		v.rewriteRuntimeAssert(n.Var, string(methodName.Value), n.OpenParenthesisTkn, len(n.Args))
+	}
+}
+
+// ExprStaticCall rewrites the self::assertX() and static::assertX() calls
+// the same way as the $this->assertX() ones.
+func (v *astVisitor) ExprStaticCall(n *ast.ExprStaticCall) {
+	v.leaveClass(n)
+	if v.currentClass == nil || v.currentClass.Parent == "" {
+		return
+	}
+	var className string
+	switch class := n.Class.(type) {
+	case *ast.Identifier:
+		className = string(class.Value) // static
+	case *ast.Name:
+		className = astNameToString(class) // self and parent
+	}
+	switch strings.ToLower(className) {
+	case "self", "static", "parent":
+	default:
+		return
+	}
+	methodName, ok := n.Call.(*ast.Identifier)
+	if !ok {
+		return
+	}
+	v.rewriteRuntimeAssert(n.Class, string(methodName.Value), n.OpenParenthesisTkn, len(n.Args))
+}
+
+// rewriteRuntimeAssert replaces the assertion call with the runtime function
+// call (see runtimeSource); the callee is the object or the class the method is called on.
+func (v *astVisitor) rewriteRuntimeAssert(callee ast.Vertex, methodName string, openParen *token.Token, numArgs int) {
+	call, ok := runtimeAssertCalls[methodName]
+	if !ok {
+		return
+	}
+	if numArgs == 0 {
+		call = strings.TrimSuffix(call, ", ")
+	}
+	v.out.fixes = append(v.out.fixes, textEdit{
+		StartPos:    callee.GetPosition().StartPos,
+		EndPos:      openParen.Position.EndPos,
+		Replacement: call,
+	})
+}
+
+var runtimeAssertCalls = map[string]string{
+	"fail":                          "__kphpunit_fail(__LINE__, ",
+	"assertTrue":                    "__kphpunit_assert_true(__LINE__, ",
+	"assertFalse":                   "__kphpunit_assert_false(__LINE__, ",
+	"assertSame":                    "__kphpunit_assert_same(__LINE__, ",
+	"assertNotSame":                 "__kphpunit_assert_not_same(__LINE__, ",
+	"assertEquals":                  "__kphpunit_assert_equals(__LINE__, ",
+	"assertNotEquals":               "__kphpunit_assert_not_equals(__LINE__, ",
+	"assertCount":                   "__kphpunit_assert_count(__LINE__, ",
+	"assertNotCount":                "__kphpunit_assert_not_count(__LINE__, ",
+	"assertEmpty":                   "__kphpunit_assert_empty(__LINE__, ",
+	"assertNotEmpty":                "__kphpunit_assert_not_empty(__LINE__, ",
+	"assertContains":                "__kphpunit_assert_contains(__LINE__, ",
+	"assertNotContains":             "__kphpunit_assert_not_contains(__LINE__, ",
+	"assertArrayHasKey":             "__kphpunit_assert_array_has_key(__LINE__, ",
+	"assertArrayNotHasKey":          "__kphpunit_assert_array_not_has_key(__LINE__, ",
+	"assertStringContainsString":    "__kphpunit_assert_string_contains_string(__LINE__, ",
+	"assertStringNotContainsString": "__kphpunit_assert_string_not_contains_string(__LINE__, ",
+	"assertStringStartsWith":        "__kphpunit_assert_string_starts_with(__LINE__, ",
+	"assertStringEndsWith":          "__kphpunit_assert_string_ends_with(__LINE__, ",
+	"assertEqualsWithDelta":         "__kphpunit_assert_equals_with_delta(__LINE__, ",
+	"assertGreaterThan":             "__kphpunit_assert_greater_than(__LINE__, ",
+	"assertGreaterThanOrEqual":      "__kphpunit_assert_greater_than_or_equal(__LINE__, ",
+	"assertLessThan":                "__kphpunit_assert_less_than(__LINE__, ",
+	"assertLessThanOrEqual":         "__kphpunit_assert_less_than_or_equal(__LINE__, ",
+	"assertIsArray":                 "__kphpunit_assert_type(__LINE__, 'array', ",
+	"assertIsBool":                  "__kphpunit_assert_type(__LINE__, 'bool', ",
+	"assertIsFloat":                 "__kphpunit_assert_type(__LINE__, 'float', ",
+	"assertIsInt":                   "__kphpunit_assert_type(__LINE__, 'int', ",
+	"assertIsString":                "__kphpunit_assert_type(__LINE__, 'string', ",
+}
+
+// rewriteMockConfig replaces the $mock->method('x')->willReturn(...) calls
+// with the generated test double methods: $mock->__ktest_will_return_x(...).
+func (v *astVisitor) rewriteMockConfig(n *ast.ExprMethodCall) bool {
+	configMethod, ok := n.Method.(*ast.Identifier)
+	if !ok {
+		return false
+	}
+	var doubleMethodPrefix string
+	switch string(configMethod.Value) {
+	case "willReturn":
+		doubleMethodPrefix = mockReturnMethodPrefix
+	case "willThrowException":
+		doubleMethodPrefix = mockThrowMethodPrefix
+	default:
+		return false
+	}
+	selector, ok := n.Var.(*ast.ExprMethodCall)
+	if !ok || len(selector.Args) != 1 {
+		return false
+	}
+	selectorName, ok := selector.Method.(*ast.Identifier)
+	if !ok || string(selectorName.Value) != "method" {
+		return false
+	}
+	mockedMethod := stringLiteral(selector.Args[0])
+	if mockedMethod == "" {
+		return false
+	}
+	v.out.fixes = append(v.out.fixes, textEdit{
+		StartPos:    selector.Var.GetPosition().EndPos,
+		EndPos:      n.OpenParenthesisTkn.GetPosition().EndPos,
+		Replacement: "->" + doubleMethodPrefix + strings.ToLower(mockedMethod) + "(",
+	})
+	return true
+}
+
+func (v *astVisitor) addMock(className string) {
+	for _, existing := range v.out.Mocks {
+		if strings.EqualFold(existing, className) {
+			return
+		}
+	}
+	v.out.Mocks = append(v.out.Mocks, className)
+}
+
+// addExpectedException records the Foo::class exception expectation,
+// so the generated test suite can catch it (and its subclasses).
+func (v *astVisitor) addExpectedException(m *testMethod, arg ast.Vertex) {
+	className := v.classNameLiteral(arg)
+	if className == "" {
+		return
+	}
+	for _, existing := range m.ExpectedExceptions {
+		if existing == className {
+			return
+		}
+	}
+	m.ExpectedExceptions = append(m.ExpectedExceptions, className)
+}
+
+// classNameLiteral returns a fully qualified class name for the Foo::class argument.
+// An empty string is returned for any other expression.
+func (v *astVisitor) classNameLiteral(arg ast.Vertex) string {
+	if a, ok := arg.(*ast.Argument); ok {
+		arg = a.Expr
+	}
+	fetch, ok := arg.(*ast.ExprClassConstFetch)
+	if !ok {
+		return ""
+	}
+	constName, ok := fetch.Const.(*ast.Identifier)
+	if !ok || !strings.EqualFold(string(constName.Value), "class") {
+		return ""
+	}
+	return v.resolveClassName(fetch.Class)
+}
+
+// nameResolver tracks the current namespace and imports
+// to resolve the class names used inside a file.
+type nameResolver struct {
+	currentNamespace string
+
+	// uses maps the imported class aliases to their fully qualified names.
+	uses map[string]string
+}
+
+func (v *nameResolver) enterNamespace(n *ast.StmtNamespace) {
+	v.currentNamespace = ""
+	if name, ok := n.Name.(*ast.Name); ok {
+		v.currentNamespace = astNameToString(name) + `\`
+	}
+}
+
+// resolveClassName returns a fully qualified class name without the leading slash.
+// An empty string is returned for the names that can't be resolved statically.
+func (v *nameResolver) resolveClassName(n ast.Vertex) string {
+	switch n := n.(type) {
+	case *ast.NameFullyQualified:
+		return astNameToString(&ast.Name{Parts: n.Parts})
+	case *ast.NameRelative:
+		return v.currentNamespace + astNameToString(&ast.Name{Parts: n.Parts})
+	case *ast.Name:
+		name := astNameToString(n)
+		switch strings.ToLower(name) {
+		case "self", "static", "parent":
+			return ""
+		}
+		alias := name
+		rest := ""
+		if i := strings.IndexByte(name, '\\'); i != -1 {
+			alias = name[:i]
+			rest = name[i:]
+		}
+		if fqn, ok := v.uses[strings.ToLower(alias)]; ok {
+			return fqn + rest
+		}
+		return v.currentNamespace + name
 	}
+	return ""
 }
 
 func (v *astVisitor) StmtUse(n *ast.StmtUseList) {
@@ -52,6 +365,7 @@ func (v *astVisitor) StmtUse(n *ast.StmtUseList) {
 		if !ok {
 			continue
 		}
+		v.addUse(name, u.Alias)
 		if astNameToString(name) == `PHPUnit\Framework\TestCase` {
 			pos := u.Use.GetPosition()
 			v.out.fixes = append(v.out.fixes, textEdit{
@@ -63,21 +377,54 @@ func (v *astVisitor) StmtUse(n *ast.StmtUseList) {
 	}
 }
 
+func (v *nameResolver) addUse(name *ast.Name, alias ast.Vertex) {
+	fqn := astNameToString(name)
+	aliasName := string(name.Parts[len(name.Parts)-1].(*ast.NamePart).Value)
+	if ident, ok := alias.(*ast.Identifier); ok {
+		aliasName = string(ident.Value)
+	}
+	if v.uses == nil {
+		v.uses = make(map[string]string)
+	}
+	// Class names are case-insensitive.
+	v.uses[strings.ToLower(aliasName)] = fqn
+}
+
 func (v *astVisitor) StmtClass(n *ast.StmtClass) {
 	ident, ok := n.Name.(*ast.Identifier)
 	if !ok {
 		return
 	}
-	className := string(ident.Value)
-	if !strings.HasSuffix(className, "Test") {
-		return
+	// All classes are collected: a test class can extend
+	// an abstract test case declared in the same file.
+	class := &testClass{
+		Name:     v.currentNamespace + string(ident.Value),
+		Abstract: hasModifier(n.Modifiers, "abstract"),
+		Groups:   groupNames(classTags(n, v.attributes)),
+	}
+	if n.Extends != nil {
+		class.Parent = v.resolveClassName(n.Extends)
 	}
-	v.out.ClassName = className
-	v.currentClass = className
+	v.out.Classes = append(v.out.Classes, class)
+	v.currentClass = class
+	v.currentClassEnd = n.Position.EndPos
+	v.currentMethod = nil
+}
+
+// StmtInterface and StmtTrait reset the current class,
+// so their methods are not treated as test methods.
+func (v *astVisitor) StmtInterface(n *ast.StmtInterface) {
+	v.currentClass = nil
+}
+
+func (v *astVisitor) StmtTrait(n *ast.StmtTrait) {
+	v.currentClass = nil
 }
 
 func (v *astVisitor) StmtClassMethod(n *ast.StmtClassMethod) {
-	if v.currentClass != v.out.ClassName {
+	v.leaveClass(n)
+	c := v.currentClass
+	if c == nil || c.Parent == "" {
 		return
 	}
 	ident, ok := n.Name.(*ast.Identifier)
@@ -85,14 +432,67 @@ func (v *astVisitor) StmtClassMethod(n *ast.StmtClassMethod) {
 		return
 	}
 	methodName := string(ident.Value)
+	v.currentMethod = nil
+	tags := classMethodTags(n, v.attributes)
 	switch methodName {
 	case "setUpBeforeClass":
-		v.out.HasSetUpBeforeClass = true
+		c.HasSetUpBeforeClass = true
 	case "tearDownAfterClass":
-		v.out.HasTearDownAfterClass = true
+		c.HasTearDownAfterClass = true
+	case "setUp":
+		c.HasSetUp = true
+		v.makePublic(n)
+	case "tearDown":
+		c.HasTearDown = true
+		v.makePublic(n)
+	default:
+		if _, ok := tags["before"]; ok {
+			c.BeforeMethods = append(c.BeforeMethods, methodName)
+			v.makePublic(n)
+		}
+		if _, ok := tags["after"]; ok {
+			c.AfterMethods = append(c.AfterMethods, methodName)
+			v.makePublic(n)
+		}
+	}
+	if hasModifier(n.Modifiers, "static") {
+		if c.StaticMethods == nil {
+			c.StaticMethods = make(map[string]bool)
+		}
+		c.StaticMethods[methodName] = true
 	}
-	if !strings.HasPrefix(methodName, "test") {
+	if _, ok := tags["test"]; !ok && !strings.HasPrefix(methodName, "test") {
 		return
 	}
-	v.out.TestMethods = append(v.out.TestMethods, methodName)
+	m := &testMethod{
+		Name:          methodName,
+		Line:          n.Position.StartLine,
+		DataProviders: tags["dataProvider"],
+		Groups:        groupNames(tags),
+	}
+	for _, p := range n.Params {
+		m.Params = append(m.Params, testParam{Cast: paramCast(p)})
+	}
+	c.TestMethods = append(c.TestMethods, m)
+	v.currentMethod = m
+}
+
+// makePublic rewrites the method visibility to public,
+// so the generated test main can call it (like setUp, which is usually protected).
+func (v *astVisitor) makePublic(n *ast.StmtClassMethod) {
+	for _, m := range n.Modifiers {
+		ident, ok := m.(*ast.Identifier)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(string(ident.Value)) {
+		case "protected", "private":
+			pos := ident.GetPosition()
+			v.out.fixes = append(v.out.fixes, textEdit{
+				StartPos:    pos.StartPos,
+				EndPos:      pos.EndPos,
+				Replacement: "public",
+			})
+		}
+	}
 }
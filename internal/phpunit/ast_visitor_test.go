@@ -0,0 +1,465 @@
+package phpunit
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/VKCOM/ktest/internal/fileutil"
+	"github.com/google/go-cmp/cmp"
+)
+
+// prepareTestdata runs the runner steps up to the test main generation
+// for the testdata project tests; nothing is compiled or written.
+func prepareTestdata(t *testing.T, project string) *runner {
+	t.Helper()
+	testDir, err := filepath.Abs(filepath.Join("testdata", project, "tests"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prepareTests(t, testDir)
+}
+
+// prepareTestSources is like prepareTestdata, but the test files
+// are given by their contents.
+func prepareTestSources(t *testing.T, files map[string]string) *runner {
+	t.Helper()
+	testDir := t.TempDir()
+	for name, contents := range files {
+		if err := fileutil.WriteFile(filepath.Join(testDir, name), []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return prepareTests(t, testDir)
+}
+
+func prepareTests(t *testing.T, testDir string) *runner {
+	t.Helper()
+	r := newRunner(&RunConfig{TestTarget: testDir, Output: ioutil.Discard})
+	steps := []func() error{
+		r.stepFindTestFiles,
+		r.stepParseTestFiles,
+		r.stepFilterOnlyParsedFiles,
+		r.stepSortTestFiles,
+		r.stepResolveTestClasses,
+		r.stepPreprocessContents,
+		r.stepGenerateTestMain,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(r.result.FileErrors) != 0 {
+		t.Fatalf("file errors: %v", r.result.FileErrors)
+	}
+	return r
+}
+
+// findTestClass returns the test class to run by its name.
+func findTestClass(t *testing.T, r *runner, name string) (*testFile, *testClass) {
+	t.Helper()
+	for _, f := range r.testFiles {
+		for _, c := range f.classes {
+			if c.Name == name {
+				return f, c
+			}
+		}
+	}
+	t.Fatalf("test class %s is not found", name)
+	return nil, nil
+}
+
+// assertContains checks that the generated code contains every snippet.
+func assertContains(t *testing.T, what string, code []byte, snippets ...string) {
+	t.Helper()
+	for _, snippet := range snippets {
+		if !strings.Contains(string(code), snippet) {
+			t.Errorf("%s doesn't contain:\n%s\n\n%s:\n%s", what, snippet, what, code)
+		}
+	}
+}
+
+func TestVisitorDataProvider(t *testing.T) {
+	r := prepareTestdata(t, "data-provider")
+	f, c := findTestClass(t, r, "DataProviderTest")
+
+	want := []*testMethod{{
+		Name:              "testSum",
+		Line:              9,
+		Params:            []testParam{{Cast: "(int)"}, {Cast: "(int)"}, {Cast: "(int)"}},
+		DataProviders:     []string{"provideSums"},
+		DataProviderCalls: []string{`(new \DataProviderTest())->provideSums()`},
+	}}
+	if diff := cmp.Diff(want, c.TestMethods); diff != "" {
+		t.Errorf("test methods mismatch (-want +have):\n%s", diff)
+	}
+	assertContains(t, "generated suite", f.generatedSuite,
+		`foreach ((new \DataProviderTest())->provideSums() as $data_name => $data_set) {`,
+		`__kphpunit_data_set_name('testSum', $data_name)`,
+		`$test->testSum((int)$data_set[0], (int)$data_set[1], (int)$data_set[2]);`,
+	)
+}
+
+func TestVisitorDataProviderKinds(t *testing.T) {
+	r := prepareTestSources(t, map[string]string{
+		"ProvidersTest.php": `<?php
+
+use PHPUnit\Framework\TestCase;
+
+class ProvidersTest extends TestCase {
+    /** @dataProvider provideStatic */
+    public function testStatic(string $s, $any) {}
+
+    #[DataProvider('provideAttribute')]
+    public function testAttribute(float $x) {}
+
+    /** @dataProvider Helpers::provide */
+    public function testExternal(bool $b) {}
+
+    public static function provideStatic() { return [['a', 1]]; }
+
+    public function provideAttribute() { return [[1.5]]; }
+}
+`,
+	})
+	f, _ := findTestClass(t, r, "ProvidersTest")
+	assertContains(t, "generated suite", f.generatedSuite,
+		`foreach (\ProvidersTest::provideStatic() as $data_name => $data_set) {`,
+		`$test->testStatic((string)$data_set[0], $data_set[1]);`,
+		`foreach ((new \ProvidersTest())->provideAttribute() as $data_name => $data_set) {`,
+		`$test->testAttribute((float)$data_set[0]);`,
+		`foreach (Helpers::provide() as $data_name => $data_set) {`,
+		`$test->testExternal((bool)$data_set[0]);`,
+	)
+}
+
+func TestVisitorHooks(t *testing.T) {
+	r := prepareTestdata(t, "set-up")
+	f, c := findTestClass(t, r, "SetUpTest")
+
+	if diff := cmp.Diff([]string{"addBefore", "setUp"}, c.beforeHooks()); diff != "" {
+		t.Errorf("before hooks mismatch (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"tearDown"}, c.afterHooks()); diff != "" {
+		t.Errorf("after hooks mismatch (-want +have):\n%s", diff)
+	}
+	// The generated suite calls the hooks, so they are made public.
+	assertContains(t, "preprocessed test", f.preprocessedContents,
+		"public function setUp()",
+		"public function tearDown()",
+		"public function addBefore()",
+	)
+	assertContains(t, "generated suite", f.generatedSuite,
+		"    $test->addBefore();\n    $test->setUp();\n    $test_fn($test);\n",
+		"  try {\n    $test->tearDown();\n  } catch",
+	)
+}
+
+func TestVisitorInheritedHooks(t *testing.T) {
+	r := prepareTestSources(t, map[string]string{
+		"BaseCase.php": `<?php
+
+use PHPUnit\Framework\TestCase;
+
+abstract class BaseCase extends TestCase {
+    /** @before */
+    protected function connect() {}
+
+    /** @after */
+    protected function disconnect() {}
+
+    public static function setUpBeforeClass(): void {}
+}
+`,
+		"HooksTest.php": `<?php
+
+class HooksTest extends BaseCase {
+    /** @before */
+    public function prepare() {}
+
+    protected function tearDown(): void {}
+
+    /** @after */
+    private function cleanup() {}
+
+    public function testFoo() {}
+}
+`,
+	})
+	f, c := findTestClass(t, r, "HooksTest")
+
+	// Parent @before methods go first, parent @after methods go last.
+	if diff := cmp.Diff([]string{"connect", "prepare"}, c.beforeHooks()); diff != "" {
+		t.Errorf("before hooks mismatch (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"tearDown", "cleanup", "disconnect"}, c.afterHooks()); diff != "" {
+		t.Errorf("after hooks mismatch (-want +have):\n%s", diff)
+	}
+	if !c.HasSetUpBeforeClass {
+		t.Errorf("setUpBeforeClass is not inherited")
+	}
+	assertContains(t, "preprocessed test", f.preprocessedContents,
+		"public function tearDown(): void",
+		"public function cleanup()",
+	)
+	assertContains(t, "generated suite", f.generatedSuite,
+		`\HooksTest::setUpBeforeClass();`,
+	)
+	if len(f.requires) != 1 || !strings.HasSuffix(f.requires[0].fullName, "BaseCase.php") {
+		t.Errorf("the base test case file is not required: %v", f.requires)
+	}
+	assertContains(t, "preprocessed base case", f.requires[0].preprocessedContents,
+		"public function connect()",
+		"public function disconnect()",
+	)
+}
+
+func TestVisitorNamespaces(t *testing.T) {
+	r := prepareTestdata(t, "namespaces")
+
+	// Abstract classes are not run, but their test methods are inherited;
+	// the overridden methods are not duplicated.
+	want := []string{
+		`App\Tests\MathTest::testOverridden`,
+		`App\Tests\MathTest::testZero`,
+		`App\Tests\StringTest::testLength`,
+		`App\Tests\StringTest::testConcat`,
+	}
+	if diff := cmp.Diff(want, selectedTests(r)); diff != "" {
+		t.Errorf("tests mismatch (-want +have):\n%s", diff)
+	}
+
+	f, c := findTestClass(t, r, `App\Tests\MathTest`)
+	if c.Parent != `App\Tests\Base\AbstractMathCase` {
+		t.Errorf("parent is resolved to %q", c.Parent)
+	}
+	if !c.HasSetUp {
+		t.Errorf("setUp is not inherited from the abstract test case declared in another file")
+	}
+	if len(f.requires) != 1 || !strings.HasSuffix(f.requires[0].fullName, filepath.Join("Base", "AbstractMathCase.php")) {
+		t.Errorf("the abstract test case file is not required: %v", f.requires)
+	}
+	for _, m := range c.TestMethods {
+		// testOverridden is declared in MathTest, testZero is inherited.
+		inherited := m.Name == "testZero"
+		if inherited != (m.File == f.requires[0].fullName) {
+			t.Errorf("%s declaring file is %q", m.Name, m.File)
+		}
+	}
+	assertContains(t, "generated suite", f.generatedSuite,
+		`$test = new \App\Tests\MathTest();`,
+		`$test = new \App\Tests\StringTest();`,
+	)
+}
+
+func TestVisitorClassScope(t *testing.T) {
+	r := prepareTestSources(t, map[string]string{
+		"ScopeTest.php": `<?php
+
+use PHPUnit\Framework\TestCase;
+
+class Helper {
+    public function testNotATest() { $this->assertSame(1, 1); }
+}
+
+class ScopeTest extends TestCase {
+    public function testFoo() { $this->assertSame('foo', 'foo'); }
+}
+
+$callback = function() { return $this->assertSame('closure', 'closure'); };
+
+function helper() { return $this->assertSame('function', 'function'); }
+
+class SecondTest extends ScopeTest {
+    public function testBar() {}
+}
+`,
+	})
+
+	want := []string{
+		"ScopeTest::testFoo",
+		"SecondTest::testBar",
+		"SecondTest::testFoo",
+	}
+	if diff := cmp.Diff(want, selectedTests(r)); diff != "" {
+		t.Errorf("tests mismatch (-want +have):\n%s", diff)
+	}
+	f, _ := findTestClass(t, r, "ScopeTest")
+	assertContains(t, "preprocessed test", f.preprocessedContents,
+		// Only the test case calls are rewritten.
+		`$this->assertSame(1, 1);`,
+		`$this->assertSame('closure', 'closure');`,
+		`$this->assertSame('function', 'function');`,
+	)
+	if strings.Contains(string(f.preprocessedContents), `$this->assertSame('foo', 'foo')`) {
+		t.Errorf("test case assertion is not rewritten:\n%s", f.preprocessedContents)
+	}
+}
+
+func TestVisitorKphpunitAssertions(t *testing.T) {
+	r := prepareTestSources(t, map[string]string{
+		"AssertTest.php": `<?php
+
+use PHPUnit\Framework\TestCase;
+
+class AssertTest extends TestCase {
+    public function testThis() {
+        $this->assertTrue(true);
+        $this->assertFalse(false, 'message');
+        $this->assertSame(1, 1);
+        $this->assertNotSame(1, 2);
+        $this->assertEquals([1], [1]);
+        $this->assertNotEquals(1, 2);
+        $this->fail();
+    }
+
+    public function testStatic() {
+        self::assertSame('a', 'a');
+        static::assertEquals(1, 1.0);
+        parent::assertTrue(true);
+        self::fail('message');
+        Other::assertSame(1, 2);
+    }
+}
+`,
+	})
+	f, _ := findTestClass(t, r, "AssertTest")
+	assertContains(t, "preprocessed test", f.preprocessedContents,
+		"__kphpunit_assert_true(__LINE__, true);",
+		"__kphpunit_assert_false(__LINE__, false, 'message');",
+		"__kphpunit_assert_same(__LINE__, 1, 1);",
+		"__kphpunit_assert_not_same(__LINE__, 1, 2);",
+		"__kphpunit_assert_equals(__LINE__, [1], [1]);",
+		"__kphpunit_assert_not_equals(__LINE__, 1, 2);",
+		"__kphpunit_fail(__LINE__);",
+		"__kphpunit_assert_same(__LINE__, 'a', 'a');",
+		"__kphpunit_assert_equals(__LINE__, 1, 1.0);",
+		"__kphpunit_assert_true(__LINE__, true);",
+		"__kphpunit_fail(__LINE__, 'message');",
+		// Only the test case own assertions are rewritten.
+		"Other::assertSame(1, 2);",
+	)
+}
+
+func TestVisitorRuntimeAssertions(t *testing.T) {
+	r := prepareTestdata(t, "assertions")
+	f, _ := findTestClass(t, r, "AssertionsTest")
+
+	assertContains(t, "preprocessed test", f.preprocessedContents,
+		"__kphpunit_assert_count(__LINE__, 2, [1, 2]);",
+		"__kphpunit_assert_not_count(__LINE__, 3, [1, 2]);",
+		"__kphpunit_assert_empty(__LINE__, []);",
+		"__kphpunit_assert_not_empty(__LINE__, 'x');",
+		"__kphpunit_assert_null(__LINE__, (null) === null);",
+		"__kphpunit_assert_not_null(__LINE__, (new Exception()) === null);",
+		"__kphpunit_assert_contains(__LINE__, 2, [1, 2, 3]);",
+		"__kphpunit_assert_not_contains(__LINE__, '2', [1, 2, 3]);",
+		"__kphpunit_assert_array_has_key(__LINE__, 'a', ['a' => 1]);",
+		"__kphpunit_assert_array_not_has_key(__LINE__, 'b', ['a' => 1]);",
+		"__kphpunit_assert_string_contains_string(__LINE__, 'ell', 'hello');",
+		"__kphpunit_assert_string_not_contains_string(__LINE__, 'x', 'hello');",
+		"__kphpunit_assert_string_starts_with(__LINE__, 'he', 'hello');",
+		"__kphpunit_assert_string_ends_with(__LINE__, 'lo', 'hello');",
+		"__kphpunit_assert_equals_with_delta(__LINE__, 1.0, 1.05, 0.1);",
+		"__kphpunit_assert_greater_than(__LINE__, 1, 2);",
+		"__kphpunit_assert_greater_than_or_equal(__LINE__, 2, 2);",
+		"__kphpunit_assert_less_than(__LINE__, 2, 1);",
+		"__kphpunit_assert_less_than_or_equal(__LINE__, 2, 2);",
+		"__kphpunit_assert_type(__LINE__, 'array', []);",
+		"__kphpunit_assert_type(__LINE__, 'int', 1);",
+		"__kphpunit_assert_type(__LINE__, 'string', 's');",
+		`__kphpunit_assert_instance_of(__LINE__, 'LogicException', (new InvalidArgumentException()) instanceof \LogicException);`,
+		"__kphpunit_assert_count(__LINE__, 3, [1, 2], 'wrong count');",
+	)
+	if strings.Contains(string(f.preprocessedContents), "$this->assert") {
+		t.Errorf("some assertions are not rewritten:\n%s", f.preprocessedContents)
+	}
+}
+
+func TestVisitorAttributes(t *testing.T) {
+	r := prepareTestSources(t, map[string]string{
+		"AttributesTest.php": `<?php
+
+use PHPUnit\Framework\TestCase;
+use PHPUnit\Framework\Attributes\DataProvider;
+use PHPUnit\Framework\Attributes\Group;
+use PHPUnit\Framework\Attributes\Test;
+
+#[Group('slow')]
+class AttributesTest extends TestCase {
+    #[
+        DataProvider('provideValues'),
+        Group("db"),
+    ]
+    public function testValues(int $x) {}
+
+    #[Test] public function checksSameLine() {}
+
+    #[Group(name: 'a]b'), Test]
+    public function checksArgs() {}
+
+    // #[Test] is a comment here.
+    public function notATest() {}
+
+    public function provideValues() { return [[1]]; }
+}
+`,
+	})
+	_, c := findTestClass(t, r, "AttributesTest")
+
+	want := []*testMethod{
+		{
+			Name:              "testValues",
+			Line:              14,
+			Params:            []testParam{{Cast: "(int)"}},
+			DataProviders:     []string{"provideValues"},
+			DataProviderCalls: []string{`(new \AttributesTest())->provideValues()`},
+			Groups:            []string{"db"},
+		},
+		{Name: "checksSameLine", Line: 16},
+		{Name: "checksArgs", Line: 19, Groups: []string{"a]b"}},
+	}
+	if diff := cmp.Diff(want, c.TestMethods); diff != "" {
+		t.Errorf("test methods mismatch (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"slow"}, c.Groups); diff != "" {
+		t.Errorf("class groups mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestVisitorExpectException(t *testing.T) {
+	r := prepareTestdata(t, "exceptions")
+	f, c := findTestClass(t, r, "ExceptionsTest")
+
+	expected := make(map[string][]string)
+	for _, m := range c.TestMethods {
+		expected[m.Name] = m.ExpectedExceptions
+	}
+	want := map[string][]string{
+		"testExpected":       {"InvalidArgumentException"},
+		"testExpectedParent": {"LogicException"},
+		"testNotThrown":      {"RuntimeException"},
+		"testWrongMessage":   nil,
+		"testCode":           {"RuntimeException"},
+		"testUncaught":       nil,
+	}
+	if diff := cmp.Diff(want, expected); diff != "" {
+		t.Errorf("expected exceptions mismatch (-want +have):\n%s", diff)
+	}
+
+	assertContains(t, "preprocessed test", f.preprocessedContents,
+		"__kphpunit_expect_exception(__LINE__, InvalidArgumentException::class);",
+		"__kphpunit_expect_exception_message(__LINE__, 'bad');",
+		"__kphpunit_expect_exception_code(__LINE__, 42);",
+	)
+	if strings.Contains(string(f.preprocessedContents), "$this->expectException") {
+		t.Errorf("some expectations are not rewritten:\n%s", f.preprocessedContents)
+	}
+	// The subclasses are matched by the catch clauses of the generated suite.
+	assertContains(t, "generated suite", f.generatedSuite,
+		"    } catch (\\LogicException $e) {\n      __kphpunit_expected_exception_caught($e, 'LogicException');\n    }",
+		"    } catch (\\InvalidArgumentException $e) {\n      __kphpunit_expected_exception_caught($e, 'InvalidArgumentException');\n    }",
+	)
+}
@@ -0,0 +1,193 @@
+package phpunit
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/VKCOM/ktest/internal/fileutil"
+)
+
+// phpunitConfig is a part of phpunit.xml that ktest understands.
+type phpunitConfig struct {
+	// Filename is the loaded config file path.
+	Filename string `xml:"-"`
+
+	Bootstrap  string             `xml:"bootstrap,attr"`
+	TestSuites []phpunitTestSuite `xml:"testsuites>testsuite"`
+	Env        []phpunitEnv       `xml:"php>env"`
+}
+
+type phpunitTestSuite struct {
+	Name        string                  `xml:"name,attr"`
+	Directories []phpunitSuiteDirectory `xml:"directory"`
+	Files       []string                `xml:"file"`
+	Exclude     []string                `xml:"exclude"`
+}
+
+type phpunitSuiteDirectory struct {
+	Path   string `xml:",chardata"`
+	Suffix string `xml:"suffix,attr"`
+}
+
+type phpunitEnv struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+	Force bool   `xml:"force,attr"`
+}
+
+// loadPhpunitConfig reads phpunit.xml (or phpunit.xml.dist) from the dir.
+// It returns nil if there is no config file.
+func loadPhpunitConfig(dir string) (*phpunitConfig, error) {
+	for _, name := range []string{"phpunit.xml", "phpunit.xml.dist"} {
+		filename := filepath.Join(dir, name)
+		if !fileutil.FileExists(filename) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		config, err := parsePhpunitConfig(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		config.Filename = filename
+		return config, nil
+	}
+	return nil, nil
+}
+
+func parsePhpunitConfig(data []byte) (*phpunitConfig, error) {
+	var config phpunitConfig
+	if err := xml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// path resolves the config path relative to the config file dir.
+func (config *phpunitConfig) path(p string) string {
+	p = strings.TrimSpace(p)
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(filepath.Dir(config.Filename), p)
+}
+
+// bootstrapFilename returns the absolute bootstrap file path, if any.
+func (config *phpunitConfig) bootstrapFilename() string {
+	if config.Bootstrap == "" {
+		return ""
+	}
+	return config.path(config.Bootstrap)
+}
+
+// environ returns the <php><env> values as "name=value" pairs.
+// Like PHPUnit, it doesn't override the already set variables unless force="true" is used.
+func (config *phpunitConfig) environ() []string {
+	var env []string
+	for _, e := range config.Env {
+		if _, ok := os.LookupEnv(e.Name); ok && !e.Force {
+			continue
+		}
+		env = append(env, e.Name+"="+e.Value)
+	}
+	return env
+}
+
+// selectTestSuites returns the test suites with the comma separated names,
+// or all of them if names is empty.
+func (config *phpunitConfig) selectTestSuites(names string) ([]phpunitTestSuite, error) {
+	if names == "" {
+		return config.TestSuites, nil
+	}
+	var selected []phpunitTestSuite
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, suite := range config.TestSuites {
+			if suite.Name == name {
+				selected = append(selected, suite)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: test suite %q is not found", config.Filename, name)
+		}
+	}
+	return selected, nil
+}
+
+// testSuiteFiles returns the test files of the suites.
+// The <directory> and <exclude> paths can be glob patterns, like PHPUnit allows.
+func (config *phpunitConfig) testSuiteFiles(suites []phpunitTestSuite) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	addFile := func(filename string) {
+		if !seen[filename] {
+			seen[filename] = true
+			files = append(files, filename)
+		}
+	}
+
+	for _, suite := range suites {
+		var excluded []string
+		for _, exclude := range suite.Exclude {
+			matches, err := filepath.Glob(config.path(exclude))
+			if err != nil {
+				return nil, err
+			}
+			excluded = append(excluded, matches...)
+		}
+		isExcluded := func(filename string) bool {
+			for _, exclude := range excluded {
+				if filename == exclude || strings.HasPrefix(filename, exclude+"/") {
+					return true
+				}
+			}
+			return false
+		}
+
+		for _, dir := range suite.Directories {
+			suffix := dir.Suffix
+			if suffix == "" {
+				suffix = "Test.php"
+			}
+			roots, err := filepath.Glob(config.path(dir.Path))
+			if err != nil {
+				return nil, err
+			}
+			for _, root := range roots {
+				err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					if isExcluded(path) {
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					if !info.IsDir() && strings.HasSuffix(info.Name(), suffix) {
+						addFile(path)
+					}
+					return nil
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, file := range suite.Files {
+			if filename := config.path(file); !isExcluded(filename) {
+				addFile(filename)
+			}
+		}
+	}
+
+	return files, nil
+}
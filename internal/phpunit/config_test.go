@@ -0,0 +1,174 @@
+package phpunit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VKCOM/ktest/internal/fileutil"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPhpunitConfigTestSuiteFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktest-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"tests/Unit/FooTest.php",
+		"tests/Unit/Helper.php",
+		"tests/Unit/Legacy/OldTest.php",
+		"tests/Integration/DbCase.php",
+		"tests/Integration/HelperTest.php",
+		"tests/Smoke/SmokeTest.php",
+	}
+	for _, f := range files {
+		if err := fileutil.WriteFile(filepath.Join(dir, f), []byte("<?php\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	xmlConfig := `<?xml version="1.0" encoding="UTF-8"?>
+<phpunit bootstrap="tests/bootstrap.php">
+  <testsuites>
+    <testsuite name="unit">
+      <directory>tests/Unit</directory>
+      <exclude>tests/Unit/Legacy</exclude>
+    </testsuite>
+    <testsuite name="integration">
+      <directory suffix="Case.php">tests/Integration</directory>
+      <file>tests/Smoke/SmokeTest.php</file>
+    </testsuite>
+  </testsuites>
+  <php>
+    <env name="APP_ENV" value="testing"/>
+  </php>
+</phpunit>
+`
+	if err := fileutil.WriteFile(filepath.Join(dir, "phpunit.xml.dist"), []byte(xmlConfig)); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadPhpunitConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := config.bootstrapFilename(), filepath.Join(dir, "tests/bootstrap.php"); have != want {
+		t.Errorf("bootstrap mismatch:\nhave: %q\nwant: %q", have, want)
+	}
+	wantEnv := []phpunitEnv{{Name: "APP_ENV", Value: "testing"}}
+	if diff := cmp.Diff(wantEnv, config.Env); diff != "" {
+		t.Errorf("env mismatch (-want +have):\n%s", diff)
+	}
+
+	tests := []struct {
+		testSuite string
+		want      []string
+	}{
+		{
+			testSuite: "",
+			want: []string{
+				"tests/Unit/FooTest.php",
+				"tests/Integration/DbCase.php",
+				"tests/Smoke/SmokeTest.php",
+			},
+		},
+		{
+			testSuite: "integration",
+			want: []string{
+				"tests/Integration/DbCase.php",
+				"tests/Smoke/SmokeTest.php",
+			},
+		},
+	}
+	for _, test := range tests {
+		suites, err := config.selectTestSuites(test.testSuite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := config.testSuiteFiles(suites)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range have {
+			have[i], _ = filepath.Rel(dir, have[i])
+		}
+		if diff := cmp.Diff(test.want, have); diff != "" {
+			t.Errorf("testsuite %q files mismatch (-want +have):\n%s", test.testSuite, diff)
+		}
+	}
+
+	if _, err := config.selectTestSuites("unknown"); err == nil {
+		t.Errorf("expected an error for the unknown test suite")
+	}
+}
+
+func TestPhpunitConfigTestSuffix(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"phpunit.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<phpunit>
+  <testsuites>
+    <testsuite name="specs">
+      <directory suffix="Spec.php">tests</directory>
+    </testsuite>
+  </testsuites>
+</phpunit>
+`,
+		"tests/FooSpec.php": `<?php
+use PHPUnit\Framework\TestCase;
+
+class FooSpec extends BaseSpec {
+    public function testFoo() { $this->assertTrue(true); }
+}
+`,
+		"tests/BaseSpec.php": `<?php
+use PHPUnit\Framework\TestCase;
+
+abstract class BaseSpec extends TestCase {
+    public function testBase() { $this->assertTrue(true); }
+}
+`,
+		"tests/NotATestSpec.php": `<?php
+class NotATestSpec extends ArrayObject {
+    public function testNothing() {}
+}
+`,
+		"tests/Helper.php": `<?php
+class Helper {}
+`,
+	}
+	for name, contents := range files {
+		if err := fileutil.WriteFile(filepath.Join(dir, name), []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testDir := filepath.Join(dir, "tests")
+	r := newRunner(&RunConfig{ProjectRoot: dir, TestTarget: testDir, Output: ioutil.Discard})
+	steps := []func() error{
+		r.stepLoadPhpunitConfig,
+		r.stepFindTestFiles,
+		r.stepParseTestFiles,
+		r.stepFilterOnlyParsedFiles,
+		r.stepSortTestFiles,
+		r.stepResolveTestClasses,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"FooSpec::testFoo", "FooSpec::testBase"}
+	if diff := cmp.Diff(want, selectedTests(r)); diff != "" {
+		t.Errorf("tests mismatch (-want +have):\n%s", diff)
+	}
+	for _, f := range r.supportFiles {
+		if f.fullName != filepath.Join(testDir, "Helper.php") {
+			t.Errorf("unexpected support file %s", f.shortName)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package phpunit
+
+import (
+	"strconv"
+	"strings"
+)
+
+// diffContextLines is a number of unchanged lines that are printed around the changes.
+const diffContextLines = 3
+
+// exportValue formats the decoded JSON value like PHPUnit exporter does.
+// The JSON objects are the PHP associative arrays, so they're printed as arrays.
+func exportValue(v interface{}) string {
+	e := &valueExporter{}
+	e.export(v, 0)
+	return e.buf.String()
+}
+
+type valueExporter struct {
+	buf strings.Builder
+	// arrays is a number of exported arrays, it's used for the &N array ids.
+	arrays int
+}
+
+func (e *valueExporter) export(v interface{}, depth int) {
+	switch v := v.(type) {
+	case nil:
+		e.buf.WriteString("null")
+	case string:
+		e.buf.WriteString("'" + v + "'")
+	case []interface{}:
+		e.exportArrayStart()
+		for i, elem := range v {
+			e.exportArrayElem(strconv.Itoa(i), elem, depth)
+		}
+		e.exportArrayEnd(len(v), depth)
+	case jsonObject:
+		e.exportArrayStart()
+		for _, field := range v {
+			key := field.Key
+			if n, err := strconv.Atoi(key); err != nil || strconv.Itoa(n) != key {
+				key = "'" + key + "'"
+			}
+			e.exportArrayElem(key, field.Value, depth)
+		}
+		e.exportArrayEnd(len(v), depth)
+	default:
+		e.buf.WriteString(jsonString(v))
+	}
+}
+
+func (e *valueExporter) exportArrayStart() {
+	e.buf.WriteString("Array &" + strconv.Itoa(e.arrays) + " (")
+	e.arrays++
+}
+
+func (e *valueExporter) exportArrayElem(key string, v interface{}, depth int) {
+	e.buf.WriteString("\n" + strings.Repeat("    ", depth+1) + key + " => ")
+	e.export(v, depth+1)
+}
+
+func (e *valueExporter) exportArrayEnd(length, depth int) {
+	if length != 0 {
+		e.buf.WriteString("\n" + strings.Repeat("    ", depth))
+	}
+	e.buf.WriteString(")")
+}
+
+// unifiedDiff returns the line diff of the expected and actual texts
+// in the format that PHPUnit uses for the failed comparisons.
+// Long runs of unchanged lines are omitted.
+func unifiedDiff(expected, actual string) string {
+	lines := diffLines(strings.Split(expected, "\n"), strings.Split(actual, "\n"))
+
+	// Only the lines that are close enough to the changes are printed.
+	visible := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.kind == ' ' {
+			continue
+		}
+		from := i - diffContextLines
+		if from < 0 {
+			from = 0
+		}
+		to := i + diffContextLines
+		if to >= len(lines) {
+			to = len(lines) - 1
+		}
+		for j := from; j <= to; j++ {
+			visible[j] = true
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("--- Expected\n+++ Actual")
+	for i, l := range lines {
+		if !visible[i] {
+			continue
+		}
+		if i == 0 || !visible[i-1] {
+			out.WriteString("\n@@ @@")
+		}
+		out.WriteString("\n")
+		out.WriteByte(l.kind)
+		out.WriteString(l.text)
+	}
+	return out.String()
+}
+
+type diffLine struct {
+	// kind is ' ' for the unchanged lines, '-' for the removed and '+' for the added ones.
+	kind byte
+	text string
+}
+
+// diffLines finds the longest common subsequence of a and b
+// and returns the edit script that turns a into b.
+func diffLines(a, b []string) []diffLine {
+	var prefix, suffix []diffLine
+	for len(a) != 0 && len(b) != 0 && a[0] == b[0] {
+		prefix = append(prefix, diffLine{kind: ' ', text: a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) != 0 && len(b) != 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, diffLine{kind: ' ', text: a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	// lcs[i][j] is the common subsequence length of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := prefix
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{kind: ' ', text: a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{kind: '-', text: a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{kind: '+', text: b[j]})
+			j++
+		}
+	}
+	for k := len(suffix) - 1; k >= 0; k-- {
+		lines = append(lines, suffix[k])
+	}
+	return lines
+}
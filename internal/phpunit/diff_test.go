@@ -0,0 +1,63 @@
+package phpunit
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExportValue(t *testing.T) {
+	var value []interface{}
+	if err := unmarshalJSONArray([]byte(`[{"b":1,"a":[true,null],"5":"x"},[]]`), &value); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`Array &0 (`,
+		`    0 => Array &1 (`,
+		`        'b' => 1`,
+		`        'a' => Array &2 (`,
+		`            0 => true`,
+		`            1 => null`,
+		`        )`,
+		`        5 => 'x'`,
+		`    )`,
+		`    1 => Array &3 ()`,
+		`)`,
+	}, "\n")
+	if have := exportValue(value); have != want {
+		t.Errorf("export mismatch:\nhave:\n%s\nwant:\n%s", have, want)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		expected string
+		actual   string
+		want     []string
+	}{
+		{
+			expected: "'foo'",
+			actual:   "'bar'",
+			want:     []string{"@@ @@", "-'foo'", "+'bar'"},
+		},
+		{
+			expected: "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl",
+			actual:   "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nK\nl",
+			want: []string{
+				"@@ @@", " a", "-b", "+B", " c", " d", " e",
+				"@@ @@", " h", " i", " j", "-k", "+K", " l",
+			},
+		},
+		{
+			expected: "a\nb\nc",
+			actual:   "a\nc\nd",
+			want:     []string{"@@ @@", " a", "-b", " c", "+d"},
+		},
+	}
+
+	for _, test := range tests {
+		want := "--- Expected\n+++ Actual\n" + strings.Join(test.want, "\n")
+		if have := unifiedDiff(test.expected, test.actual); have != want {
+			t.Errorf("diff(%q, %q) mismatch:\nhave:\n%s\nwant:\n%s", test.expected, test.actual, have, want)
+		}
+	}
+}
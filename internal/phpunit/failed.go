@@ -0,0 +1,111 @@
+package phpunit
+
+import (
+	"sort"
+	"strings"
+)
+
+// RerunMode describes how RunConfig.LastFailed tests are used.
+type RerunMode int
+
+const (
+	// RerunAll runs all tests in the usual order.
+	RerunAll RerunMode = iota
+	// RerunLastFailed runs only the LastFailed tests.
+	RerunLastFailed
+	// RerunFailedFirst runs the LastFailed tests before the others.
+	RerunFailedFirst
+)
+
+// FailedTests returns the names of the tests that should be re-run
+// after the result, in "Class::method" or "Class" (for the whole class) form.
+// The test files that failed before their classes are known (like the files
+// with syntax errors) are recorded by their full names.
+//
+// The previous failures of the tests that were not executed this time are kept,
+// so running a subset of the tests doesn't forget the other failures.
+func FailedTests(result *RunResult, previous []string) []string {
+	failed := make(map[string]bool)
+	addFailure := func(name string) {
+		if i := strings.Index(name, " with data set "); i != -1 {
+			name = name[:i]
+		}
+		failed[name] = true
+	}
+	for _, failure := range result.Failures {
+		addFailure(failure.Name)
+	}
+	for _, testErr := range result.Errors {
+		addFailure(testErr.Name)
+	}
+	for _, mismatch := range result.Mismatches {
+		addFailure(mismatch.Name)
+	}
+	for _, fileErr := range result.FileErrors {
+		if fileErr.Class == "" {
+			addFailure(fileErr.File)
+			continue
+		}
+		for _, class := range strings.Split(fileErr.Class, ", ") {
+			addFailure(class)
+		}
+	}
+
+	executed := make(map[string]bool)
+	for _, f := range result.Files {
+		executed[f.File] = true
+	}
+	for _, test := range result.Results {
+		executed[test.Class] = true
+		executed[test.Class+"::"+strings.SplitN(test.Name, " with data set ", 2)[0]] = true
+	}
+	for _, name := range previous {
+		if !executed[name] {
+			failed[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// failedTestsSet matches the test methods against RunConfig.LastFailed.
+type failedTestsSet map[string]bool
+
+// newFailedTestsSet returns the set of the failed tests;
+// all classes of the failed files are added to it.
+func newFailedTestsSet(names []string, files []*testFile) failedTestsSet {
+	set := make(failedTestsSet, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	for _, f := range files {
+		if !set[f.fullName] {
+			continue
+		}
+		for _, c := range f.classes {
+			set[c.Name] = true
+		}
+	}
+	return set
+}
+
+func (set failedTestsSet) hasClass(c *testClass) bool {
+	if set[c.Name] {
+		return true
+	}
+	for _, m := range c.TestMethods {
+		if set.hasMethod(c, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (set failedTestsSet) hasMethod(c *testClass, m *testMethod) bool {
+	return set[c.Name] || set[c.Name+"::"+m.Name]
+}
@@ -0,0 +1,155 @@
+package phpunit
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFailedTests(t *testing.T) {
+	result := &RunResult{
+		Failures: []TestFailure{
+			{Name: "FooTest::testA"},
+			{Name: "FooTest::testProvider with data set #1"},
+		},
+		Errors: []TestFailure{
+			{Name: "BarTest"},
+		},
+		FileErrors: []FileError{
+			{File: "/tests/BazTest.php", Class: "BazTest, QuxTest"},
+			{File: "/tests/BrokenTest.php", Kind: ParseError},
+		},
+		Files: []FileResult{
+			{File: "/tests/FooTest.php"},
+			{File: "/tests/FixedTest.php"},
+		},
+		Results: []TestResult{
+			{Class: "FooTest", Name: "testA"},
+			{Class: "FooTest", Name: "testB"},
+			{Class: "FooTest", Name: "testProvider with data set #1"},
+		},
+	}
+	previous := []string{
+		"FooTest::testB",     // Passed this time.
+		"OtherTest::testOld", // Not executed this time.
+		"/tests/FixedTest.php",
+	}
+
+	have := FailedTests(result, previous)
+	want := []string{
+		"/tests/BrokenTest.php",
+		"BarTest",
+		"BazTest",
+		"FooTest::testA",
+		"FooTest::testProvider",
+		"OtherTest::testOld",
+		"QuxTest",
+	}
+	if diff := cmp.Diff(have, want); diff != "" {
+		t.Errorf("failed tests mismatch (-have +want):\n%s", diff)
+	}
+}
+
+func TestSelectLastFailed(t *testing.T) {
+	tests := []string{
+		"ATest::testA1", "ATest::testA2",
+		"BTest::testB1", "BTest::testB2", "BTest::testB3",
+		"CTest::testC1",
+		"DTest::testD1", "DTest::testD2",
+	}
+	lastFailed := []string{"BTest::testB3", "DTest", "UnknownTest::testFoo"}
+
+	cases := []struct {
+		name  string
+		mode  RerunMode
+		last  []string
+		want  []string
+		files []string
+	}{
+		{
+			name:  "last failed",
+			mode:  RerunLastFailed,
+			last:  lastFailed,
+			want:  []string{"BTest::testB3", "DTest::testD1", "DTest::testD2"},
+			files: []string{"/tests/BTest.php", "/tests/DTest.php"},
+		},
+		{
+			name:  "last failed file",
+			mode:  RerunLastFailed,
+			last:  []string{"/tests/CTest.php", "ATest::testA2"},
+			want:  []string{"ATest::testA2", "CTest::testC1"},
+			files: []string{"/tests/ATest.php", "/tests/CTest.php"},
+		},
+		{
+			name:  "last failed not found",
+			mode:  RerunLastFailed,
+			last:  []string{"UnknownTest::testFoo", "/tests/UnknownTest.php"},
+			want:  tests,
+			files: []string{"/tests/ATest.php", "/tests/BTest.php", "/tests/CTest.php", "/tests/DTest.php"},
+		},
+		{
+			name:  "last failed without failures",
+			mode:  RerunLastFailed,
+			want:  tests,
+			files: []string{"/tests/ATest.php", "/tests/BTest.php", "/tests/CTest.php", "/tests/DTest.php"},
+		},
+		{
+			name: "failed first",
+			mode: RerunFailedFirst,
+			last: lastFailed,
+			want: []string{
+				"BTest::testB3", "BTest::testB1", "BTest::testB2",
+				"DTest::testD1", "DTest::testD2",
+				"ATest::testA1", "ATest::testA2",
+				"CTest::testC1",
+			},
+			files: []string{"/tests/BTest.php", "/tests/DTest.php", "/tests/ATest.php", "/tests/CTest.php"},
+		},
+		{
+			name:  "all",
+			mode:  RerunAll,
+			last:  lastFailed,
+			want:  tests,
+			files: []string{"/tests/ATest.php", "/tests/BTest.php", "/tests/CTest.php", "/tests/DTest.php"},
+		},
+	}
+
+	for _, c := range cases {
+		r := newTestRunner(&RunConfig{Output: ioutil.Discard, Rerun: c.mode, LastFailed: c.last}, tests...)
+		if err := r.stepSelectLastFailed(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if diff := cmp.Diff(c.want, selectedTests(r)); diff != "" {
+			t.Errorf("%s: tests mismatch (-want +have):\n%s", c.name, diff)
+		}
+		// The ids follow the execution order.
+		var files []string
+		for i, f := range r.testFiles {
+			files = append(files, f.fullName)
+			if i != 0 && f.id <= r.testFiles[i-1].id {
+				t.Errorf("%s: file %s id %d is not greater than the previous file id", c.name, f.fullName, f.id)
+			}
+		}
+		if diff := cmp.Diff(c.files, files); diff != "" {
+			t.Errorf("%s: files mismatch (-want +have):\n%s", c.name, diff)
+		}
+	}
+}
+
+func TestSelectFailedFirstClasses(t *testing.T) {
+	// Several classes in one file: the failed class goes first.
+	r := newTestRunner(&RunConfig{Output: ioutil.Discard, Rerun: RerunFailedFirst, LastFailed: []string{"BTest::testB2"}},
+		"ATest::testA1", "BTest::testB1", "BTest::testB2")
+	f := r.testFiles[0]
+	f.classes = append(f.classes, r.testFiles[1].classes...)
+	r.testFiles = r.testFiles[:1]
+
+	if err := r.stepSelectLastFailed(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"BTest::testB2", "BTest::testB1", "ATest::testA1"}
+	if diff := cmp.Diff(want, selectedTests(r)); diff != "" {
+		t.Errorf("tests mismatch (-want +have):\n%s", diff)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 func formatResult(w io.Writer, conf *FormatConfig, result *RunResult) {
@@ -13,33 +16,226 @@ func formatResult(w io.Writer, conf *FormatConfig, result *RunResult) {
 		fmt.Fprint(w, "\n")
 	}
 
+	// The report sections are separated like in PHPUnit.
+	sections := 0
+	startSection := func() {
+		if sections != 0 {
+			fmt.Fprint(w, "--\n\n")
+		}
+		sections++
+	}
+
+	if len(result.FileErrors) != 0 {
+		startSection()
+		if len(result.FileErrors) == 1 {
+			fmt.Fprintf(w, "There was 1 file error:\n\n")
+		} else {
+			fmt.Fprintf(w, "There were %d file errors:\n\n", len(result.FileErrors))
+		}
+		for i, fileErr := range result.FileErrors {
+			filename := fileErr.File
+			if conf.ShortLocation {
+				filename = filepath.Base(filename)
+			}
+			fmt.Fprintf(w, "%d) %s\n", i+1, filename)
+			fmt.Fprintf(w, "%s: %v\n\n", fileErr.Kind, fileErr.Err)
+		}
+	}
+
+	if len(result.Errors) != 0 {
+		startSection()
+		if len(result.Errors) == 1 {
+			fmt.Fprintf(w, "There was 1 error:\n\n")
+		} else {
+			fmt.Fprintf(w, "There were %d errors:\n\n", len(result.Errors))
+		}
+		formatFailures(w, conf, result.Errors)
+	}
+
 	if len(result.Failures) != 0 {
+		startSection()
 		if len(result.Failures) == 1 {
 			fmt.Fprintf(w, "There was 1 failure:\n\n")
 		} else {
 			fmt.Fprintf(w, "There were %d failures:\n\n", len(result.Failures))
 		}
+		formatFailures(w, conf, result.Failures)
+	}
 
-		for i, failure := range result.Failures {
-			fmt.Fprintf(w, "%d) %s\n", i+1, failure.Name)
-			if failure.Message != "" {
-				fmt.Fprintf(w, "%s\n", failure.Message)
-			}
-			if failure.Reason != "" {
-				fmt.Fprintf(w, "%s.\n", failure.Reason)
-			}
+	if len(result.Risky) != 0 {
+		startSection()
+		if len(result.Risky) == 1 {
+			fmt.Fprintf(w, "There was 1 risky test:\n\n")
+		} else {
+			fmt.Fprintf(w, "There were %d risky tests:\n\n", len(result.Risky))
+		}
+		formatFailures(w, conf, result.Risky)
+	}
+
+	if len(result.Mismatches) != 0 {
+		startSection()
+		if len(result.Mismatches) == 1 {
+			fmt.Fprintf(w, "There was 1 PHP/KPHP mismatch:\n\n")
+		} else {
+			fmt.Fprintf(w, "There were %d PHP/KPHP mismatches:\n\n", len(result.Mismatches))
+		}
+
+		for i, mismatch := range result.Mismatches {
+			fmt.Fprintf(w, "%d) %s\n", i+1, mismatch.Name)
+			fmt.Fprintf(w, "PHP:  %s\n", mismatch.PHP)
+			fmt.Fprintf(w, "KPHP: %s\n", mismatch.KPHP)
 			io.WriteString(w, "\n")
 			if conf.ShortLocation {
-				fmt.Fprintf(w, "%s:%d\n\n", filepath.Base(failure.File), failure.Line)
+				fmt.Fprintf(w, "%s\n\n", filepath.Base(mismatch.File))
 			} else {
-				fmt.Fprintf(w, "%s:%d\n\n", failure.File, failure.Line)
+				fmt.Fprintf(w, "%s\n\n", mismatch.File)
 			}
 		}
+	}
+
+	if len(result.Errors) != 0 || len(result.FileErrors) != 0 {
+		fmt.Fprintln(w, "ERRORS!")
+		fmt.Fprintf(w, "Tests: %d, Assertions: %d", result.Tests, result.Assertions)
+		if len(result.Errors) != 0 {
+			fmt.Fprintf(w, ", Errors: %d", len(result.Errors))
+		}
+		if len(result.FileErrors) != 0 {
+			fmt.Fprintf(w, ", File errors: %d", len(result.FileErrors))
+		}
+		if result.NotRun != 0 {
+			fmt.Fprintf(w, ", Not run: %d", result.NotRun)
+		}
+		if len(result.Failures) != 0 {
+			fmt.Fprintf(w, ", Failures: %d", len(result.Failures))
+		}
+		formatNotPassedCounts(w, result)
+		if len(result.Mismatches) != 0 {
+			fmt.Fprintf(w, ", PHP/KPHP mismatches: %d", len(result.Mismatches))
+		}
+		fmt.Fprint(w, ".\n")
+	} else if len(result.Failures) != 0 || len(result.Mismatches) != 0 {
 		fmt.Fprintln(w, "FAILURES!")
-		fmt.Fprintf(w, "Tests: %d, Assertions: %d, Failures: %d.\n",
+		fmt.Fprintf(w, "Tests: %d, Assertions: %d, Failures: %d",
 			result.Tests, result.Assertions, len(result.Failures))
+		formatNotPassedCounts(w, result)
+		if len(result.Mismatches) != 0 {
+			fmt.Fprintf(w, ", PHP/KPHP mismatches: %d", len(result.Mismatches))
+		}
+		fmt.Fprint(w, ".\n")
+	} else if len(result.Skipped) != 0 || len(result.Incomplete) != 0 || len(result.Risky) != 0 {
+		fmt.Fprintln(w, "OK, but incomplete, skipped, or risky tests!")
+		fmt.Fprintf(w, "Tests: %d, Assertions: %d", result.Tests, result.Assertions)
+		formatNotPassedCounts(w, result)
+		fmt.Fprint(w, ".\n")
 	} else {
 		fmt.Fprintf(w, "OK (%d tests, %d assertions)\n",
 			result.Tests, result.Assertions)
 	}
+
+	if conf.ReportSlowest > 0 {
+		formatSlowest(w, conf, result)
+	}
+}
+
+// formatNotPassedCounts prints the skipped, incomplete and risky tests counters
+// in the same order as PHPUnit does.
+func formatNotPassedCounts(w io.Writer, result *RunResult) {
+	if len(result.Skipped) != 0 {
+		fmt.Fprintf(w, ", Skipped: %d", len(result.Skipped))
+	}
+	if len(result.Incomplete) != 0 {
+		fmt.Fprintf(w, ", Incomplete: %d", len(result.Incomplete))
+	}
+	if len(result.Risky) != 0 {
+		fmt.Fprintf(w, ", Risky: %d", len(result.Risky))
+	}
+}
+
+func formatSlowest(w io.Writer, conf *FormatConfig, result *RunResult) {
+	tests := make([]TestResult, len(result.Results))
+	copy(tests, result.Results)
+	sort.SliceStable(tests, func(i, j int) bool {
+		return tests[i].Time > tests[j].Time
+	})
+	if len(tests) > conf.ReportSlowest {
+		tests = tests[:conf.ReportSlowest]
+	}
+	if len(tests) != 0 {
+		fmt.Fprintf(w, "\nSlowest tests:\n")
+		for _, test := range tests {
+			fmt.Fprintf(w, "%10s  %s::%s\n", formatDuration(test.Time), test.Class, test.Name)
+		}
+	}
+
+	files := make([]FileResult, len(result.Files))
+	copy(files, result.Files)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].BuildTime+files[i].RunTime > files[j].BuildTime+files[j].RunTime
+	})
+	if len(files) > conf.ReportSlowest {
+		files = files[:conf.ReportSlowest]
+	}
+	if len(files) != 0 {
+		fmt.Fprintf(w, "\nSlowest files:\n")
+		for _, f := range files {
+			filename := f.File
+			if conf.ShortLocation {
+				filename = filepath.Base(filename)
+			}
+			fmt.Fprintf(w, "%10s  (build %s, run %s)  %s\n",
+				formatDuration(f.BuildTime+f.RunTime), formatDuration(f.BuildTime), formatDuration(f.RunTime), filename)
+		}
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+func formatFailures(w io.Writer, conf *FormatConfig, failures []TestFailure) {
+	for i, failure := range failures {
+		fmt.Fprintf(w, "%d) %s\n", i+1, failure.Name)
+		if failure.Message != "" {
+			fmt.Fprintf(w, "%s\n", failure.Message)
+		}
+		if failure.Reason != "" {
+			fmt.Fprintf(w, "%s.\n", failure.Reason)
+		}
+		if failure.Diff != "" {
+			fmt.Fprintf(w, "%s\n", failure.Diff)
+		}
+		io.WriteString(w, "\n")
+		if conf.ShortLocation {
+			fmt.Fprintf(w, "%s:%d\n\n", filepath.Base(failure.File), failure.Line)
+		} else {
+			fmt.Fprintf(w, "%s:%d\n\n", failure.File, failure.Line)
+		}
+		if failure.Output != "" {
+			fmt.Fprintf(w, "Output:\n%s\n\n", strings.TrimRight(failure.Output, "\n"))
+		}
+	}
+}
+
+func failureMessage(failure *TestFailure) string {
+	if failure.Reason != "" {
+		return failure.Reason
+	}
+	return failure.Message
+}
+
+// failureText mimics the PHPUnit failure details format.
+func failureText(failure *TestFailure) string {
+	var lines []string
+	lines = append(lines, failure.Name)
+	if failure.Message != "" {
+		lines = append(lines, failure.Message)
+	}
+	if failure.Reason != "" {
+		lines = append(lines, failure.Reason+".")
+	}
+	if failure.Diff != "" {
+		lines = append(lines, failure.Diff)
+	}
+	lines = append(lines, "", fmt.Sprintf("%s:%d", failure.File, failure.Line))
+	return strings.Join(lines, "\n")
 }
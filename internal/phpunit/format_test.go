@@ -0,0 +1,194 @@
+package phpunit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatSlowest(t *testing.T) {
+	result := &RunResult{
+		Tests:      3,
+		Assertions: 3,
+		Results: []TestResult{
+			{Class: "FooTest", Name: "testFast", Time: 2 * time.Millisecond},
+			{Class: "FooTest", Name: "testSlow", Time: 1500 * time.Millisecond},
+			{Class: "BarTest", Name: "testMedium", Time: 40 * time.Millisecond},
+		},
+		Files: []FileResult{
+			{File: "/tests/FooTest.php", BuildTime: 3 * time.Second, RunTime: 1600 * time.Millisecond},
+			{File: "/tests/BarTest.php", RunTime: 50 * time.Millisecond},
+		},
+	}
+
+	var out strings.Builder
+	formatResult(&out, &FormatConfig{ShortLocation: true, ReportSlowest: 2}, result)
+	want := `
+OK (3 tests, 3 assertions)
+
+Slowest tests:
+      1.5s  FooTest::testSlow
+      40ms  BarTest::testMedium
+
+Slowest files:
+      4.6s  (build 3s, run 1.6s)  FooTest.php
+      50ms  (build 0s, run 50ms)  BarTest.php
+`
+	if out.String() != want {
+		t.Errorf("output mismatch:\nhave:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestFormatSkippedAndRisky(t *testing.T) {
+	result := &RunResult{
+		Tests:      4,
+		Assertions: 2,
+		Skipped:    []TestFailure{{Name: "FooTest::testSkipped", Message: "no database"}},
+		Incomplete: []TestFailure{{Name: "FooTest::testIncomplete"}},
+		Risky: []TestFailure{
+			{Name: "FooTest::testNothing", Message: "This test did not perform any assertions", File: "/tests/FooTest.php", Line: 20},
+		},
+	}
+
+	var out strings.Builder
+	formatResult(&out, &FormatConfig{ShortLocation: true}, result)
+	want := `
+There was 1 risky test:
+
+1) FooTest::testNothing
+This test did not perform any assertions
+
+FooTest.php:20
+
+OK, but incomplete, skipped, or risky tests!
+Tests: 4, Assertions: 2, Skipped: 1, Incomplete: 1, Risky: 1.
+`
+	if out.String() != want {
+		t.Errorf("output mismatch:\nhave:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestFormatFileErrors(t *testing.T) {
+	result := &RunResult{
+		Tests:      2,
+		Assertions: 1,
+		Failures: []TestFailure{
+			{Name: "FooTest::testFoo", Reason: "Failed asserting that false is true", File: "/tests/FooTest.php", Line: 10},
+		},
+		FileErrors: []FileError{
+			{File: "/tests/BarTest.php", Class: "BarTest", Kind: BuildError, Err: errors.New("compilation error")},
+			{File: "/tests/BazTest.php", Class: "BazTest", Kind: RunError, Err: errors.New("signal: segmentation fault")},
+		},
+		NotRun: 3,
+	}
+
+	var out strings.Builder
+	formatResult(&out, &FormatConfig{ShortLocation: true}, result)
+	want := `
+There were 2 file errors:
+
+1) BarTest.php
+build error: compilation error
+
+2) BazTest.php
+run error: signal: segmentation fault
+
+--
+
+There was 1 failure:
+
+1) FooTest::testFoo
+Failed asserting that false is true.
+
+FooTest.php:10
+
+ERRORS!
+Tests: 2, Assertions: 1, File errors: 2, Not run: 3, Failures: 1.
+`
+	if out.String() != want {
+		t.Errorf("output mismatch:\nhave:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestFormatSections(t *testing.T) {
+	result := &RunResult{
+		Tests:      3,
+		Assertions: 1,
+		Risky: []TestFailure{
+			{Name: "FooTest::testNothing", Message: "This test did not perform any assertions", File: "/tests/FooTest.php", Line: 20},
+		},
+		Mismatches: []TestMismatch{
+			{Name: "FooTest::testFloat", File: "/tests/FooTest.php", PHP: "passed", KPHP: "failed"},
+		},
+	}
+
+	var out strings.Builder
+	formatResult(&out, &FormatConfig{ShortLocation: true}, result)
+	want := `
+There was 1 risky test:
+
+1) FooTest::testNothing
+This test did not perform any assertions
+
+FooTest.php:20
+
+--
+
+There was 1 PHP/KPHP mismatch:
+
+1) FooTest::testFloat
+PHP:  passed
+KPHP: failed
+
+FooTest.php
+
+FAILURES!
+Tests: 3, Assertions: 1, Failures: 0, Risky: 1, PHP/KPHP mismatches: 1.
+`
+	if out.String() != want {
+		t.Errorf("output mismatch:\nhave:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	result := &RunResult{
+		Tests:      2,
+		Assertions: 1,
+		Errors: []TestFailure{
+			{Name: "FooTest::testUncaught", Message: "RuntimeException: unexpected", File: "/src/Foo.php", Line: 12, Output: "debug\n"},
+		},
+		Failures: []TestFailure{
+			{Name: "FooTest::testNotThrown", Reason: `Failed asserting that exception of type "RuntimeException" is thrown`, File: "/tests/FooTest.php", Line: 7},
+		},
+	}
+
+	var out strings.Builder
+	formatResult(&out, &FormatConfig{ShortLocation: true}, result)
+	want := `
+There was 1 error:
+
+1) FooTest::testUncaught
+RuntimeException: unexpected
+
+Foo.php:12
+
+Output:
+debug
+
+--
+
+There was 1 failure:
+
+1) FooTest::testNotThrown
+Failed asserting that exception of type "RuntimeException" is thrown.
+
+FooTest.php:7
+
+ERRORS!
+Tests: 2, Assertions: 1, Errors: 1, Failures: 1.
+`
+	if out.String() != want {
+		t.Errorf("output mismatch:\nhave:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,41 @@
+package phpunit
+
+import "strings"
+
+// groupNames returns the @group tag values.
+// PHPUnit treats @small, @medium and @large as the groups too.
+func groupNames(tags map[string][]string) []string {
+	var groups []string
+	for _, name := range tags["group"] {
+		if name != "" {
+			groups = append(groups, name)
+		}
+	}
+	for _, size := range []string{"small", "medium", "large"} {
+		if _, ok := tags[size]; ok {
+			groups = append(groups, size)
+		}
+	}
+	return groups
+}
+
+// selectedByGroups reports whether the test with the class and method groups
+// should be run. The test groups are compared case-insensitively, like PHPUnit does.
+func selectedByGroups(include, exclude []string, testGroups ...[]string) bool {
+	hasGroup := func(names []string) bool {
+		for _, groups := range testGroups {
+			for _, group := range groups {
+				for _, name := range names {
+					if strings.EqualFold(group, name) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	if len(include) != 0 && !hasGroup(include) {
+		return false
+	}
+	return !hasGroup(exclude)
+}
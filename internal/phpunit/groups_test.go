@@ -0,0 +1,50 @@
+package phpunit
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGroupNames(t *testing.T) {
+	tags := parseDocTags(`/**
+	 * @group slow
+	 * @group integration
+	 * @large
+	 */`)
+	parseAttributeTags(`#[Group('db')]`, tags)
+
+	have := groupNames(tags)
+	want := []string{"slow", "integration", "db", "large"}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("groupNames() mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestSelectedByGroups(t *testing.T) {
+	classGroups := []string{"integration"}
+	methodGroups := []string{"slow"}
+
+	tests := []struct {
+		include []string
+		exclude []string
+		want    bool
+	}{
+		{want: true},
+		{include: []string{"slow"}, want: true},
+		{include: []string{"Integration"}, want: true},
+		{include: []string{"fast"}, want: false},
+		{include: []string{"fast", "slow"}, want: true},
+		{exclude: []string{"slow"}, want: false},
+		{exclude: []string{"integration"}, want: false},
+		{exclude: []string{"fast"}, want: true},
+		{include: []string{"integration"}, exclude: []string{"slow"}, want: false},
+	}
+
+	for _, test := range tests {
+		have := selectedByGroups(test.include, test.exclude, classGroups, methodGroups)
+		if have != test.want {
+			t.Errorf("selectedByGroups(%q, %q) = %v, want %v", test.include, test.exclude, have, test.want)
+		}
+	}
+}
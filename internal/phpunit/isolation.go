@@ -0,0 +1,190 @@
+package phpunit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// runTests runs the test file executable: once, or once per test method
+// if RunConfig.ProcessIsolation is set. args select the suite of the combined main.
+func (r *runner) runTests(f *testFile, executable string, args []string) *testFileRun {
+	ctx := context.Background()
+	if r.conf.FileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.conf.FileTimeout)
+		defer cancel()
+	}
+
+	runExecutable := func(ctx context.Context, args []string, c *testClass, m *testMethod) *testFileRun {
+		return r.runTestExecutable(ctx, f, executable, args, c, m)
+	}
+	if !r.conf.ProcessIsolation {
+		return runExecutable(ctx, args, nil, nil)
+	}
+	return r.runIsolatedTests(ctx, f, args, runExecutable)
+}
+
+// runIsolatedTests runs every test method in a separate process and combines the results.
+//
+// A failed run is reported as the error of its test method, the other methods are still run.
+// When the ctx is done (the test file timeout has expired), the remaining methods are not run,
+// they are reported as errors too.
+func (r *runner) runIsolatedTests(ctx context.Context, f *testFile, args []string, runExecutable func(ctx context.Context, args []string, c *testClass, m *testMethod) *testFileRun) *testFileRun {
+	combined := &testFileRun{parsed: &testFileResult{finished: true}}
+	for _, c := range f.classes {
+		for _, m := range c.TestMethods {
+			if ctx.Err() != nil {
+				message := timeoutMessage("test file", r.conf.FileTimeout) + ", the test was not run"
+				combined.stderr = append(combined.stderr, 'E')
+				combined.parsed.merge(failedIsolatedTest(f, c, m, message, 0))
+				continue
+			}
+			testArgs := append(append([]string{}, args...), c.Name+"::"+m.Name)
+			run := runExecutable(ctx, testArgs, c, m)
+			combined.runTime += run.runTime
+			if run.err != nil {
+				message := fmt.Sprintf("%s: %v", run.errKind, run.err)
+				combined.stderr = append(combined.stderr, 'E')
+				combined.parsed.merge(failedIsolatedTest(f, c, m, message, run.runTime))
+			} else {
+				combined.stderr = append(combined.stderr, run.stderr...)
+				combined.parsed.merge(run.parsed)
+			}
+		}
+	}
+	return combined
+}
+
+// failedIsolatedTest reports the isolated test run error as the test error.
+func failedIsolatedTest(f *testFile, c *testClass, m *testMethod, message string, runTime time.Duration) *testFileResult {
+	testErr := TestFailure{
+		Name:    c.Name + "::" + m.Name,
+		Message: message,
+		File:    f.testMethodFile(c.Name, m.Name),
+		Line:    f.testMethodLine(c.Name, m.Name),
+	}
+	test := TestResult{Class: c.Name, Name: m.Name, File: f.fullName, Time: runTime, Error: &testErr}
+	return &testFileResult{finished: true, errors: []TestFailure{testErr}, tests: []TestResult{test}}
+}
+
+// merge appends the results of the isolated test run.
+func (res *testFileResult) merge(other *testFileResult) {
+	res.finished = res.finished && other.finished
+	res.asserts += other.asserts
+	res.failures = append(res.failures, other.failures...)
+	res.errors = append(res.errors, other.errors...)
+	res.tests = append(res.tests, other.tests...)
+	res.skipped = append(res.skipped, other.skipped...)
+	res.incomplete = append(res.incomplete, other.incomplete...)
+	res.risky = append(res.risky, other.risky...)
+}
+
+// interruptedTestRun reports the test that was running when the executable
+// crashed or was killed as an error; the results of the completed tests are kept.
+//
+// The running test is the last started one. If no test has started yet,
+// the isolated test method (c and m) is reported, if any.
+// It returns false if there is no test to report the error for.
+func (r *runner) interruptedTestRun(f *testFile, run *testFileRun, stdout []byte, c *testClass, m *testMethod, message string) bool {
+	parsed, err := parseTestOutput(f, r.eventMarker, stdout)
+	if err != nil {
+		return false
+	}
+	r.fixErrorLocations(parsed)
+
+	var test *TestResult
+	switch {
+	case parsed.unfinished:
+		test = &parsed.tests[len(parsed.tests)-1]
+	case c != nil:
+		parsed.tests = append(parsed.tests, TestResult{Class: c.Name, Name: m.Name, File: f.fullName})
+		test = &parsed.tests[len(parsed.tests)-1]
+	default:
+		return false
+	}
+
+	testErr := TestFailure{
+		Name:    test.Class + "::" + test.Name,
+		Message: message,
+		File:    f.testMethodFile(test.Class, test.Name),
+		Line:    f.testMethodLine(test.Class, test.Name),
+		Output:  test.Output,
+	}
+	parsed.errors = append(parsed.errors, testErr)
+	test.Error = &testErr
+	run.parsed = parsed
+	run.err = nil
+	// The killed test didn't print its status.
+	run.stderr = append(run.stderr, 'E')
+	return true
+}
+
+// testWatchdog cancels the test executable run if a single test
+// takes longer than the timeout. It watches the START and END events
+// in the test output.
+type testWatchdog struct {
+	timeout time.Duration
+	marker  string
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	timedOut bool
+	buf      []byte
+}
+
+func newTestWatchdog(timeout time.Duration, marker string, cancel context.CancelFunc) *testWatchdog {
+	return &testWatchdog{timeout: timeout, marker: marker, cancel: cancel}
+}
+
+func (w *testWatchdog) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			break
+		}
+		line := w.buf[:i]
+		switch {
+		case bytes.HasPrefix(line, []byte(w.marker+`["START"`)):
+			w.stopTimer()
+			w.timer = time.AfterFunc(w.timeout, w.fire)
+		case bytes.HasPrefix(line, []byte(w.marker+`["END"`)):
+			w.stopTimer()
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *testWatchdog) fire() {
+	w.mu.Lock()
+	w.timedOut = true
+	w.mu.Unlock()
+	w.cancel()
+}
+
+func (w *testWatchdog) stopTimer() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// Stop stops the watchdog and reports whether the test has timed out.
+func (w *testWatchdog) Stop() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopTimer()
+	return w.timedOut
+}
+
+func timeoutMessage(kind string, timeout time.Duration) string {
+	return fmt.Sprintf("Timeout: the %s took longer than %s", kind, timeout)
+}
@@ -0,0 +1,197 @@
+package phpunit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTestWatchdog(t *testing.T) {
+	canceled := make(chan struct{})
+	w := newTestWatchdog(10*time.Millisecond, testEventMarker, func() { close(canceled) })
+	w.Write([]byte("\n##ktest## [\"START\",\"testA\"]\n\n##ktest## [\"END\",\"testA\",1000]\n"))
+	w.Write([]byte("output\n##ktest## [\"START\",\"test"))
+	w.Write([]byte("B\"]\n"))
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run is not canceled after the test timeout")
+	}
+	if !w.Stop() {
+		t.Errorf("Stop() = false, want true")
+	}
+}
+
+func TestTestWatchdogIgnoresOutput(t *testing.T) {
+	w := newTestWatchdog(10*time.Millisecond, testEventMarker, func() {})
+	// The test prints the marker in the middle of a line, it's not an event.
+	w.Write([]byte("\n##ktest## [\"START\",\"testA\"]\n"))
+	w.Write([]byte("output ##ktest## [\"END\",\"testA\",1000]\n"))
+	w.Write([]byte("\n##ktest## [\"END\",\"testA\",1000]\n"))
+	w.Write([]byte("output ##ktest## [\"START\",\"testB\"]\n"))
+
+	time.Sleep(50 * time.Millisecond)
+	if w.Stop() {
+		t.Errorf("Stop() = true, want false")
+	}
+}
+
+func TestInterruptedTestRun(t *testing.T) {
+	r := &runner{conf: &RunConfig{}, eventMarker: testEventMarker}
+	f := &testFile{
+		fullName: "/tests/FooTest.php",
+		classes: []*testClass{
+			{Name: "FooTest", TestMethods: []*testMethod{{Name: "testA", Line: 5}, {Name: "testLoop", Line: 9}}},
+		},
+	}
+	output := `
+##ktest## ["CLASS","FooTest"]
+
+##ktest## ["START","testA"]
+
+##ktest## ["ASSERT_OK"]
+
+##ktest## ["END","testA",1000]
+
+##ktest## ["START","testLoop"]
+looping
+`
+	run := &testFileRun{stderr: []byte("."), errKind: RunError}
+	if !r.interruptedTestRun(f, run, []byte(output), nil, nil, "Timeout") {
+		t.Fatal("the interrupted test is not found")
+	}
+
+	testErr := TestFailure{Name: "FooTest::testLoop", Message: "Timeout", File: "/tests/FooTest.php", Line: 9}
+	want := []TestResult{
+		{Class: "FooTest", Name: "testA", File: "/tests/FooTest.php", Assertions: 1, Time: 1000},
+		{Class: "FooTest", Name: "testLoop", File: "/tests/FooTest.php", Error: &testErr},
+	}
+	if diff := cmp.Diff(want, run.parsed.tests); diff != "" {
+		t.Errorf("tests mismatch (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]TestFailure{testErr}, run.parsed.errors); diff != "" {
+		t.Errorf("errors mismatch (-want +have):\n%s", diff)
+	}
+	if string(run.stderr) != ".E" {
+		t.Errorf("stderr = %q, want %q", run.stderr, ".E")
+	}
+}
+
+func TestRunIsolatedTests(t *testing.T) {
+	r := &runner{conf: &RunConfig{ProcessIsolation: true}}
+	f := &testFile{
+		fullName: "/tests/FooTest.php",
+		classes: []*testClass{
+			{Name: "FooTest", TestMethods: []*testMethod{{Name: "testA", Line: 5}, {Name: "testCrash", Line: 9}, {Name: "testC", Line: 13}}},
+		},
+	}
+	passed := func(m *testMethod) *testFileRun {
+		return &testFileRun{
+			stderr:  []byte("."),
+			runTime: time.Millisecond,
+			parsed: &testFileResult{
+				finished: true,
+				asserts:  1,
+				tests:    []TestResult{{Class: "FooTest", Name: m.Name, File: "/tests/FooTest.php", Assertions: 1}},
+			},
+		}
+	}
+
+	var runArgs [][]string
+	run := r.runIsolatedTests(context.Background(), f, []string{"0"}, func(ctx context.Context, args []string, c *testClass, m *testMethod) *testFileRun {
+		runArgs = append(runArgs, args)
+		if m.Name == "testCrash" {
+			return &testFileRun{stderr: []byte("segfault"), runTime: time.Millisecond, errKind: RunError, err: errors.New("signal: segmentation fault")}
+		}
+		return passed(m)
+	})
+
+	if run.err != nil {
+		t.Fatalf("unexpected file error: %v", run.err)
+	}
+	wantArgs := [][]string{{"0", "FooTest::testA"}, {"0", "FooTest::testCrash"}, {"0", "FooTest::testC"}}
+	if diff := cmp.Diff(wantArgs, runArgs); diff != "" {
+		t.Errorf("run args mismatch (-want +have):\n%s", diff)
+	}
+	testErr := TestFailure{
+		Name:    "FooTest::testCrash",
+		Message: "run error: signal: segmentation fault",
+		File:    "/tests/FooTest.php",
+		Line:    9,
+	}
+	want := &testFileResult{
+		finished: true,
+		asserts:  2,
+		errors:   []TestFailure{testErr},
+		tests: []TestResult{
+			{Class: "FooTest", Name: "testA", File: "/tests/FooTest.php", Assertions: 1},
+			{Class: "FooTest", Name: "testCrash", File: "/tests/FooTest.php", Time: time.Millisecond, Error: &testErr},
+			{Class: "FooTest", Name: "testC", File: "/tests/FooTest.php", Assertions: 1},
+		},
+	}
+	if diff := cmp.Diff(want, run.parsed, cmp.AllowUnexported(testFileResult{})); diff != "" {
+		t.Errorf("result mismatch (-want +have):\n%s", diff)
+	}
+	if string(run.stderr) != ".E." {
+		t.Errorf("stderr = %q, want %q", run.stderr, ".E.")
+	}
+	if run.runTime != 3*time.Millisecond {
+		t.Errorf("run time = %s, want 3ms", run.runTime)
+	}
+}
+
+func TestRunIsolatedTestsFileTimeout(t *testing.T) {
+	r := &runner{conf: &RunConfig{ProcessIsolation: true, FileTimeout: time.Second}}
+	f := &testFile{
+		fullName: "/tests/FooTest.php",
+		classes: []*testClass{
+			{Name: "FooTest", TestMethods: []*testMethod{{Name: "testA", Line: 5}, {Name: "testSlow", Line: 9}, {Name: "testC", Line: 13}}},
+			{Name: "BarTest", TestMethods: []*testMethod{{Name: "testD", Line: 20}}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var runTests []string
+	run := r.runIsolatedTests(ctx, f, nil, func(ctx context.Context, args []string, c *testClass, m *testMethod) *testFileRun {
+		runTests = append(runTests, m.Name)
+		test := TestResult{Class: c.Name, Name: m.Name, File: f.fullName}
+		if m.Name == "testSlow" {
+			// The file timeout expires: the test is interrupted (see interruptedTestRun).
+			cancel()
+			testErr := TestFailure{Name: "FooTest::testSlow", Message: timeoutMessage("test file", time.Second), File: f.fullName, Line: 9}
+			test.Error = &testErr
+			return &testFileRun{stderr: []byte("E"), parsed: &testFileResult{errors: []TestFailure{testErr}, tests: []TestResult{test}}}
+		}
+		return &testFileRun{stderr: []byte("R"), parsed: &testFileResult{finished: true, tests: []TestResult{test}}}
+	})
+
+	if diff := cmp.Diff([]string{"testA", "testSlow"}, runTests); diff != "" {
+		t.Errorf("run tests mismatch (-want +have):\n%s", diff)
+	}
+	// The tests that were not run are reported as errors too.
+	notRun := "Timeout: the test file took longer than 1s, the test was not run"
+	wantErrors := []TestFailure{
+		{Name: "FooTest::testSlow", Message: "Timeout: the test file took longer than 1s", File: f.fullName, Line: 9},
+		{Name: "FooTest::testC", Message: notRun, File: f.fullName, Line: 13},
+		{Name: "BarTest::testD", Message: notRun, File: f.fullName, Line: 20},
+	}
+	if diff := cmp.Diff(wantErrors, run.parsed.errors); diff != "" {
+		t.Errorf("errors mismatch (-want +have):\n%s", diff)
+	}
+	var haveTests []string
+	for _, test := range run.parsed.tests {
+		haveTests = append(haveTests, test.Class+"::"+test.Name)
+	}
+	wantTests := []string{"FooTest::testA", "FooTest::testSlow", "FooTest::testC", "BarTest::testD"}
+	if diff := cmp.Diff(wantTests, haveTests); diff != "" {
+		t.Errorf("tests mismatch (-want +have):\n%s", diff)
+	}
+	if string(run.stderr) != "REEE" {
+		t.Errorf("stderr = %q, want %q", run.stderr, "REEE")
+	}
+}
@@ -0,0 +1,158 @@
+package phpunit
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type junitTestSuites struct {
+	XMLName xml.Name          `xml:"testsuites"`
+	Suites  []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string           `xml:"name,attr"`
+	File       string           `xml:"file,attr,omitempty"`
+	Tests      int              `xml:"tests,attr"`
+	Assertions int              `xml:"assertions,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Errors     int              `xml:"errors,attr"`
+	Skipped    int              `xml:"skipped,attr,omitempty"`
+	Time       string           `xml:"time,attr"`
+	Cases      []*junitTestCase `xml:"testcase"`
+
+	time time.Duration
+}
+
+type junitTestCase struct {
+	Name       string        `xml:"name,attr"`
+	Class      string        `xml:"class,attr"`
+	ClassName  string        `xml:"classname,attr"`
+	File       string        `xml:"file,attr"`
+	Line       int           `xml:"line,attr,omitempty"`
+	Assertions int           `xml:"assertions,attr"`
+	Time       string        `xml:"time,attr"`
+	Failure    *junitMessage `xml:"failure,omitempty"`
+	Error      *junitMessage `xml:"error,omitempty"`
+	Skipped    *junitMessage `xml:"skipped,omitempty"`
+	SystemOut  string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Type    string `xml:"type,attr,omitempty"`
+	Message string `xml:"message,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+func writeJUnitReport(w io.Writer, result *RunResult) error {
+	var report junitTestSuites
+	suites := make(map[string]*junitTestSuite)
+	getSuite := func(class, file string) *junitTestSuite {
+		// A single file can contain several test classes.
+		key := file + "::" + class
+		if suite, ok := suites[key]; ok {
+			return suite
+		}
+		suite := &junitTestSuite{Name: class, File: file}
+		suites[key] = suite
+		report.Suites = append(report.Suites, suite)
+		return suite
+	}
+
+	for _, test := range result.Results {
+		suite := getSuite(test.Class, test.File)
+		testCase := &junitTestCase{
+			Name:       test.Name,
+			Class:      test.Class,
+			ClassName:  test.Class,
+			File:       test.File,
+			Assertions: test.Assertions,
+			Time:       junitTime(test.Time),
+			SystemOut:  test.Output,
+		}
+		if test.Error != nil {
+			testCase.Line = test.Error.Line
+			testCase.Error = &junitMessage{
+				Type:    errorType(test.Error),
+				Message: failureMessage(test.Error),
+				Text:    failureText(test.Error),
+			}
+			suite.Errors++
+		} else if test.Failure != nil {
+			testCase.Line = test.Failure.Line
+			testCase.Failure = &junitMessage{
+				Type:    "failure",
+				Message: failureMessage(test.Failure),
+				Text:    failureText(test.Failure),
+			}
+			suite.Failures++
+		} else if skipped := skippedTest(&test); skipped != nil {
+			testCase.Line = skipped.Line
+			testCase.Skipped = &junitMessage{
+				Message: skipped.Message,
+			}
+			suite.Skipped++
+		}
+		suite.Tests++
+		suite.Assertions += test.Assertions
+		suite.time += test.Time
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	for _, fileErr := range result.FileErrors {
+		suite := getSuite(fileErr.Class, fileErr.File)
+		suite.Cases = append(suite.Cases, &junitTestCase{
+			Name:      fileErr.Kind.String(),
+			Class:     fileErr.Class,
+			ClassName: fileErr.Class,
+			File:      fileErr.File,
+			Time:      junitTime(0),
+			Error: &junitMessage{
+				Type:    fileErr.Kind.String(),
+				Message: fileErr.Kind.String(),
+				Text:    fileErr.Err.Error(),
+			},
+		})
+		suite.Tests++
+		suite.Errors++
+	}
+
+	for _, suite := range report.Suites {
+		suite.Time = junitTime(suite.time)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// skippedTest returns the skipped or incomplete test details, if any.
+// Both are reported as skipped, like PHPUnit does.
+func skippedTest(test *TestResult) *TestFailure {
+	if test.Skipped != nil {
+		return test.Skipped
+	}
+	return test.Incomplete
+}
+
+// errorType returns the exception class name of the test error.
+func errorType(testErr *TestFailure) string {
+	if i := strings.Index(testErr.Message, ": "); i != -1 {
+		return testErr.Message[:i]
+	}
+	return "error"
+}
+
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.6f", d.Seconds())
+}
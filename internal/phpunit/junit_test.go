@@ -0,0 +1,63 @@
+package phpunit
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJUnitReport(t *testing.T) {
+	failure := TestFailure{
+		Name:   "BazTest::testTrue",
+		Reason: `Failed asserting that 11 is true`,
+		File:   "/tests/BazTest.php",
+		Line:   14,
+	}
+	testErr := TestFailure{
+		Name:    "BazTest::testThrow",
+		Message: "RuntimeException: unexpected",
+		File:    "/src/Baz.php",
+		Line:    7,
+	}
+	result := &RunResult{
+		Results: []TestResult{
+			{Class: "BazTest", Name: "testEquals", File: "/tests/BazTest.php", Assertions: 2, Time: 1500 * time.Microsecond},
+			{Class: "BazTest", Name: "testTrue", File: "/tests/BazTest.php", Assertions: 1, Time: time.Millisecond, Failure: &failure},
+			{Class: "BazTest", Name: "testThrow", File: "/tests/BazTest.php", Assertions: 0, Time: time.Millisecond, Error: &testErr},
+		},
+		FileErrors: []FileError{
+			{Class: "BrokenTest", File: "/tests/BrokenTest.php", Kind: BuildError, Err: errors.New("kphp2cpp: exit status 1: <compilation error>")},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteJUnitReport(&buf, result); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="BazTest" file="/tests/BazTest.php" tests="3" assertions="3" failures="1" errors="1" time="0.003500">
+    <testcase name="testEquals" class="BazTest" classname="BazTest" file="/tests/BazTest.php" assertions="2" time="0.001500"></testcase>
+    <testcase name="testTrue" class="BazTest" classname="BazTest" file="/tests/BazTest.php" line="14" assertions="1" time="0.001000">
+      <failure type="failure" message="Failed asserting that 11 is true">BazTest::testTrue&#xA;Failed asserting that 11 is true.&#xA;&#xA;/tests/BazTest.php:14</failure>
+    </testcase>
+    <testcase name="testThrow" class="BazTest" classname="BazTest" file="/tests/BazTest.php" line="7" assertions="0" time="0.001000">
+      <error type="RuntimeException" message="RuntimeException: unexpected">BazTest::testThrow&#xA;RuntimeException: unexpected&#xA;&#xA;/src/Baz.php:7</error>
+    </testcase>
+  </testsuite>
+  <testsuite name="BrokenTest" file="/tests/BrokenTest.php" tests="1" assertions="0" failures="0" errors="1" time="0.000000">
+    <testcase name="build error" class="BrokenTest" classname="BrokenTest" file="/tests/BrokenTest.php" assertions="0" time="0.000000">
+      <error type="build error" message="build error">kphp2cpp: exit status 1: &lt;compilation error&gt;</error>
+    </testcase>
+  </testsuite>
+</testsuites>`
+	have := strings.TrimSpace(buf.String())
+	if diff := cmp.Diff(have, want); diff != "" {
+		t.Errorf("output mismatches (-have +want)!\n%s", diff)
+	}
+}
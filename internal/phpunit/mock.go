@@ -0,0 +1,523 @@
+package phpunit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/z7zmey/php-parser/pkg/ast"
+	"github.com/z7zmey/php-parser/pkg/version"
+	"github.com/z7zmey/php-parser/pkg/visitor"
+	"github.com/z7zmey/php-parser/pkg/visitor/traverser"
+
+	"github.com/VKCOM/ktest/internal/fileutil"
+	"github.com/VKCOM/ktest/internal/phpsyntax"
+)
+
+// The prefixes of the generated test double methods that replace
+// the $mock->method('x')->willReturn() and willThrowException() calls.
+const (
+	mockReturnMethodPrefix = "__ktest_will_return_"
+	mockThrowMethodPrefix  = "__ktest_will_throw_"
+)
+
+// mockClassName returns the name of the test double generated for the class.
+// The double is declared in the same namespace as the mocked class.
+func mockClassName(className string) string {
+	namespace := ""
+	shortName := className
+	if i := strings.LastIndexByte(className, '\\'); i != -1 {
+		namespace = className[:i+1]
+		shortName = className[i+1:]
+	}
+	return namespace + "KtestMock_" + shortName
+}
+
+// mockGenerator creates the test doubles for createMock and createStub.
+//
+// KPHP has no reflection and eval, so every double is a class that is generated
+// from the mocked class (or interface) source. The sources are located
+// with the composer.json PSR-4 autoload rules.
+type mockGenerator struct {
+	composerRoot string
+	phpVersion   *version.Version
+	psr4         []psr4Rule
+
+	// classes caches the parsed class declarations by their lowercase names.
+	classes map[string]*classDecl
+	// parsedFiles prevents the repeated parsing of the files without the requested class.
+	parsedFiles map[string]bool
+}
+
+type psr4Rule struct {
+	prefix string
+	dirs   []string
+}
+
+// classDecl describes a class or interface that can be mocked.
+type classDecl struct {
+	Name      string
+	Interface bool
+	Final     bool
+	// Parents are the fully qualified names of the extended and implemented classes.
+	Parents []string
+	Methods []*methodDecl
+}
+
+type methodDecl struct {
+	Name       string
+	Visibility string
+	Static     bool
+	Final      bool
+	ByRef      bool
+	// Params are the PHP parameters declarations with the fully qualified type names.
+	Params []string
+	// ReturnType is empty if the method has no return type declaration.
+	ReturnType string
+}
+
+func newMockGenerator(composerRoot string, phpVersion *version.Version) (*mockGenerator, error) {
+	g := &mockGenerator{
+		composerRoot: composerRoot,
+		phpVersion:   phpVersion,
+		classes:      make(map[string]*classDecl),
+		parsedFiles:  make(map[string]bool),
+	}
+	if composerRoot == "" {
+		return g, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(composerRoot, "composer.json"))
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Autoload struct {
+			PSR4 map[string]interface{} `json:"psr-4"`
+		} `json:"autoload"`
+		AutoloadDev struct {
+			PSR4 map[string]interface{} `json:"psr-4"`
+		} `json:"autoload-dev"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("composer.json: %v", err)
+	}
+	for _, rules := range []map[string]interface{}{manifest.Autoload.PSR4, manifest.AutoloadDev.PSR4} {
+		for prefix, dirs := range rules {
+			rule := psr4Rule{prefix: prefix}
+			switch dirs := dirs.(type) {
+			case string:
+				rule.dirs = []string{dirs}
+			case []interface{}:
+				for _, dir := range dirs {
+					if dir, ok := dir.(string); ok {
+						rule.dirs = append(rule.dirs, dir)
+					}
+				}
+			}
+			g.psr4 = append(g.psr4, rule)
+		}
+	}
+	// The longest prefix wins, like in the composer autoloader.
+	sort.SliceStable(g.psr4, func(i, j int) bool {
+		return len(g.psr4[i].prefix) > len(g.psr4[j].prefix)
+	})
+	return g, nil
+}
+
+// Generate returns the test double source for the class.
+func (g *mockGenerator) Generate(className string) ([]byte, error) {
+	decl, err := g.findClass(className)
+	if err != nil {
+		return nil, err
+	}
+	if decl == nil {
+		return nil, fmt.Errorf("can't find %s declaration: only PSR-4 autoloaded classes can be mocked", className)
+	}
+	if decl.Final {
+		return nil, fmt.Errorf("can't mock final class %s", className)
+	}
+
+	methods, err := g.mockedMethods(decl)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := ""
+	mockName := mockClassName(decl.Name)
+	if i := strings.LastIndexByte(mockName, '\\'); i != -1 {
+		namespace = mockName[:i]
+		mockName = mockName[i+1:]
+	}
+	type mockMethod struct {
+		*methodDecl
+		Key          string
+		ReturnsValue bool
+		DefaultValue string
+	}
+	templateData := map[string]interface{}{
+		"Namespace": namespace,
+		"Name":      mockName,
+		"Mocked":    decl.Name,
+		"Interface": decl.Interface,
+	}
+	var mockMethods []mockMethod
+	for _, m := range methods {
+		returnType := strings.ToLower(m.ReturnType)
+		mockMethods = append(mockMethods, mockMethod{
+			methodDecl:   m,
+			Key:          strings.ToLower(m.Name),
+			ReturnsValue: returnType != "void",
+			DefaultValue: defaultValueForType(returnType),
+		})
+	}
+	templateData["Methods"] = mockMethods
+
+	var generated bytes.Buffer
+	if err := mockTemplate.Execute(&generated, templateData); err != nil {
+		return nil, err
+	}
+	return generated.Bytes(), nil
+}
+
+// mockedMethods collects the overridable methods of the class and its parents.
+// The nearest declaration wins, like with the usual inheritance.
+func (g *mockGenerator) mockedMethods(decl *classDecl) ([]*methodDecl, error) {
+	var methods []*methodDecl
+	seen := make(map[string]bool)
+	visited := make(map[string]bool)
+	var walk func(decl *classDecl) error
+	walk = func(decl *classDecl) error {
+		if visited[strings.ToLower(decl.Name)] {
+			return nil
+		}
+		visited[strings.ToLower(decl.Name)] = true
+		for _, m := range decl.Methods {
+			key := strings.ToLower(m.Name)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			// Final methods can't be overridden; the constructor
+			// and other magic methods are not mocked.
+			if m.Static || m.Final || m.Visibility == "private" || strings.HasPrefix(m.Name, "__") {
+				continue
+			}
+			methods = append(methods, m)
+		}
+		for _, parentName := range decl.Parents {
+			parent, err := g.findClass(parentName)
+			if err != nil {
+				return err
+			}
+			// Built-in classes and interfaces can't be found,
+			// their methods are not mocked.
+			if parent == nil {
+				continue
+			}
+			if err := walk(parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(decl)
+	return methods, err
+}
+
+// findClass returns nil if the class source can't be found.
+func (g *mockGenerator) findClass(className string) (*classDecl, error) {
+	key := strings.ToLower(className)
+	if decl, ok := g.classes[key]; ok {
+		return decl, nil
+	}
+	for _, rule := range g.psr4 {
+		if !strings.HasPrefix(className, rule.prefix) {
+			continue
+		}
+		relPath := strings.ReplaceAll(strings.TrimPrefix(className, rule.prefix), `\`, "/") + ".php"
+		for _, dir := range rule.dirs {
+			filename := filepath.Join(g.composerRoot, dir, relPath)
+			if g.parsedFiles[filename] || !fileutil.FileExists(filename) {
+				continue
+			}
+			if err := g.parseClassFile(filename); err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			if decl, ok := g.classes[key]; ok {
+				return decl, nil
+			}
+		}
+	}
+	g.classes[key] = nil
+	return nil, nil
+}
+
+func (g *mockGenerator) parseClassFile(filename string) error {
+	g.parsedFiles[filename] = true
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	src, _ = phpsyntax.MaskAttributes(src)
+	rootNode, err := parsePHPSource(src, g.phpVersion)
+	if err != nil {
+		return err
+	}
+	v := &classDeclVisitor{src: src}
+	traverser.NewTraverser(v).Traverse(rootNode)
+	for _, decl := range v.out {
+		g.classes[strings.ToLower(decl.Name)] = decl
+	}
+	return nil
+}
+
+// classDeclVisitor collects the class and interface declarations of a file.
+type classDeclVisitor struct {
+	visitor.Null
+	nameResolver
+	src []byte
+
+	out     []*classDecl
+	current *classDecl
+}
+
+func (v *classDeclVisitor) StmtNamespace(n *ast.StmtNamespace) {
+	v.enterNamespace(n)
+}
+
+func (v *classDeclVisitor) StmtUse(n *ast.StmtUseList) {
+	for _, u := range n.Uses {
+		u := u.(*ast.StmtUse)
+		if name, ok := u.Use.(*ast.Name); ok && u.Type == nil {
+			v.addUse(name, u.Alias)
+		}
+	}
+}
+
+func (v *classDeclVisitor) StmtClass(n *ast.StmtClass) {
+	ident, ok := n.Name.(*ast.Identifier)
+	if !ok {
+		// Anonymous classes can't be mocked.
+		v.current = nil
+		return
+	}
+	decl := &classDecl{
+		Name:  v.currentNamespace + string(ident.Value),
+		Final: hasModifier(n.Modifiers, "final"),
+	}
+	if n.Extends != nil {
+		decl.Parents = append(decl.Parents, v.resolveClassName(n.Extends))
+	}
+	for _, iface := range n.Implements {
+		decl.Parents = append(decl.Parents, v.resolveClassName(iface))
+	}
+	v.out = append(v.out, decl)
+	v.current = decl
+}
+
+func (v *classDeclVisitor) StmtInterface(n *ast.StmtInterface) {
+	decl := &classDecl{
+		Name:      v.currentNamespace + string(n.Name.(*ast.Identifier).Value),
+		Interface: true,
+	}
+	for _, parent := range n.Extends {
+		decl.Parents = append(decl.Parents, v.resolveClassName(parent))
+	}
+	v.out = append(v.out, decl)
+	v.current = decl
+}
+
+func (v *classDeclVisitor) StmtTrait(n *ast.StmtTrait) {
+	v.current = nil
+}
+
+func (v *classDeclVisitor) StmtClassMethod(n *ast.StmtClassMethod) {
+	if v.current == nil {
+		return
+	}
+	m := &methodDecl{
+		Name:       string(n.Name.(*ast.Identifier).Value),
+		Visibility: "public",
+		Static:     hasModifier(n.Modifiers, "static"),
+		Final:      hasModifier(n.Modifiers, "final"),
+		ByRef:      n.AmpersandTkn != nil,
+	}
+	for _, visibility := range []string{"protected", "private"} {
+		if hasModifier(n.Modifiers, visibility) {
+			m.Visibility = visibility
+		}
+	}
+	for _, p := range n.Params {
+		m.Params = append(m.Params, v.paramDecl(p.(*ast.Parameter)))
+	}
+	if n.ReturnType != nil {
+		m.ReturnType = v.typeDecl(n.ReturnType)
+	}
+	v.current.Methods = append(v.current.Methods, m)
+}
+
+func (v *classDeclVisitor) paramDecl(p *ast.Parameter) string {
+	var decl strings.Builder
+	if p.Type != nil {
+		decl.WriteString(v.typeDecl(p.Type) + " ")
+	}
+	if p.AmpersandTkn != nil {
+		decl.WriteString("&")
+	}
+	if p.VariadicTkn != nil {
+		decl.WriteString("...")
+	}
+	decl.WriteString(string(v.src[p.Var.GetPosition().StartPos:p.Var.GetPosition().EndPos]))
+	if p.DefaultValue != nil {
+		decl.WriteString(" = " + v.exprDecl(p.DefaultValue))
+	}
+	return decl.String()
+}
+
+// exprDecl returns a constant expression (like a parameter default value)
+// with the class names resolved, so it can be used outside of the current file.
+func (v *classDeclVisitor) exprDecl(n ast.Vertex) string {
+	pos := n.GetPosition()
+	src := v.src[pos.StartPos:pos.EndPos]
+	names := &classNamesVisitor{resolve: v.classRef, offset: pos.StartPos}
+	traverser.NewTraverser(names).Traverse(n)
+	if fixed := applyTextEdits(src, names.edits); fixed != nil {
+		return string(fixed)
+	}
+	return string(src)
+}
+
+// classRef returns the fully qualified class name with the leading slash.
+// An empty string is returned for static and parent.
+func (v *classDeclVisitor) classRef(n ast.Vertex) string {
+	if name, ok := n.(*ast.Name); ok && strings.EqualFold(astNameToString(name), "self") {
+		return `\` + v.current.Name
+	}
+	if fqn := v.resolveClassName(n); fqn != "" {
+		return `\` + fqn
+	}
+	return ""
+}
+
+// classNamesVisitor collects the edits that replace the class names
+// of an expression with the names returned by resolve.
+// The edit positions are relative to the offset.
+type classNamesVisitor struct {
+	visitor.Null
+	resolve func(n ast.Vertex) string
+	offset  int
+
+	edits []textEdit
+}
+
+func (v *classNamesVisitor) ExprClassConstFetch(n *ast.ExprClassConstFetch) {
+	v.replace(n.Class)
+}
+
+func (v *classNamesVisitor) ExprNew(n *ast.ExprNew) {
+	v.replace(n.Class)
+}
+
+func (v *classNamesVisitor) replace(class ast.Vertex) {
+	name := v.resolve(class)
+	if name == "" {
+		return
+	}
+	pos := class.GetPosition()
+	v.edits = append(v.edits, textEdit{
+		StartPos:    pos.StartPos - v.offset,
+		EndPos:      pos.EndPos - v.offset,
+		Replacement: name,
+	})
+}
+
+// typeDecl returns a type declaration that can be used outside of the current file.
+func (v *classDeclVisitor) typeDecl(n ast.Vertex) string {
+	switch n := n.(type) {
+	case *ast.Nullable:
+		return "?" + v.typeDecl(n.Expr)
+	case *ast.Identifier:
+		return string(n.Value)
+	case *ast.Name:
+		name := astNameToString(n)
+		switch strings.ToLower(name) {
+		case "self":
+			return `\` + v.current.Name
+		case "int", "float", "string", "bool", "array", "callable", "iterable", "object", "void", "mixed":
+			return name
+		}
+	}
+	return `\` + v.resolveClassName(n)
+}
+
+// defaultValueForType returns the value that the test double method
+// returns until it's configured with willReturn.
+func defaultValueForType(typ string) string {
+	switch typ {
+	case "int":
+		return "0"
+	case "float":
+		return "0.0"
+	case "string":
+		return "''"
+	case "bool":
+		return "false"
+	case "array", "iterable":
+		return "[]"
+	default:
+		return "null"
+	}
+}
+
+// mockTemplate is a test double class.
+// Every mocked method records the call and returns the configured value or throws the configured exception.
+var mockTemplate = template.Must(template.New("mock").Parse(`<?php
+{{if .Namespace}}
+namespace {{.Namespace}};
+{{end}}
+/**
+ * {{.Name}} is a test double for \{{.Mocked}}, generated by ktest.
+ */
+class {{.Name}} {{if .Interface}}implements{{else}}extends{{end}} \{{.Mocked}} {
+  /** @var string[] */
+  public $__ktest_calls = [];
+{{- range .Methods}}
+{{if .ReturnsValue}}
+  public $__ktest_return_{{.Key}} = {{.DefaultValue}};
+{{- end}}
+  /** @var ?\Throwable */
+  public $__ktest_throw_{{.Key}} = null;
+{{- end}}
+{{if not .Interface}}
+  public function __construct() {}
+{{end}}
+{{- range .Methods}}
+  {{.Visibility}} function {{if .ByRef}}&{{end}}{{.Name}}({{range $i, $p := .Params}}{{if $i}}, {{end}}{{$p}}{{end}}){{if .ReturnType}}: {{.ReturnType}}{{end}} {
+    $this->__ktest_calls[] = '{{.Name}}';
+    if ($this->__ktest_throw_{{.Key}} !== null) {
+      throw $this->__ktest_throw_{{.Key}};
+    }
+    {{- if .ReturnsValue}}
+    return $this->__ktest_return_{{.Key}};
+    {{- end}}
+  }
+{{if .ReturnsValue}}
+  public function __ktest_will_return_{{.Key}}({{if .ReturnType}}{{.ReturnType}} {{end}}$value) {
+    $this->__ktest_return_{{.Key}} = $value;
+  }
+{{end}}
+  public function __ktest_will_throw_{{.Key}}(\Throwable $e) {
+    $this->__ktest_throw_{{.Key}} = $e;
+  }
+{{end -}}
+}
+`))
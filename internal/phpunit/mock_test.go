@@ -0,0 +1,188 @@
+package phpunit
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/VKCOM/ktest/internal/fileutil"
+	"github.com/google/go-cmp/cmp"
+	"github.com/z7zmey/php-parser/pkg/version"
+)
+
+func TestMockGenerator(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"composer.json": `{"autoload": {"psr-4": {"App\\": "src/"}}}`,
+		"src/Clock.php": `<?php
+namespace App;
+
+interface Clock {
+    public function now(): int;
+}
+`,
+		"src/Repo/UserRepository.php": `<?php
+namespace App\Repo;
+
+use App\Model\User as U;
+
+class UserRepository implements \App\Clock {
+    public function __construct(string $dsn) {}
+    public function find(int $id, ?U $default = null): ?U { return null; }
+    public function save(U ...$users): void {}
+    final public function name(): string { return 'repo'; }
+    public static function create(): self { return new self(''); }
+    public function now(): int { return 0; }
+}
+`,
+		"src/Repo/FinalRepository.php": `<?php
+namespace App\Repo;
+
+final class FinalRepository {}
+`,
+	}
+	for name, contents := range files {
+		if err := fileutil.WriteFile(filepath.Join(root, name), []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := newMockGenerator(root, &version.Version{Major: 7, Minor: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := g.Generate(`App\Repo\UserRepository`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`<?php`,
+		``,
+		`namespace App\Repo;`,
+		``,
+		`/**`,
+		` * KtestMock_UserRepository is a test double for \App\Repo\UserRepository, generated by ktest.`,
+		` */`,
+		`class KtestMock_UserRepository extends \App\Repo\UserRepository {`,
+		`  /** @var string[] */`,
+		`  public $__ktest_calls = [];`,
+		``,
+		`  public $__ktest_return_find = null;`,
+		`  /** @var ?\Throwable */`,
+		`  public $__ktest_throw_find = null;`,
+		``,
+		`  /** @var ?\Throwable */`,
+		`  public $__ktest_throw_save = null;`,
+		``,
+		`  public $__ktest_return_now = 0;`,
+		`  /** @var ?\Throwable */`,
+		`  public $__ktest_throw_now = null;`,
+		``,
+		`  public function __construct() {}`,
+		``,
+		`  public function find(int $id, ?\App\Model\User $default = null): ?\App\Model\User {`,
+		`    $this->__ktest_calls[] = 'find';`,
+		`    if ($this->__ktest_throw_find !== null) {`,
+		`      throw $this->__ktest_throw_find;`,
+		`    }`,
+		`    return $this->__ktest_return_find;`,
+		`  }`,
+		``,
+		`  public function __ktest_will_return_find(?\App\Model\User $value) {`,
+		`    $this->__ktest_return_find = $value;`,
+		`  }`,
+		``,
+		`  public function __ktest_will_throw_find(\Throwable $e) {`,
+		`    $this->__ktest_throw_find = $e;`,
+		`  }`,
+		``,
+		`  public function save(\App\Model\User ...$users): void {`,
+		`    $this->__ktest_calls[] = 'save';`,
+		`    if ($this->__ktest_throw_save !== null) {`,
+		`      throw $this->__ktest_throw_save;`,
+		`    }`,
+		`  }`,
+		``,
+		`  public function __ktest_will_throw_save(\Throwable $e) {`,
+		`    $this->__ktest_throw_save = $e;`,
+		`  }`,
+		``,
+		`  public function now(): int {`,
+		`    $this->__ktest_calls[] = 'now';`,
+		`    if ($this->__ktest_throw_now !== null) {`,
+		`      throw $this->__ktest_throw_now;`,
+		`    }`,
+		`    return $this->__ktest_return_now;`,
+		`  }`,
+		``,
+		`  public function __ktest_will_return_now(int $value) {`,
+		`    $this->__ktest_return_now = $value;`,
+		`  }`,
+		``,
+		`  public function __ktest_will_throw_now(\Throwable $e) {`,
+		`    $this->__ktest_throw_now = $e;`,
+		`  }`,
+		`}`,
+		``,
+	}, "\n")
+	if diff := cmp.Diff(string(src), want); diff != "" {
+		t.Errorf("generated mock mismatch (-have +want):\n%s", diff)
+	}
+
+	src, err = g.Generate(`App\Clock`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), `class KtestMock_Clock implements \App\Clock {`) {
+		t.Errorf("interface mock doesn't implement the interface:\n%s", src)
+	}
+	if strings.Contains(string(src), "__construct") {
+		t.Errorf("interface mock shouldn't override the constructor:\n%s", src)
+	}
+
+	if _, err := g.Generate(`App\Repo\FinalRepository`); err == nil {
+		t.Errorf("expected an error for the final class")
+	}
+	if _, err := g.Generate(`App\Missing`); err == nil {
+		t.Errorf("expected an error for the missing class")
+	}
+}
+
+func TestMockGeneratorDefaultValues(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"composer.json": `{"autoload": {"psr-4": {"App\\": "src/"}}}`,
+		"src/Repo/OrderRepository.php": `<?php
+namespace App\Repo;
+
+use App\Model\Status;
+use App\Model as M;
+
+class OrderRepository {
+    const LIMIT = 10;
+
+    public function find(int $status = Status::ACTIVE, array $sort = [M\Order::class => self::LIMIT], string $name = \PHP_EOL, $state = Filter::ANY) {}
+}
+`,
+	}
+	for name, contents := range files {
+		if err := fileutil.WriteFile(filepath.Join(root, name), []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := newMockGenerator(root, &version.Version{Major: 7, Minor: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := g.Generate(`App\Repo\OrderRepository`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The double is generated in another file, so the imported names are resolved.
+	want := `public function find(int $status = \App\Model\Status::ACTIVE, array $sort = [\App\Model\Order::class => \App\Repo\OrderRepository::LIMIT], string $name = \PHP_EOL, $state = \App\Repo\Filter::ANY) {`
+	if !strings.Contains(string(src), want) {
+		t.Errorf("generated mock doesn't contain:\n%s\n\ngenerated mock:\n%s", want, src)
+	}
+}
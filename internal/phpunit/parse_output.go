@@ -2,127 +2,577 @@ package phpunit
 
 import (
 	"bytes"
-	"encoding/json"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type testFileResult struct {
 	finished bool
 	asserts  int
 	failures []TestFailure
+	errors   []TestFailure
+	tests    []TestResult
+
+	skipped    []TestFailure
+	incomplete []TestFailure
+	risky      []TestFailure
+
+	// unfinished is set if the last test has started, but not ended.
+	unfinished bool
 }
 
-func parseTestOutput(f *testFile, output []byte) (*testFileResult, error) {
+// parseTestOutput parses the test executable stdout;
+// marker is the event marker of the run (see newEventMarker).
+func parseTestOutput(f *testFile, marker string, output []byte) (*testFileResult, error) {
 	res := &testFileResult{}
 
-	var currentTest string
-	for i, line := range bytes.Split(output, []byte("\n")) {
-		if len(line) == 0 {
-			continue
+	var currentClass string
+	var currentTest *TestResult
+	// Output of the current test, it's attached to the test result
+	// and its failures (testFailures and testErrors are their indexes) on END.
+	var testOutput bytes.Buffer
+	var testFailures, testErrors []int
+	// testMark is the SKIPPED or INCOMPLETE op of the current test.
+	var testMark string
+	addAssert := func() {
+		res.asserts++
+		if currentTest != nil {
+			currentTest.Assertions++
 		}
-		var fields []interface{}
-		if err := json.Unmarshal(line, &fields); err != nil {
-			return nil, fmt.Errorf("output line %d: %s: %v", i+1, line, err)
+	}
+	addFailure := func(failure TestFailure) {
+		addAssert()
+		// Assertions can fail outside of the test methods (like in setUpBeforeClass).
+		failure.Name = currentClass
+		failure.File = f.fullName
+		if currentTest != nil {
+			failure.Name += "::" + currentTest.Name
+			failure.File = f.testMethodFile(currentClass, currentTest.Name)
+		}
+		res.failures = append(res.failures, failure)
+		if currentTest != nil {
+			currentTest.Failure = &failure
+			testFailures = append(testFailures, len(res.failures)-1)
+		}
+	}
+
+	addError := func(testErr TestFailure) {
+		testErr.Name = currentClass
+		if currentTest != nil {
+			testErr.Name += "::" + currentTest.Name
 		}
-		if len(fields) == 0 {
-			return nil, fmt.Errorf("output line %d: %s: empty fields", i+1, line)
+		if testErr.File == "" {
+			testErr.File = f.fullName
+			if currentTest != nil {
+				testErr.File = f.testMethodFile(currentClass, currentTest.Name)
+			}
+		}
+		res.errors = append(res.errors, testErr)
+		if currentTest != nil {
+			currentTest.Error = &testErr
+			testErrors = append(testErrors, len(res.errors)-1)
+		}
+	}
+
+	// Skipped and incomplete tests are interrupted, so there is only one mark per test.
+	addMark := func(op string, mark TestFailure) {
+		mark.Name = currentClass
+		mark.File = f.fullName
+		if currentTest != nil {
+			mark.Name += "::" + currentTest.Name
+			mark.File = f.testMethodFile(currentClass, currentTest.Name)
+		}
+		if op == "SKIPPED" {
+			res.skipped = append(res.skipped, mark)
+		} else {
+			res.incomplete = append(res.incomplete, mark)
+		}
+		testMark = op
+	}
+
+	addOutput := func(text []byte) {
+		if currentTest != nil {
+			testOutput.Write(text)
+		}
+	}
+
+	handleEvent := func(fields []interface{}) error {
+		op, err := checkEventFields(fields)
+		if err != nil {
+			return err
 		}
-		op := fields[0].(string)
 		switch op {
+		case "CLASS":
+			currentClass = fields[1].(string)
 		case "START":
-			currentTest = fields[1].(string)
+			res.tests = append(res.tests, TestResult{
+				Class: currentClass,
+				Name:  fields[1].(string),
+				File:  f.fullName,
+			})
+			currentTest = &res.tests[len(res.tests)-1]
+			res.unfinished = true
+			testOutput.Reset()
+			testFailures = testFailures[:0]
+			testErrors = testErrors[:0]
+			testMark = ""
+		case "END":
+			if currentTest != nil {
+				currentTest.Time = time.Duration(fields[2].(float64))
+				currentTest.Output = testOutput.String()
+				switch {
+				case testMark == "SKIPPED":
+					res.skipped[len(res.skipped)-1].Output = currentTest.Output
+					skipped := res.skipped[len(res.skipped)-1]
+					currentTest.Skipped = &skipped
+				case testMark == "INCOMPLETE":
+					res.incomplete[len(res.incomplete)-1].Output = currentTest.Output
+					incomplete := res.incomplete[len(res.incomplete)-1]
+					currentTest.Incomplete = &incomplete
+				case currentTest.Failure == nil && currentTest.Error == nil && currentTest.Assertions == 0:
+					risky := TestFailure{
+						Name:    currentClass + "::" + currentTest.Name,
+						Message: "This test did not perform any assertions",
+						File:    f.testMethodFile(currentClass, currentTest.Name),
+						Line:    f.testMethodLine(currentClass, currentTest.Name),
+						Output:  currentTest.Output,
+					}
+					res.risky = append(res.risky, risky)
+					currentTest.Risky = &risky
+				}
+				for _, i := range testFailures {
+					res.failures[i].Output = currentTest.Output
+				}
+				for _, i := range testErrors {
+					res.errors[i].Output = currentTest.Output
+				}
+				if currentTest.Failure != nil {
+					currentTest.Failure.Output = currentTest.Output
+				}
+				if currentTest.Error != nil {
+					currentTest.Error.Output = currentTest.Output
+				}
+			}
+			currentTest = nil
+			res.unfinished = false
 		case "FAIL":
-			res.asserts++
 			message := fields[1].(string)
 			line := fields[2].(float64)
-			res.failures = append(res.failures, TestFailure{
-				Name:    f.info.ClassName + "::" + currentTest,
+			addFailure(TestFailure{
 				Message: message,
-				File:    f.fullName,
 				Line:    int(line),
 			})
 		case "ASSERT_OK":
-			res.asserts++
+			addAssert()
+		case "SKIPPED", "INCOMPLETE":
+			message := fields[1].(string)
+			line := fields[2].(float64)
+			addMark(op, TestFailure{
+				Message: message,
+				Line:    int(line),
+			})
 		case "FINISHED":
 			res.finished = true
 		case "ASSERT_EQUALS_FAILED":
-			res.asserts++
 			expected := fields[1]
 			actual := fields[2]
 			message := fields[3].(string)
 			line := fields[4].(float64)
 			reason := fmt.Sprintf("Failed asserting that %s matches expected %s",
 				jsonString(actual), jsonString(expected))
-			res.failures = append(res.failures, TestFailure{
-				Name:    f.info.ClassName + "::" + currentTest,
+			addFailure(comparisonFailure(TestFailure{
 				Reason:  reason,
 				Message: message,
-				File:    f.fullName,
 				Line:    int(line),
-			})
+			}, expected, actual, "equal"))
 		case "ASSERT_NOT_EQUALS_FAILED":
-			res.asserts++
 			expected := fields[1]
 			actual := fields[2]
 			message := fields[3].(string)
 			line := fields[4].(float64)
 			reason := fmt.Sprintf("Failed asserting that %s is not equal to %s",
 				jsonString(actual), jsonString(expected))
-			res.failures = append(res.failures, TestFailure{
-				Name:    f.info.ClassName + "::" + currentTest,
+			addFailure(TestFailure{
 				Reason:  reason,
 				Message: message,
-				File:    f.fullName,
 				Line:    int(line),
 			})
 		case "ASSERT_BOOL_FAILED":
-			res.asserts++
 			expected := fields[1]
 			actual := fields[2]
 			message := fields[3].(string)
 			line := fields[4].(float64)
 			reason := fmt.Sprintf("Failed asserting that %s is %s", jsonString(actual), expected)
-			res.failures = append(res.failures, TestFailure{
-				Name:    f.info.ClassName + "::" + currentTest,
+			addFailure(TestFailure{
 				Reason:  reason,
 				Message: message,
-				File:    f.fullName,
 				Line:    int(line),
 			})
 		case "ASSERT_NOT_SAME_FAILED":
-			res.asserts++
 			expected := fields[1]
 			actual := fields[2]
 			message := fields[3].(string)
 			line := fields[4].(float64)
 			reason := fmt.Sprintf("Failed asserting that %s is not identical to %s",
 				jsonString(actual), jsonString(expected))
-			res.failures = append(res.failures, TestFailure{
-				Name:    f.info.ClassName + "::" + currentTest,
+			addFailure(TestFailure{
 				Reason:  reason,
 				Message: message,
-				File:    f.fullName,
 				Line:    int(line),
 			})
 		case "ASSERT_SAME_FAILED":
-			res.asserts++
 			expected := fields[1]
 			actual := fields[2]
 			message := fields[3].(string)
 			line := fields[4].(float64)
 			reason := fmt.Sprintf("Failed asserting that %s is identical to %s",
 				jsonString(actual), jsonString(expected))
-			res.failures = append(res.failures, TestFailure{
-				Name:    f.info.ClassName + "::" + currentTest,
+			addFailure(comparisonFailure(TestFailure{
+				Reason:  reason,
+				Message: message,
+				Line:    int(line),
+			}, expected, actual, "identical"))
+		case "ASSERT_COUNT_FAILED", "ASSERT_NOT_COUNT_FAILED":
+			expected := fields[1]
+			actual := fields[2]
+			message := fields[3].(string)
+			line := fields[4].(float64)
+			relation := "matches"
+			if op == "ASSERT_NOT_COUNT_FAILED" {
+				relation = "does not match"
+			}
+			reason := fmt.Sprintf("Failed asserting that actual size %s %s expected size %s",
+				jsonString(actual), relation, jsonString(expected))
+			addFailure(TestFailure{
 				Reason:  reason,
 				Message: message,
-				File:    f.fullName,
 				Line:    int(line),
 			})
+		case "ASSERT_NULL_FAILED", "ASSERT_NOT_NULL_FAILED":
+			message := fields[1].(string)
+			line := fields[2].(float64)
+			reason := "Failed asserting that value is null"
+			if op == "ASSERT_NOT_NULL_FAILED" {
+				reason = "Failed asserting that null is not null"
+			}
+			addFailure(TestFailure{
+				Reason:  reason,
+				Message: message,
+				Line:    int(line),
+			})
+		case "ASSERT_EMPTY_FAILED", "ASSERT_NOT_EMPTY_FAILED":
+			actual := fields[1]
+			message := fields[2].(string)
+			line := fields[3].(float64)
+			relation := "is empty"
+			if op == "ASSERT_NOT_EMPTY_FAILED" {
+				relation = "is not empty"
+			}
+			addFailure(TestFailure{
+				Reason:  fmt.Sprintf("Failed asserting that %s %s", jsonString(actual), relation),
+				Message: message,
+				Line:    int(line),
+			})
+		case "ASSERT_CONTAINS_FAILED", "ASSERT_NOT_CONTAINS_FAILED":
+			needle := fields[1]
+			message := fields[2].(string)
+			line := fields[3].(float64)
+			relation := "contains"
+			if op == "ASSERT_NOT_CONTAINS_FAILED" {
+				relation = "does not contain"
+			}
+			addFailure(TestFailure{
+				Reason:  fmt.Sprintf("Failed asserting that an array %s %s", relation, jsonString(needle)),
+				Message: message,
+				Line:    int(line),
+			})
+		case "ASSERT_ARRAY_HAS_KEY_FAILED", "ASSERT_ARRAY_NOT_HAS_KEY_FAILED":
+			key := fields[1]
+			message := fields[2].(string)
+			line := fields[3].(float64)
+			relation := "has the key"
+			if op == "ASSERT_ARRAY_NOT_HAS_KEY_FAILED" {
+				relation = "does not have the key"
+			}
+			addFailure(TestFailure{
+				Reason:  fmt.Sprintf("Failed asserting that an array %s %s", relation, jsonString(key)),
+				Message: message,
+				Line:    int(line),
+			})
+		case "ASSERT_STRING_CONTAINS_FAILED", "ASSERT_STRING_NOT_CONTAINS_FAILED",
+			"ASSERT_STRING_STARTS_WITH_FAILED", "ASSERT_STRING_ENDS_WITH_FAILED":
+			needle := fields[1].(string)
+			haystack := fields[2].(string)
+			message := fields[3].(string)
+			line := fields[4].(float64)
+			relation := map[string]string{
+				"ASSERT_STRING_CONTAINS_FAILED":     "contains",
+				"ASSERT_STRING_NOT_CONTAINS_FAILED": "does not contain",
+				"ASSERT_STRING_STARTS_WITH_FAILED":  "starts with",
+				"ASSERT_STRING_ENDS_WITH_FAILED":    "ends with",
+			}[op]
+			addFailure(TestFailure{
+				Reason:  fmt.Sprintf(`Failed asserting that '%s' %s "%s"`, haystack, relation, needle),
+				Message: message,
+				Line:    int(line),
+			})
+		case "ASSERT_EQUALS_WITH_DELTA_FAILED":
+			expected := fields[1]
+			actual := fields[2]
+			delta := fields[3]
+			message := fields[4].(string)
+			line := fields[5].(float64)
+			reason := fmt.Sprintf("Failed asserting that %s matches expected %s (delta %s)",
+				jsonString(actual), jsonString(expected), jsonString(delta))
+			addFailure(TestFailure{
+				Reason:   reason,
+				Message:  message,
+				Line:     int(line),
+				Expected: jsonString(expected),
+				Actual:   jsonString(actual),
+			})
+		case "ASSERT_COMPARISON_FAILED":
+			expected := fields[1]
+			actual := fields[2]
+			relation := fields[3].(string)
+			message := fields[4].(string)
+			line := fields[5].(float64)
+			var reason string
+			switch relation {
+			case "greater than or equal", "less than or equal":
+				reason = fmt.Sprintf("Failed asserting that %s is equal to %s or is %s %s",
+					jsonString(actual), jsonString(expected), strings.TrimSuffix(relation, " or equal"), jsonString(expected))
+			default:
+				reason = fmt.Sprintf("Failed asserting that %s is %s %s",
+					jsonString(actual), relation, jsonString(expected))
+			}
+			addFailure(TestFailure{
+				Reason:  reason,
+				Message: message,
+				Line:    int(line),
+			})
+		case "ASSERT_TYPE_FAILED":
+			typ := fields[1].(string)
+			actual := fields[2]
+			message := fields[3].(string)
+			line := fields[4].(float64)
+			addFailure(TestFailure{
+				Reason:  fmt.Sprintf(`Failed asserting that %s is of type "%s"`, jsonString(actual), typ),
+				Message: message,
+				Line:    int(line),
+			})
+		case "ASSERT_INSTANCE_OF_FAILED":
+			class := fields[1].(string)
+			message := fields[2].(string)
+			line := fields[3].(float64)
+			addFailure(TestFailure{
+				Reason:  fmt.Sprintf(`Failed asserting that value is an instance of class "%s"`, class),
+				Message: message,
+				Line:    int(line),
+			})
+		case "ERROR":
+			class := fields[1].(string)
+			message := fields[2].(string)
+			file := fields[3].(string)
+			line := fields[4].(float64)
+			addError(TestFailure{
+				Message: class + ": " + message,
+				File:    file,
+				Line:    int(line),
+			})
+		case "EXCEPTION_NOT_THROWN":
+			expected := fields[1].(string)
+			line := fields[2].(float64)
+			addFailure(TestFailure{
+				Reason: fmt.Sprintf(`Failed asserting that exception of type "%s" is thrown`, expected),
+				Line:   int(line),
+			})
+		case "EXCEPTION_MISMATCH":
+			expected := fields[1].(string)
+			actual := fields[2].(string)
+			message := fields[3].(string)
+			line := fields[4].(float64)
+			reason := fmt.Sprintf(`Failed asserting that exception of type "%s" matches expected exception "%s". Message was: "%s"`,
+				actual, expected, message)
+			addFailure(TestFailure{
+				Reason: reason,
+				Line:   int(line),
+			})
+		case "EXCEPTION_MESSAGE_FAILED":
+			expected := fields[1].(string)
+			actual := fields[2].(string)
+			line := fields[3].(float64)
+			reason := fmt.Sprintf("Failed asserting that exception message '%s' contains '%s'", actual, expected)
+			addFailure(TestFailure{
+				Reason:   reason,
+				Line:     int(line),
+				Expected: expected,
+				Actual:   actual,
+			})
+		case "EXCEPTION_CODE_FAILED":
+			expected := fields[1]
+			actual := fields[2]
+			line := fields[3].(float64)
+			reason := fmt.Sprintf("Failed asserting that %s is equal to expected exception code %s",
+				jsonString(actual), jsonString(expected))
+			addFailure(TestFailure{
+				Reason: reason,
+				Line:   int(line),
+			})
 		default:
-			return nil, fmt.Errorf("output line %d: %s: unexpected op %s", i+1, line, op)
+			return fmt.Errorf("unexpected op %s", op)
+		}
+		return nil
+	}
+
+	// The output is the test output with the runtime events in between.
+	// Every event is a separate line that starts with the marker
+	// (the runtime writes a newline before it, see __kphpunit_event);
+	// anything else, including the marker in the middle of a line, is the test output.
+	eventPrefix := []byte("\n" + marker)
+	for eventNum := 1; len(output) != 0; eventNum++ {
+		i := bytes.Index(output, eventPrefix)
+		if i == -1 {
+			addOutput(output)
+			break
+		}
+		addOutput(output[:i])
+		event := output[i+len(eventPrefix):]
+		output = nil
+		if end := bytes.IndexByte(event, '\n'); end != -1 {
+			output = event[end+1:]
+			event = event[:end]
+		}
+
+		var fields []interface{}
+		if err := unmarshalJSONArray(event, &fields); err != nil {
+			return nil, fmt.Errorf("event %d: %s: %v", eventNum, event, err)
+		}
+		if err := handleEvent(fields); err != nil {
+			return nil, fmt.Errorf("event %d: %s: %v", eventNum, event, err)
 		}
 	}
 
 	return res, nil
 }
+
+// comparisonFailure completes the failed equality assertion info.
+// Two arrays or two strings are compared with a diff, like PHPUnit does;
+// the other values are described by the failure reason only.
+func comparisonFailure(failure TestFailure, expected, actual interface{}, relation string) TestFailure {
+	failure.Expected = jsonString(expected)
+	failure.Actual = jsonString(actual)
+
+	kind := ""
+	switch expected.(type) {
+	case []interface{}, jsonObject:
+		switch actual.(type) {
+		case []interface{}, jsonObject:
+			kind = "arrays"
+		}
+	case string:
+		if _, ok := actual.(string); ok {
+			kind = "strings"
+		}
+	}
+	if kind == "" {
+		return failure
+	}
+
+	failure.Reason = fmt.Sprintf("Failed asserting that two %s are %s", kind, relation)
+	failure.Expected = exportValue(expected)
+	failure.Actual = exportValue(actual)
+	failure.Diff = unifiedDiff(failure.Expected, failure.Actual)
+	return failure
+}
+
+// newEventMarker returns a marker that prefixes the events written by the runtime
+// (see runtimeSource), so they can't be confused with the test output.
+// It's random for every run and passed to the test main as the first argument,
+// so the tests can't forge the events.
+func newEventMarker() string {
+	var nonce [8]byte
+	if _, err := cryptorand.Read(nonce[:]); err != nil {
+		binary.LittleEndian.PutUint64(nonce[:], uint64(time.Now().UnixNano()))
+	}
+	return "##ktest-" + hex.EncodeToString(nonce[:]) + "## "
+}
+
+// eventFields describe the event fields after the op name:
+// s is a string, n is a number and v is any JSON value.
+var eventFields = map[string]string{
+	"CLASS":                             "s",
+	"START":                             "s",
+	"END":                               "sn",
+	"FINISHED":                          "",
+	"FAIL":                              "sn",
+	"ASSERT_OK":                         "",
+	"SKIPPED":                           "sn",
+	"INCOMPLETE":                        "sn",
+	"ASSERT_EQUALS_FAILED":              "vvsn",
+	"ASSERT_NOT_EQUALS_FAILED":          "vvsn",
+	"ASSERT_BOOL_FAILED":                "svsn",
+	"ASSERT_SAME_FAILED":                "vvsn",
+	"ASSERT_NOT_SAME_FAILED":            "vvsn",
+	"ASSERT_COUNT_FAILED":               "vvsn",
+	"ASSERT_NOT_COUNT_FAILED":           "vvsn",
+	"ASSERT_NULL_FAILED":                "sn",
+	"ASSERT_NOT_NULL_FAILED":            "sn",
+	"ASSERT_EMPTY_FAILED":               "vsn",
+	"ASSERT_NOT_EMPTY_FAILED":           "vsn",
+	"ASSERT_CONTAINS_FAILED":            "vsn",
+	"ASSERT_NOT_CONTAINS_FAILED":        "vsn",
+	"ASSERT_ARRAY_HAS_KEY_FAILED":       "vsn",
+	"ASSERT_ARRAY_NOT_HAS_KEY_FAILED":   "vsn",
+	"ASSERT_STRING_CONTAINS_FAILED":     "sssn",
+	"ASSERT_STRING_NOT_CONTAINS_FAILED": "sssn",
+	"ASSERT_STRING_STARTS_WITH_FAILED":  "sssn",
+	"ASSERT_STRING_ENDS_WITH_FAILED":    "sssn",
+	"ASSERT_EQUALS_WITH_DELTA_FAILED":   "vvvsn",
+	"ASSERT_COMPARISON_FAILED":          "vvssn",
+	"ASSERT_TYPE_FAILED":                "svsn",
+	"ASSERT_INSTANCE_OF_FAILED":         "ssn",
+	"ERROR":                             "sssn",
+	"EXCEPTION_NOT_THROWN":              "sn",
+	"EXCEPTION_MISMATCH":                "sssn",
+	"EXCEPTION_MESSAGE_FAILED":          "ssn",
+	"EXCEPTION_CODE_FAILED":             "vvn",
+}
+
+// checkEventFields returns the event op if the event fields match eventFields.
+func checkEventFields(fields []interface{}) (string, error) {
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty fields")
+	}
+	op, ok := fields[0].(string)
+	if !ok {
+		return "", fmt.Errorf("op is %s, not a string", jsonString(fields[0]))
+	}
+	kinds, ok := eventFields[op]
+	if !ok {
+		return "", fmt.Errorf("unexpected op %s", op)
+	}
+	if len(fields)-1 != len(kinds) {
+		return "", fmt.Errorf("%s: expected %d fields, got %d", op, len(kinds), len(fields)-1)
+	}
+	for i, kind := range kinds {
+		field := fields[i+1]
+		switch kind {
+		case 's':
+			_, ok = field.(string)
+		case 'n':
+			_, ok = field.(float64)
+		default:
+			ok = true
+		}
+		if !ok {
+			typ := map[rune]string{'s': "string", 'n': "number"}[kind]
+			return "", fmt.Errorf("%s: field %d is %s, not a %s", op, i+1, jsonString(field), typ)
+		}
+	}
+	return op, nil
+}
@@ -0,0 +1,413 @@
+package phpunit
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testEventMarker is the event marker of the test outputs, see newEventMarker.
+const testEventMarker = "##ktest## "
+
+func TestParseTestOutput(t *testing.T) {
+	f := &testFile{fullName: "/tests/FooTest.php"}
+	// Only the lines that start with the marker are events,
+	// everything else (even if it looks like an event) is the test output.
+	output := `
+##ktest## ["CLASS","FooTest"]
+
+##ktest## ["START","testEcho"]
+hello
+["ASSERT_OK"]
+["FAIL"]
+["ASSERT_SAME_FAILED",1]
+foo ##ktest## bar
+no newline
+##ktest## ["ASSERT_OK"]
+
+##ktest## ["END","testEcho",1000]
+
+##ktest## ["START","testFail"]
+[1, 2] is not an op
+partial
+##ktest## ["ASSERT_OK"]
+
+##ktest## ["ASSERT_SAME_FAILED",1,2,"",10]
+
+##ktest## ["END","testFail",2000]
+
+##ktest## ["FINISHED"]
+`
+	res, err := parseTestOutput(f, testEventMarker, []byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echoOutput := "hello\n[\"ASSERT_OK\"]\n[\"FAIL\"]\n[\"ASSERT_SAME_FAILED\",1]\nfoo ##ktest## bar\nno newline"
+	failureOutput := "[1, 2] is not an op\npartial"
+	failure := TestFailure{
+		Name:     "FooTest::testFail",
+		Reason:   "Failed asserting that 2 is identical to 1",
+		File:     "/tests/FooTest.php",
+		Line:     10,
+		Expected: "1",
+		Actual:   "2",
+		Output:   failureOutput,
+	}
+	want := &testFileResult{
+		finished: true,
+		asserts:  3,
+		failures: []TestFailure{failure},
+		tests: []TestResult{
+			{Class: "FooTest", Name: "testEcho", File: "/tests/FooTest.php", Assertions: 1, Time: 1000, Output: echoOutput},
+			{Class: "FooTest", Name: "testFail", File: "/tests/FooTest.php", Assertions: 2, Time: 2000, Output: failureOutput, Failure: &failure},
+		},
+	}
+	if diff := cmp.Diff(res, want, cmp.AllowUnexported(testFileResult{})); diff != "" {
+		t.Errorf("result mismatches (-have +want):\n%s", diff)
+	}
+}
+
+func TestParseTestOutputBadEvent(t *testing.T) {
+	tests := []struct {
+		event string
+		err   string
+	}{
+		{`["START"`, "unexpected end of JSON input"},
+		{`{"op":"START"}`, "expected a JSON array"},
+		{`[]`, "empty fields"},
+		{`[1]`, "op is 1, not a string"},
+		{`["UNKNOWN"]`, "unexpected op UNKNOWN"},
+		{`["FAIL"]`, "FAIL: expected 2 fields, got 0"},
+		{`["ASSERT_SAME_FAILED",1]`, "ASSERT_SAME_FAILED: expected 4 fields, got 1"},
+		{`["ASSERT_OK",1]`, "ASSERT_OK: expected 0 fields, got 1"},
+		{`["START",1]`, "START: field 1 is 1, not a string"},
+		{`["END","testFoo","1000"]`, `END: field 2 is "1000", not a number`},
+		{`["ASSERT_SAME_FAILED",1,2,null,10]`, "ASSERT_SAME_FAILED: field 3 is null, not a string"},
+		{`["ASSERT_COUNT_FAILED",3,2,"",null]`, "ASSERT_COUNT_FAILED: field 4 is null, not a number"},
+		{`["ASSERT_NULL_FAILED",11]`, "ASSERT_NULL_FAILED: expected 2 fields, got 1"},
+		{`["ASSERT_EMPTY_FAILED",[],"",9,1]`, "ASSERT_EMPTY_FAILED: expected 3 fields, got 4"},
+		{`["ASSERT_CONTAINS_FAILED",4,13]`, "ASSERT_CONTAINS_FAILED: expected 3 fields, got 2"},
+		{`["ASSERT_ARRAY_HAS_KEY_FAILED","b",1,37]`, "ASSERT_ARRAY_HAS_KEY_FAILED: field 2 is 1, not a string"},
+		{`["ASSERT_STRING_CONTAINS_FAILED","world",["hello"],"",41]`, `ASSERT_STRING_CONTAINS_FAILED: field 2 is ["hello"], not a string`},
+		{`["ASSERT_EQUALS_WITH_DELTA_FAILED",1,1.5,"",21]`, "ASSERT_EQUALS_WITH_DELTA_FAILED: expected 5 fields, got 4"},
+		{`["ASSERT_COMPARISON_FAILED",1,0,true,"",22]`, "ASSERT_COMPARISON_FAILED: field 3 is true, not a string"},
+		{`["ASSERT_TYPE_FAILED",null,"1","",27]`, "ASSERT_TYPE_FAILED: field 1 is null, not a string"},
+		{`["ASSERT_INSTANCE_OF_FAILED","RuntimeException",53]`, "ASSERT_INSTANCE_OF_FAILED: expected 3 fields, got 2"},
+	}
+
+	f := &testFile{fullName: "/tests/FooTest.php"}
+	for _, test := range tests {
+		output := "\n" + testEventMarker + `["START","testFoo"]` + "\n\n" + testEventMarker + test.event + "\n"
+		_, err := parseTestOutput(f, testEventMarker, []byte(output))
+		if err == nil {
+			t.Errorf("%s: expected an error", test.event)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error mismatch:\nhave: %v\nwant: %s", test.event, err, test.err)
+		}
+	}
+}
+
+func TestParseTestOutputArrayDiff(t *testing.T) {
+	f := &testFile{fullName: "/tests/FooTest.php"}
+	output := `
+##ktest## ["CLASS","FooTest"]
+
+##ktest## ["START","testArrays"]
+
+##ktest## ["ASSERT_EQUALS_FAILED",{"b":1,"a":2},{"b":1,"a":3},"",7]
+
+##ktest## ["END","testArrays",1000]
+
+##ktest## ["FINISHED"]
+`
+	res, err := parseTestOutput(f, testEventMarker, []byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.failures) != 1 {
+		t.Fatalf("expected 1 failure, found %d", len(res.failures))
+	}
+	failure := res.failures[0]
+	if want := "Failed asserting that two arrays are equal"; failure.Reason != want {
+		t.Errorf("reason mismatch:\nhave: %s\nwant: %s", failure.Reason, want)
+	}
+	wantDiff := "--- Expected\n+++ Actual\n@@ @@\n Array &0 (\n     'b' => 1\n-    'a' => 2\n+    'a' => 3\n )"
+	if failure.Diff != wantDiff {
+		t.Errorf("diff mismatch:\nhave:\n%s\nwant:\n%s", failure.Diff, wantDiff)
+	}
+}
+
+func TestParseTestOutputForgedEvents(t *testing.T) {
+	f := &testFile{fullName: "/tests/FooTest.php"}
+	marker := newEventMarker()
+	if marker == newEventMarker() {
+		t.Errorf("the event marker is the same for two runs: %q", marker)
+	}
+	// The test prints the events with a marker of another run.
+	forged := "\n##ktest## [\"FAIL\",\"\",5]\n\n" + strings.Replace(marker, "##ktest-", "##ktest-0", 1) + `["ASSERT_OK"]` + "\n"
+	output := "\n" + marker + `["CLASS","FooTest"]` + "\n" +
+		"\n" + marker + `["START","testForge"]` + "\n" +
+		forged +
+		"\n" + marker + `["ASSERT_OK"]` + "\n" +
+		"\n" + marker + `["END","testForge",1000]` + "\n" +
+		"\n" + marker + `["FINISHED"]` + "\n"
+	res, err := parseTestOutput(f, marker, []byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &testFileResult{
+		finished: true,
+		asserts:  1,
+		tests: []TestResult{
+			{Class: "FooTest", Name: "testForge", File: "/tests/FooTest.php", Assertions: 1, Time: 1000, Output: forged},
+		},
+	}
+	if diff := cmp.Diff(want, res, cmp.AllowUnexported(testFileResult{})); diff != "" {
+		t.Errorf("result mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestParseTestOutputSkippedAndRisky(t *testing.T) {
+	f := &testFile{
+		fullName: "/tests/FooTest.php",
+		classes: []*testClass{
+			{Name: "FooTest", TestMethods: []*testMethod{{Name: "testNothing", Line: 20}}},
+		},
+	}
+	output := `
+##ktest## ["CLASS","FooTest"]
+
+##ktest## ["START","testSkipped"]
+
+##ktest## ["SKIPPED","no database",12]
+
+##ktest## ["END","testSkipped",1000]
+
+##ktest## ["START","testIncomplete"]
+
+##ktest## ["ASSERT_OK"]
+
+##ktest## ["INCOMPLETE","",16]
+
+##ktest## ["END","testIncomplete",1000]
+
+##ktest## ["START","testNothing"]
+
+##ktest## ["END","testNothing",1000]
+
+##ktest## ["FINISHED"]
+`
+	res, err := parseTestOutput(f, testEventMarker, []byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skipped := TestFailure{Name: "FooTest::testSkipped", Message: "no database", File: "/tests/FooTest.php", Line: 12}
+	incomplete := TestFailure{Name: "FooTest::testIncomplete", File: "/tests/FooTest.php", Line: 16}
+	risky := TestFailure{Name: "FooTest::testNothing", Message: "This test did not perform any assertions", File: "/tests/FooTest.php", Line: 20}
+	want := &testFileResult{
+		finished:   true,
+		asserts:    1,
+		skipped:    []TestFailure{skipped},
+		incomplete: []TestFailure{incomplete},
+		risky:      []TestFailure{risky},
+		tests: []TestResult{
+			{Class: "FooTest", Name: "testSkipped", File: "/tests/FooTest.php", Time: 1000, Skipped: &skipped},
+			{Class: "FooTest", Name: "testIncomplete", File: "/tests/FooTest.php", Assertions: 1, Time: 1000, Incomplete: &incomplete},
+			{Class: "FooTest", Name: "testNothing", File: "/tests/FooTest.php", Time: 1000, Risky: &risky},
+		},
+	}
+	if diff := cmp.Diff(res, want, cmp.AllowUnexported(testFileResult{})); diff != "" {
+		t.Errorf("result mismatches (-have +want):\n%s", diff)
+	}
+}
+
+func TestParseTestOutputInheritedMethod(t *testing.T) {
+	f := &testFile{
+		fullName: "/tests/FooTest.php",
+		classes: []*testClass{
+			{Name: "FooTest", TestMethods: []*testMethod{
+				{Name: "testOwn", Line: 8},
+				{Name: "testInherited", Line: 30, File: "/tests/Base/AbstractCase.php"},
+			}},
+		},
+	}
+	output := `
+##ktest## ["CLASS","FooTest"]
+
+##ktest## ["START","testOwn"]
+
+##ktest## ["FAIL","",9]
+
+##ktest## ["END","testOwn",1000]
+
+##ktest## ["START","testInherited"]
+
+##ktest## ["FAIL","",31]
+
+##ktest## ["END","testInherited",1000]
+
+##ktest## ["FINISHED"]
+`
+	res, err := parseTestOutput(f, testEventMarker, []byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var have []string
+	for _, failure := range res.failures {
+		have = append(have, fmt.Sprintf("%s:%d", failure.File, failure.Line))
+	}
+	want := []string{"/tests/FooTest.php:9", "/tests/Base/AbstractCase.php:31"}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("failure locations mismatch (-want +have):\n%s", diff)
+	}
+}
+
+func TestParseTestOutputAssertionFailures(t *testing.T) {
+	tests := []struct {
+		event string
+		want  TestFailure
+	}{
+		{`["FAIL","not implemented",7]`, TestFailure{Message: "not implemented", Line: 7}},
+		{`["ASSERT_BOOL_FAILED","true",11,"",8]`, TestFailure{Reason: "Failed asserting that 11 is true", Line: 8}},
+		{`["ASSERT_NOT_EQUALS_FAILED",1,1,"",9]`, TestFailure{Reason: "Failed asserting that 1 is not equal to 1", Line: 9}},
+		{`["ASSERT_NOT_SAME_FAILED","a","a","",10]`, TestFailure{Reason: `Failed asserting that "a" is not identical to "a"`, Line: 10}},
+		{`["ASSERT_COUNT_FAILED",3,2,"wrong count",33]`, TestFailure{Reason: "Failed asserting that actual size 2 matches expected size 3", Message: "wrong count", Line: 33}},
+		{`["ASSERT_NOT_COUNT_FAILED",2,2,"",8]`, TestFailure{Reason: "Failed asserting that actual size 2 does not match expected size 2", Line: 8}},
+		{`["ASSERT_NULL_FAILED","",11]`, TestFailure{Reason: "Failed asserting that value is null", Line: 11}},
+		{`["ASSERT_NOT_NULL_FAILED","must be set",12]`, TestFailure{Reason: "Failed asserting that null is not null", Message: "must be set", Line: 12}},
+		{`["ASSERT_EMPTY_FAILED",[1],"",9]`, TestFailure{Reason: "Failed asserting that [1] is empty", Line: 9}},
+		{`["ASSERT_NOT_EMPTY_FAILED","","",10]`, TestFailure{Reason: `Failed asserting that "" is not empty`, Line: 10}},
+		{`["ASSERT_CONTAINS_FAILED",4,"",13]`, TestFailure{Reason: "Failed asserting that an array contains 4", Line: 13}},
+		{`["ASSERT_NOT_CONTAINS_FAILED","2","",14]`, TestFailure{Reason: `Failed asserting that an array does not contain "2"`, Line: 14}},
+		{`["ASSERT_ARRAY_HAS_KEY_FAILED","b","",37]`, TestFailure{Reason: `Failed asserting that an array has the key "b"`, Line: 37}},
+		{`["ASSERT_ARRAY_NOT_HAS_KEY_FAILED",0,"",16]`, TestFailure{Reason: "Failed asserting that an array does not have the key 0", Line: 16}},
+		{`["ASSERT_STRING_CONTAINS_FAILED","world","hello","",41]`, TestFailure{Reason: `Failed asserting that 'hello' contains "world"`, Line: 41}},
+		{`["ASSERT_STRING_NOT_CONTAINS_FAILED","ell","hello","",18]`, TestFailure{Reason: `Failed asserting that 'hello' does not contain "ell"`, Line: 18}},
+		{`["ASSERT_STRING_STARTS_WITH_FAILED","x","hello","",19]`, TestFailure{Reason: `Failed asserting that 'hello' starts with "x"`, Line: 19}},
+		{`["ASSERT_STRING_ENDS_WITH_FAILED","x","hello","",20]`, TestFailure{Reason: `Failed asserting that 'hello' ends with "x"`, Line: 20}},
+		{
+			`["ASSERT_EQUALS_WITH_DELTA_FAILED",1,1.5,0.1,"",21]`,
+			TestFailure{Reason: "Failed asserting that 1.5 matches expected 1 (delta 0.1)", Line: 21, Expected: "1", Actual: "1.5"},
+		},
+		{`["ASSERT_COMPARISON_FAILED",1,0,"greater than","",22]`, TestFailure{Reason: "Failed asserting that 0 is greater than 1", Line: 22}},
+		{`["ASSERT_COMPARISON_FAILED",3,2,"greater than or equal","",45]`, TestFailure{Reason: "Failed asserting that 2 is equal to 3 or is greater than 3", Line: 45}},
+		{`["ASSERT_COMPARISON_FAILED",1,2,"less than","",24]`, TestFailure{Reason: "Failed asserting that 2 is less than 1", Line: 24}},
+		{`["ASSERT_COMPARISON_FAILED",1,2,"less than or equal","",25]`, TestFailure{Reason: "Failed asserting that 2 is equal to 1 or is less than 1", Line: 25}},
+		{`["ASSERT_TYPE_FAILED","int","1","",27]`, TestFailure{Reason: `Failed asserting that "1" is of type "int"`, Line: 27}},
+		{
+			`["ASSERT_INSTANCE_OF_FAILED","RuntimeException","",53]`,
+			TestFailure{Reason: `Failed asserting that value is an instance of class "RuntimeException"`, Line: 53},
+		},
+	}
+
+	f := &testFile{fullName: "/tests/FooTest.php"}
+	for _, test := range tests {
+		output := "\n" + testEventMarker + `["CLASS","FooTest"]` + "\n" +
+			"\n" + testEventMarker + `["START","testFoo"]` + "\n" +
+			"\n" + testEventMarker + test.event + "\n" +
+			"\n" + testEventMarker + `["END","testFoo",1000]` + "\n"
+		res, err := parseTestOutput(f, testEventMarker, []byte(output))
+		if err != nil {
+			t.Errorf("%s: %v", test.event, err)
+			continue
+		}
+		want := test.want
+		want.Name = "FooTest::testFoo"
+		want.File = "/tests/FooTest.php"
+		if diff := cmp.Diff([]TestFailure{want}, res.failures); diff != "" {
+			t.Errorf("%s: failures mismatch (-want +have):\n%s", test.event, diff)
+		}
+		if res.asserts != 1 {
+			t.Errorf("%s: asserts = %d, want 1", test.event, res.asserts)
+		}
+	}
+}
+
+func TestParseTestOutputExceptions(t *testing.T) {
+	tests := []struct {
+		event   string
+		failure *TestFailure
+		testErr *TestFailure
+		asserts int
+	}{
+		{
+			event:   `["ERROR","RuntimeException","unexpected","/src/Foo.php",12]`,
+			testErr: &TestFailure{Message: "RuntimeException: unexpected", File: "/src/Foo.php", Line: 12},
+			asserts: 0,
+		},
+		{
+			event:   `["EXCEPTION_NOT_THROWN","RuntimeException",7]`,
+			failure: &TestFailure{Reason: `Failed asserting that exception of type "RuntimeException" is thrown`, Line: 7},
+			asserts: 1,
+		},
+		{
+			event: `["EXCEPTION_MISMATCH","LogicException","RuntimeException","boom",8]`,
+			failure: &TestFailure{
+				Reason: `Failed asserting that exception of type "RuntimeException" matches expected exception "LogicException". Message was: "boom"`,
+				Line:   8,
+			},
+			asserts: 1,
+		},
+		{
+			event: `["EXCEPTION_MESSAGE_FAILED","expected","actual message",9]`,
+			failure: &TestFailure{
+				Reason:   "Failed asserting that exception message 'actual message' contains 'expected'",
+				Line:     9,
+				Expected: "expected",
+				Actual:   "actual message",
+			},
+			asserts: 1,
+		},
+		{
+			event:   `["EXCEPTION_CODE_FAILED",42,7,10]`,
+			failure: &TestFailure{Reason: "Failed asserting that 7 is equal to expected exception code 42", Line: 10},
+			asserts: 1,
+		},
+	}
+
+	f := &testFile{fullName: "/tests/FooTest.php"}
+	for _, test := range tests {
+		output := "\n" + testEventMarker + `["CLASS","FooTest"]` + "\n" +
+			"\n" + testEventMarker + `["START","testFoo"]` + "\n" +
+			"\n" + testEventMarker + test.event + "\n" +
+			"\n" + testEventMarker + `["END","testFoo",1000]` + "\n"
+		res, err := parseTestOutput(f, testEventMarker, []byte(output))
+		if err != nil {
+			t.Errorf("%s: %v", test.event, err)
+			continue
+		}
+
+		var wantFailures, wantErrors []TestFailure
+		if test.failure != nil {
+			want := *test.failure
+			want.Name = "FooTest::testFoo"
+			want.File = "/tests/FooTest.php"
+			wantFailures = append(wantFailures, want)
+		}
+		if test.testErr != nil {
+			want := *test.testErr
+			want.Name = "FooTest::testFoo"
+			wantErrors = append(wantErrors, want)
+		}
+		if diff := cmp.Diff(wantFailures, res.failures); diff != "" {
+			t.Errorf("%s: failures mismatch (-want +have):\n%s", test.event, diff)
+		}
+		if diff := cmp.Diff(wantErrors, res.errors); diff != "" {
+			t.Errorf("%s: errors mismatch (-want +have):\n%s", test.event, diff)
+		}
+		if res.asserts != test.asserts {
+			t.Errorf("%s: asserts = %d, want %d", test.event, res.asserts, test.asserts)
+		}
+		if len(res.tests) != 1 || (res.tests[0].Error != nil) != (test.testErr != nil) {
+			t.Errorf("%s: the test error is not attached to the test result: %+v", test.event, res.tests)
+		}
+	}
+}
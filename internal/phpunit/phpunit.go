@@ -3,6 +3,9 @@ package phpunit
 import (
 	"io"
 	"time"
+
+	"github.com/VKCOM/ktest/event"
+	"github.com/VKCOM/ktest/internal/buildcache"
 )
 
 type RunConfig struct {
@@ -12,8 +15,65 @@ type RunConfig struct {
 	TestArgv     []string
 	SrcDir       string
 
+	// PHPVersion is the "major.minor" PHP version used to parse the test files.
+	// If empty, phpsyntax.DefaultVersion is used.
+	PHPVersion string
+
+	// Filter is a regexp that selects the tests to run by their Class::method names.
+	Filter string
+
+	// TestSuite selects the phpunit.xml test suites by their comma separated names.
+	// If empty, all test suites are used.
+	TestSuite string
+
+	// Groups selects the tests with at least one of the @group names, if not empty.
+	// ExcludeGroups skips the tests with any of the @group names.
+	Groups        []string
+	ExcludeGroups []string
+
 	KphpCommand string
 
+	// VsPHP enables running the tests with PHP as well;
+	// the results are compared with the KPHP ones.
+	VsPHP      bool
+	PhpCommand string
+
+	// BuildCache is used to avoid the recompilation of unchanged tests, if not nil.
+	BuildCache *buildcache.Cache
+
+	// Jobs is a number of test files that are built and run in parallel.
+	Jobs int
+
+	// TeamcityOutput enables test progress reporting in TeamCity format.
+	TeamcityOutput bool
+
+	// RandomOrder makes the runner shuffle the test files, classes and methods.
+	// The same Seed gives the same order, so a failure can be reproduced.
+	RandomOrder bool
+	Seed        int64
+
+	// LastFailed are the tests that failed during the previous run (see FailedTests).
+	// Rerun defines how they're used.
+	LastFailed []string
+	Rerun      RerunMode
+
+	// ProcessIsolation makes the runner execute every test method in a separate process,
+	// so a crash or a timeout only affects that test.
+	ProcessIsolation bool
+
+	// TestTimeout and FileTimeout limit the test method and the whole test file run time.
+	// The process is killed and the running test is reported as an error.
+	// Zero means no limit.
+	TestTimeout time.Duration
+	FileTimeout time.Duration
+
+	// SingleBinary makes the runner compile all test files into one executable.
+	// If that build fails, every test file is compiled separately.
+	SingleBinary bool
+
+	// Events receives the machine-readable test progress, if not nil.
+	Events *event.Encoder
+
 	Output     io.Writer
 	DebugPrint func(string)
 
@@ -21,10 +81,119 @@ type RunConfig struct {
 }
 
 type RunResult struct {
+	// Tests is the number of executed tests.
 	Tests      int
 	Assertions int
 	Failures   []TestFailure
 	Time       time.Duration
+
+	// Errors describe the tests that were interrupted by uncaught exceptions.
+	// Error locations point to the place where the exception was created.
+	Errors []TestFailure
+
+	// Skipped and Incomplete describe the tests that called
+	// markTestSkipped and markTestIncomplete.
+	Skipped    []TestFailure
+	Incomplete []TestFailure
+	// Risky describe the passed tests that didn't perform any assertions.
+	Risky []TestFailure
+
+	// Results contain every executed test, in the order of execution.
+	Results []TestResult
+
+	// Files contain the build and run times of every executed test file.
+	Files []FileResult
+
+	// FileErrors describe test files that were not run completely.
+	FileErrors []FileError
+	// NotRun is the number of tests in the test files that have failed to build or run.
+	NotRun int
+
+	// Mismatches describe tests with different PHP and KPHP results.
+	// Only collected when RunConfig.VsPHP is set.
+	Mismatches []TestMismatch
+}
+
+// TestMismatch describes a test that behaves differently under PHP and KPHP.
+type TestMismatch struct {
+	Name string
+	File string
+
+	// PHP and KPHP are the human-readable test verdicts.
+	PHP  string
+	KPHP string
+}
+
+// FileResult describes a single test file build and run.
+type FileResult struct {
+	File string
+
+	// BuildTime is zero if the file executable was taken from the build cache
+	// or if all test files were compiled into one executable.
+	BuildTime time.Duration
+	RunTime   time.Duration
+}
+
+// TestResult describes a single test method run.
+type TestResult struct {
+	Class      string
+	Name       string
+	File       string
+	Assertions int
+	Time       time.Duration
+
+	// Failure is nil for the passed tests.
+	Failure *TestFailure
+
+	// Error is not nil if the test has thrown an unexpected exception.
+	Error *TestFailure
+
+	// Skipped and Incomplete are set for the tests marked with markTestSkipped
+	// and markTestIncomplete, Risky is set for the passed tests without assertions.
+	Skipped    *TestFailure
+	Incomplete *TestFailure
+	Risky      *TestFailure
+
+	// Output is everything the test has printed to stdout.
+	Output string
+}
+
+type FileErrorKind int
+
+const (
+	BuildError FileErrorKind = iota
+	RunError
+	OutputError
+	PHPRunError
+	ParseError
+	MockError
+)
+
+func (kind FileErrorKind) String() string {
+	switch kind {
+	case BuildError:
+		return "build error"
+	case RunError:
+		return "run error"
+	case OutputError:
+		return "parse test output error"
+	case PHPRunError:
+		return "PHP run error"
+	case ParseError:
+		return "PHP parse error"
+	case MockError:
+		return "mock generation error"
+	default:
+		return "unknown error"
+	}
+}
+
+// FileError is an error that prevented the test file results from being collected.
+type FileError struct {
+	File  string
+	Class string
+	Kind  FileErrorKind
+	Err   error
 }
 
 type TestFailure struct {
@@ -33,6 +202,17 @@ type TestFailure struct {
 	Message string
 	File    string
 	Line    int
+
+	// Expected and Actual are set for the failed equality assertions.
+	Expected string
+	Actual   string
+
+	// Diff is a unified diff of Expected and Actual.
+	// It's only set when two arrays or two strings are compared.
+	Diff string
+
+	// Output is everything the failed test has printed to stdout.
+	Output string
 }
 
 func Run(conf *RunConfig) (*RunResult, error) {
@@ -49,8 +229,17 @@ func Run(conf *RunConfig) (*RunResult, error) {
 type FormatConfig struct {
 	PrintTime     bool
 	ShortLocation bool
+
+	// ReportSlowest is a number of the slowest tests and test files
+	// that are listed after the results summary.
+	ReportSlowest int
 }
 
 func FormatResult(w io.Writer, conf *FormatConfig, result *RunResult) {
 	formatResult(w, conf, result)
 }
+
+// WriteJUnitReport writes the result as a JUnit XML report.
+func WriteJUnitReport(w io.Writer, result *RunResult) error {
+	return writeJUnitReport(w, result)
+}
@@ -2,18 +2,29 @@ package phpunit
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/VKCOM/ktest/event"
 	"github.com/VKCOM/ktest/internal/fileutil"
 	"github.com/VKCOM/ktest/internal/kphpscript"
+	"github.com/VKCOM/ktest/internal/phpscript"
+	"github.com/VKCOM/ktest/internal/phpsyntax"
+	"github.com/VKCOM/ktest/internal/teamcity"
 	"github.com/VKCOM/ktest/internal/testdir"
+	"github.com/z7zmey/php-parser/pkg/ast"
 	"github.com/z7zmey/php-parser/pkg/conf"
 	"github.com/z7zmey/php-parser/pkg/errors"
 	"github.com/z7zmey/php-parser/pkg/parser"
@@ -26,13 +37,45 @@ type runner struct {
 
 	result RunResult
 
+	logger *teamcity.Logger
+
 	testDir      string
 	testFiles    []*testFile
 	testdataDirs []string
 
-	buildDir      string
-	buildDirTests string
-	buildDirMains string
+	buildDir       string
+	buildDirTests  string
+	buildDirMains  string
+	buildDirSuites string
+
+	runtimeFilename string
+
+	phpVersion *version.Version
+
+	// phpunitConfig is the project phpunit.xml, it's nil if there is none.
+	phpunitConfig *phpunitConfig
+	// env is passed to the test executables.
+	env []string
+
+	// supportFiles are the PHP files from the test dir that don't contain tests.
+	// They are parsed only if some test class extends a class that is not found
+	// among the test files; the files with the parent classes go to baseFiles.
+	supportFiles []*testFile
+	baseFiles    []*testFile
+
+	combinedMainFilename string
+	combinedMain         []byte
+
+	// mocks are the generated test doubles by the lowercase mocked class names.
+	mocks map[string]generatedMock
+
+	// eventMarker is passed to the test mains, see newEventMarker.
+	eventMarker string
+}
+
+type generatedMock struct {
+	filename string
+	err      error
 }
 
 type testFile struct {
@@ -41,27 +84,119 @@ type testFile struct {
 	fullName  string
 	shortName string
 
-	mainFilename string
+	mainFilename  string
+	suiteFilename string
 
 	info *testParsedInfo
 
+	// classes are the test classes to run, with the inherited test methods.
+	classes []*testClass
+	// requires are the files that declare the classes parent test cases.
+	requires []*testFile
+	// mocks are the test doubles used by the file (and its requires).
+	mocks []string
+
 	contents             []byte
 	preprocessedContents []byte
+	generatedSuite       []byte
 	generatedMain        []byte
 }
 
 type testParsedInfo struct {
-	ClassName   string
-	TestMethods []string
+	// Classes are all classes declared in the file, including the abstract ones.
+	Classes []*testClass
+
+	// Mocks are the fully qualified names of the classes
+	// passed to createMock and createStub.
+	Mocks []string
+
+	fixes []textEdit
+}
+
+type testClass struct {
+	// Name is a fully qualified class name without the leading slash.
+	Name string
+	// Parent is a fully qualified parent class name (empty if there is no parent).
+	Parent   string
+	Abstract bool
+
+	TestMethods []*testMethod
+
+	// StaticMethods is a set of the test class static methods.
+	StaticMethods map[string]bool
 
 	HasSetUpBeforeClass   bool
 	HasTearDownAfterClass bool
+	HasSetUp              bool
+	HasTearDown           bool
 
-	fixes []textEdit
+	// BeforeMethods and AfterMethods are annotated with @before and @after.
+	BeforeMethods []string
+	AfterMethods  []string
+
+	// Groups are the class @group names, they apply to all its test methods.
+	Groups []string
+}
+
+// isTestCaseBase reports whether the class is a PHPUnit test case base class,
+// like PHPUnit\Framework\TestCase. The test classes are the non-abstract
+// classes that extend it, directly or through the project base classes.
+func isTestCaseBase(className string) bool {
+	name := className[strings.LastIndexByte(className, '\\')+1:]
+	return strings.EqualFold(name, "TestCase") || strings.EqualFold(name, "PHPUnit_Framework_TestCase")
+}
+
+type testMethod struct {
+	Name   string
+	Line   int
+	Params []testParam
+
+	// DataProviders are the @dataProvider method names.
+	DataProviders []string
+	// DataProviderCalls are PHP expressions that call DataProviders.
+	DataProviderCalls []string
+
+	// ExpectedExceptions are the fully qualified class names
+	// passed to expectException as Foo::class.
+	ExpectedExceptions []string
+
+	// Groups are the method @group names.
+	Groups []string
+
+	// File is the full name of the file that declares the inherited method.
+	// It's empty for the methods declared in the test file itself.
+	File string
+}
+
+// CallArgs returns the test method call arguments.
+// Only data provider tests have arguments, they are taken from $data_set.
+func (m *testMethod) CallArgs() string {
+	if len(m.DataProviders) == 0 {
+		return ""
+	}
+	args := make([]string, len(m.Params))
+	for i, p := range m.Params {
+		args[i] = fmt.Sprintf("%s$data_set[%d]", p.Cast, i)
+	}
+	return strings.Join(args, ", ")
+}
+
+type testParam struct {
+	// Cast is a PHP type cast that is applied to the data set value
+	// before it's passed to the test method, like "(int)".
+	Cast string
 }
 
 func newRunner(conf *RunConfig) *runner {
-	return &runner{conf: conf}
+	var output io.Writer
+
+	if conf.TeamcityOutput {
+		output = conf.Output
+	} else {
+		output = ioutil.Discard
+	}
+
+	return &runner{conf: conf, logger: teamcity.NewLogger(output), eventMarker: newEventMarker()}
 }
 
 func (r *runner) Run() (*RunResult, error) {
@@ -78,11 +213,18 @@ func (r *runner) Run() (*RunResult, error) {
 		name string
 		fn   func() error
 	}{
+		{"load phpunit config", r.stepLoadPhpunitConfig},
 		{"find test files", r.stepFindTestFiles},
 		{"prepare temp build dir", r.stepPrepareTempBuildDir},
 		{"parse test files", r.stepParseTestFiles},
 		{"filter only parsed files", r.stepFilterOnlyParsedFiles},
 		{"sort test files", r.stepSortTestFiles},
+		{"resolve test classes", r.stepResolveTestClasses},
+		{"select test groups", r.stepSelectGroups},
+		{"filter tests", r.stepFilterTests},
+		{"generate mocks", r.stepGenerateMocks},
+		{"shuffle tests", r.stepShuffleTests},
+		{"select last failed tests", r.stepSelectLastFailed},
 		{"preprocess contents", r.stepPreprocessContents},
 		{"generate test main", r.stepGenerateTestMain},
 		{"write preprocessed test files", r.stepWritePreprocessedTestFiles},
@@ -105,13 +247,36 @@ func (r *runner) debugf(format string, args ...interface{}) {
 	}
 }
 
+func (r *runner) stepLoadPhpunitConfig() error {
+	config, err := loadPhpunitConfig(r.conf.ProjectRoot)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		if r.conf.TestSuite != "" {
+			return fmt.Errorf("can't select the test suite %q: no phpunit.xml found in %s", r.conf.TestSuite, r.conf.ProjectRoot)
+		}
+		return nil
+	}
+	r.debugf("phpunit config: %q", config.Filename)
+	r.phpunitConfig = config
+	r.env = config.environ()
+	return nil
+}
+
 func (r *runner) stepFindTestFiles() error {
 	var testDir string
 	var testFiles []string
 	var testdataDirs []string
+	var supportFiles []string
 	if strings.HasSuffix(r.conf.TestTarget, ".php") {
 		testFiles = []string{r.conf.TestTarget}
 		testDir = filepath.Dir(r.conf.TestTarget)
+		result, err := findTestFiles(testDir)
+		if err != nil {
+			return err
+		}
+		supportFiles = result.support
 	} else {
 		result, err := findTestFiles(r.conf.TestTarget)
 		if err != nil {
@@ -119,6 +284,13 @@ func (r *runner) stepFindTestFiles() error {
 		}
 		testDir = r.conf.TestTarget
 		testFiles = result.scripts
+		supportFiles = result.support
+		if r.phpunitConfig != nil && len(r.phpunitConfig.TestSuites) != 0 {
+			testFiles, err = r.findTestSuiteFiles(testDir)
+			if err != nil {
+				return err
+			}
+		}
 		testdataDirs = result.testdata
 		for i := range testdataDirs {
 			testdataDirs[i] = strings.TrimPrefix(testdataDirs[i], r.conf.ProjectRoot)
@@ -138,6 +310,21 @@ func (r *runner) stepFindTestFiles() error {
 			shortName: strings.TrimPrefix(f, testDir),
 		}
 	}
+	// The phpunit.xml suffix can select the files that are support files otherwise.
+	isTestFile := make(map[string]bool, len(testFiles))
+	for _, f := range testFiles {
+		isTestFile[f] = true
+	}
+	r.supportFiles = r.supportFiles[:0]
+	for _, f := range supportFiles {
+		if isTestFile[f] {
+			continue
+		}
+		r.supportFiles = append(r.supportFiles, &testFile{
+			fullName:  f,
+			shortName: strings.TrimPrefix(f, testDir),
+		})
+	}
 
 	if r.conf.DebugPrint != nil {
 		r.debugf("test dir: %q", r.testDir)
@@ -149,6 +336,27 @@ func (r *runner) stepFindTestFiles() error {
 	return nil
 }
 
+// findTestSuiteFiles returns the phpunit.xml test suite files from the test dir.
+// The suite files outside of the test dir are ignored, since the test target
+// given on the command line narrows the test suites down.
+func (r *runner) findTestSuiteFiles(testDir string) ([]string, error) {
+	suites, err := r.phpunitConfig.selectTestSuites(r.conf.TestSuite)
+	if err != nil {
+		return nil, err
+	}
+	files, err := r.phpunitConfig.testSuiteFiles(suites)
+	if err != nil {
+		return nil, err
+	}
+	testFiles := files[:0]
+	for _, f := range files {
+		if strings.HasPrefix(f, strings.TrimSuffix(testDir, "/")+"/") {
+			testFiles = append(testFiles, f)
+		}
+	}
+	return testFiles, nil
+}
+
 func (r *runner) stepPrepareTempBuildDir() error {
 	testsDirRel := strings.TrimPrefix(r.testDir, r.conf.ProjectRoot)
 	linkFiles := []string{r.conf.SrcDir}
@@ -158,6 +366,7 @@ func (r *runner) stepPrepareTempBuildDir() error {
 		LinkFiles:   linkFiles,
 		MakeDirs: []string{
 			"mains",
+			"suites",
 			testsDirRel,
 		},
 	}
@@ -167,40 +376,90 @@ func (r *runner) stepPrepareTempBuildDir() error {
 	}
 	r.buildDir = tempDir
 	r.buildDirMains = filepath.Join(tempDir, "mains")
+	r.buildDirSuites = filepath.Join(tempDir, "suites")
+	r.runtimeFilename = filepath.Join(tempDir, "suites", "runtime.php")
 	r.buildDirTests = filepath.Join(tempDir, testsDirRel)
 	r.debugf("temp build dir: %q", tempDir)
 	return nil
 }
 
 func (r *runner) stepParseTestFiles() error {
+	phpVersion, err := phpsyntax.ParseVersion(r.conf.PHPVersion)
+	if err != nil {
+		return err
+	}
+	r.phpVersion = phpVersion
+
 	for _, f := range r.testFiles {
-		src, err := ioutil.ReadFile(f.fullName)
-		if err != nil {
-			return fmt.Errorf("read file: %w", err)
-		}
-		f.contents = src
-		var parserErrors []*errors.Error
-		errorHandler := func(e *errors.Error) {
-			parserErrors = append(parserErrors, e)
-		}
-		rootNode, err := parser.Parse(src, conf.Config{
-			Version:          &version.Version{Major: 7, Minor: 4},
-			ErrorHandlerFunc: errorHandler,
-		})
-		if len(parserErrors) != 0 {
-			for _, parseErr := range parserErrors {
-				log.Printf("%s: parse error: %v", f.fullName, parseErr)
+		if err := r.parseFile(f); err != nil {
+			if parseErr, ok := err.(*fileParseError); ok {
+				// The file is skipped, but it's still reported as an error.
+				r.result.FileErrors = append(r.result.FileErrors, FileError{
+					File: f.fullName,
+					Kind: ParseError,
+					Err:  parseErr,
+				})
+				r.emit(event.Event{
+					Action:  event.Error,
+					File:    f.fullName,
+					Reason:  ParseError.String(),
+					Message: parseErr.Error(),
+				})
+				continue
 			}
-			continue
+			return err
 		}
-		f.info = &testParsedInfo{}
-		visitor := &astVisitor{out: f.info}
-		traverser.NewTraverser(visitor).Traverse(rootNode)
 	}
 
 	return nil
 }
 
+type fileParseError struct {
+	messages []string
+}
+
+func (e *fileParseError) Error() string {
+	return strings.Join(e.messages, "; ")
+}
+
+// parseFile collects the file classes info into f.info.
+func (r *runner) parseFile(f *testFile) error {
+	src, err := ioutil.ReadFile(f.fullName)
+	if err != nil {
+		return fmt.Errorf("read file: %w", err)
+	}
+	f.contents = src
+	masked, attrs := phpsyntax.MaskAttributes(src)
+	rootNode, err := parsePHPSource(masked, r.phpVersion)
+	if err != nil {
+		return err
+	}
+	f.info = &testParsedInfo{}
+	visitor := &astVisitor{out: f.info, attributes: attrs}
+	traverser.NewTraverser(visitor).Traverse(rootNode)
+	return nil
+}
+
+// parsePHPSource returns a *fileParseError if the source has syntax errors.
+func parsePHPSource(src []byte, phpVersion *version.Version) (ast.Vertex, error) {
+	var parserErrors []*errors.Error
+	errorHandler := func(e *errors.Error) {
+		parserErrors = append(parserErrors, e)
+	}
+	rootNode, err := parser.Parse(src, conf.Config{
+		Version:          phpVersion,
+		ErrorHandlerFunc: errorHandler,
+	})
+	if len(parserErrors) != 0 {
+		messages := make([]string, len(parserErrors))
+		for i, parseErr := range parserErrors {
+			messages[i] = parseErr.String()
+		}
+		return nil, &fileParseError{messages: messages}
+	}
+	return rootNode, err
+}
+
 func (r *runner) stepFilterOnlyParsedFiles() error {
 	parsedFiles := make([]*testFile, 0, len(r.testFiles))
 	for _, f := range r.testFiles {
@@ -225,23 +484,427 @@ func (r *runner) stepSortTestFiles() error {
 	return nil
 }
 
+// stepGenerateMocks writes the test doubles for the createMock and createStub calls.
+// The test files with the classes that can't be mocked are reported as errors.
+func (r *runner) stepGenerateMocks() error {
+	var generator *mockGenerator
+	r.mocks = make(map[string]generatedMock)
+	generate := func(className string) generatedMock {
+		key := strings.ToLower(className)
+		if mock, ok := r.mocks[key]; ok {
+			return mock
+		}
+		var mock generatedMock
+		src, err := generator.Generate(className)
+		if err == nil {
+			mockName := mockClassName(className)
+			mock.filename = filepath.Join(r.buildDir, "mocks", strings.ReplaceAll(mockName, `\`, "/")+".php")
+			err = fileutil.WriteFile(mock.filename, src)
+		}
+		mock.err = err
+		r.mocks[key] = mock
+		return mock
+	}
+
+	selectedFiles := r.testFiles[:0]
+	for _, f := range r.testFiles {
+		var mockErr error
+		for _, info := range f.parsedInfos() {
+			for _, className := range info.Mocks {
+				if generator == nil {
+					var err error
+					generator, err = newMockGenerator(r.conf.ComposerRoot, r.phpVersion)
+					if err != nil {
+						return err
+					}
+				}
+				mock := generate(className)
+				if mock.err != nil {
+					mockErr = mock.err
+					break
+				}
+				f.mocks = appendNewNames(f.mocks, mock.filename)
+			}
+		}
+		if mockErr == nil {
+			selectedFiles = append(selectedFiles, f)
+			continue
+		}
+		r.result.FileErrors = append(r.result.FileErrors, FileError{
+			File:  f.fullName,
+			Class: f.className(),
+			Kind:  MockError,
+			Err:   mockErr,
+		})
+		r.emit(event.Event{
+			Action:  event.Error,
+			File:    f.fullName,
+			Class:   f.className(),
+			Reason:  MockError.String(),
+			Message: mockErr.Error(),
+		})
+	}
+	r.testFiles = selectedFiles
+
+	return nil
+}
+
+// stepShuffleTests randomizes the test files, classes and methods order
+// to reveal the tests that depend on each other through the global state.
+func (r *runner) stepShuffleTests() error {
+	if !r.conf.RandomOrder {
+		return nil
+	}
+
+	// With -json the Output is discarded, so the seed is reported as an event too.
+	fmt.Fprintf(r.conf.Output, "Random seed: %d\n\n", r.conf.Seed)
+	r.emit(event.Event{Action: event.Seed, Seed: r.conf.Seed})
+	rnd := rand.New(rand.NewSource(r.conf.Seed))
+	rnd.Shuffle(len(r.testFiles), func(i, j int) {
+		r.testFiles[i], r.testFiles[j] = r.testFiles[j], r.testFiles[i]
+	})
+	for i, f := range r.testFiles {
+		f.id = i
+		rnd.Shuffle(len(f.classes), func(i, j int) {
+			f.classes[i], f.classes[j] = f.classes[j], f.classes[i]
+		})
+		for _, c := range f.classes {
+			rnd.Shuffle(len(c.TestMethods), func(i, j int) {
+				c.TestMethods[i], c.TestMethods[j] = c.TestMethods[j], c.TestMethods[i]
+			})
+		}
+	}
+
+	return nil
+}
+
+// stepSelectLastFailed applies the RunConfig.Rerun mode.
+func (r *runner) stepSelectLastFailed() error {
+	switch r.conf.Rerun {
+	case RerunLastFailed:
+		if len(r.conf.LastFailed) == 0 {
+			fmt.Fprintf(r.conf.Output, "No failed tests recorded, running all tests\n\n")
+			return nil
+		}
+		failed := newFailedTestsSet(r.conf.LastFailed, r.testFiles)
+		found := false
+		for _, f := range r.testFiles {
+			for _, c := range f.classes {
+				found = found || failed.hasClass(c)
+			}
+		}
+		if !found {
+			fmt.Fprintf(r.conf.Output, "No recorded failed tests found, running all tests\n\n")
+			return nil
+		}
+		r.selectTests(failed.hasMethod)
+
+	case RerunFailedFirst:
+		failed := newFailedTestsSet(r.conf.LastFailed, r.testFiles)
+		hasFailedClass := func(f *testFile) bool {
+			for _, c := range f.classes {
+				if failed.hasClass(c) {
+					return true
+				}
+			}
+			return false
+		}
+		// The files order is changed, so their ids are re-assigned
+		// to keep the execution order consistent with them.
+		sort.SliceStable(r.testFiles, func(i, j int) bool {
+			return hasFailedClass(r.testFiles[i]) && !hasFailedClass(r.testFiles[j])
+		})
+		for i, f := range r.testFiles {
+			f.id = i
+			sort.SliceStable(f.classes, func(i, j int) bool {
+				return failed.hasClass(f.classes[i]) && !failed.hasClass(f.classes[j])
+			})
+			for _, c := range f.classes {
+				sort.SliceStable(c.TestMethods, func(i, j int) bool {
+					return failed.hasMethod(c, c.TestMethods[i]) && !failed.hasMethod(c, c.TestMethods[j])
+				})
+			}
+		}
+	}
+
+	return nil
+}
+
+// stepResolveTestClasses selects the test classes to run
+// and adds the test methods and hooks inherited from their parents.
+func (r *runner) stepResolveTestClasses() error {
+	type classDecl struct {
+		class *testClass
+		file  *testFile
+	}
+	classes := make(map[string]classDecl)
+	addClasses := func(f *testFile) {
+		for _, c := range f.info.Classes {
+			classes[strings.ToLower(c.Name)] = classDecl{class: c, file: f}
+		}
+	}
+	for _, f := range r.testFiles {
+		addClasses(f)
+	}
+
+	supportFilesParsed := false
+	findClass := func(name string) (classDecl, bool) {
+		decl, ok := classes[strings.ToLower(name)]
+		if ok || supportFilesParsed {
+			return decl, ok
+		}
+		supportFilesParsed = true
+		for _, f := range r.supportFiles {
+			if err := r.parseFile(f); err != nil {
+				r.debugf("%s: skip support file: %v", f.fullName, err)
+				continue
+			}
+			addClasses(f)
+		}
+		decl, ok = classes[strings.ToLower(name)]
+		return decl, ok
+	}
+
+	isTestFile := make(map[*testFile]bool, len(r.testFiles))
+	for _, f := range r.testFiles {
+		isTestFile[f] = true
+	}
+	isBaseFile := make(map[*testFile]bool)
+	for _, f := range r.testFiles {
+		for _, c := range f.info.Classes {
+			if c.Abstract || c.Parent == "" {
+				continue
+			}
+			// Parents are collected from the closest to the farthest one,
+			// the first parent that is not a project class should be a PHPUnit TestCase.
+			var parents []*testClass
+			var parentFiles []*testFile
+			visited := map[*testClass]bool{c: true}
+			baseName := c.Parent
+			for baseName != "" {
+				decl, ok := findClass(baseName)
+				if !ok {
+					break
+				}
+				if visited[decl.class] {
+					baseName = ""
+					break
+				}
+				visited[decl.class] = true
+				parents = append(parents, decl.class)
+				parentFiles = append(parentFiles, decl.file)
+				baseName = decl.class.Parent
+			}
+			if !isTestCaseBase(baseName) {
+				continue
+			}
+			for _, parentFile := range parentFiles {
+				if parentFile == f {
+					continue
+				}
+				f.addRequire(parentFile)
+				if !isTestFile[parentFile] && !isBaseFile[parentFile] {
+					isBaseFile[parentFile] = true
+					r.baseFiles = append(r.baseFiles, parentFile)
+				}
+			}
+			f.classes = append(f.classes, inheritTestClass(c, parents, parentFiles))
+		}
+	}
+
+	return nil
+}
+
+// stepSelectGroups applies RunConfig.Groups and RunConfig.ExcludeGroups.
+// The test files without selected tests are removed, so their mocks are not generated.
+func (r *runner) stepSelectGroups() error {
+	if len(r.conf.Groups) == 0 && len(r.conf.ExcludeGroups) == 0 {
+		return nil
+	}
+
+	r.selectTests(func(c *testClass, m *testMethod) bool {
+		return selectedByGroups(r.conf.Groups, r.conf.ExcludeGroups, c.Groups, m.Groups)
+	})
+	return nil
+}
+
+// stepFilterTests applies RunConfig.Filter to the Class::method test names.
+func (r *runner) stepFilterTests() error {
+	if r.conf.Filter == "" {
+		return nil
+	}
+	re, err := regexp.Compile(r.conf.Filter)
+	if err != nil {
+		return err
+	}
+	r.selectTests(func(c *testClass, m *testMethod) bool {
+		return re.MatchString(c.Name + "::" + m.Name)
+	})
+	return nil
+}
+
+// selectTests keeps the test methods that are selected by the predicate.
+// The classes and files without selected tests are removed,
+// so the files are not compiled at all.
+func (r *runner) selectTests(selected func(c *testClass, m *testMethod) bool) {
+	selectedFiles := r.testFiles[:0]
+	for _, f := range r.testFiles {
+		selectedClasses := f.classes[:0]
+		for _, c := range f.classes {
+			selectedMethods := c.TestMethods[:0]
+			for _, m := range c.TestMethods {
+				if selected(c, m) {
+					selectedMethods = append(selectedMethods, m)
+				}
+			}
+			c.TestMethods = selectedMethods
+			if len(selectedMethods) != 0 {
+				selectedClasses = append(selectedClasses, c)
+			}
+		}
+		f.classes = selectedClasses
+		if len(selectedClasses) != 0 {
+			selectedFiles = append(selectedFiles, f)
+		}
+	}
+	r.testFiles = selectedFiles
+}
+
+// parsedInfos returns the parse results of the file and its requires.
+func (f *testFile) parsedInfos() []*testParsedInfo {
+	infos := []*testParsedInfo{f.info}
+	for _, required := range f.requires {
+		infos = append(infos, required.info)
+	}
+	return infos
+}
+
+// testsCount returns the number of test methods to run.
+// Data provider tests are counted once.
+func (f *testFile) testsCount() int {
+	n := 0
+	for _, c := range f.classes {
+		n += len(c.TestMethods)
+	}
+	return n
+}
+
+// testMethod finds the test method, the test name can include the data set name.
+func (f *testFile) testMethod(class, test string) *testMethod {
+	test = strings.SplitN(test, " with data set ", 2)[0]
+	for _, c := range f.classes {
+		if c.Name != class {
+			continue
+		}
+		for _, m := range c.TestMethods {
+			if m.Name == test {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// testMethodLine returns the test method declaration line.
+func (f *testFile) testMethodLine(class, test string) int {
+	if m := f.testMethod(class, test); m != nil {
+		return m.Line
+	}
+	return 0
+}
+
+// testMethodFile returns the full name of the file that declares the test method,
+// it differs from the test file for the methods inherited from another file.
+func (f *testFile) testMethodFile(class, test string) string {
+	if m := f.testMethod(class, test); m != nil && m.File != "" {
+		return m.File
+	}
+	return f.fullName
+}
+
+// className returns the test class names, separated by a comma.
+func (f *testFile) className() string {
+	names := make([]string, len(f.classes))
+	for i, c := range f.classes {
+		names[i] = c.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// addRequire adds a file with the parent class to the requires list.
+// Parents are added from the closest to the farthest one,
+// but they should be required in the reverse order.
+func (f *testFile) addRequire(required *testFile) {
+	for _, existing := range f.requires {
+		if existing == required {
+			return
+		}
+	}
+	f.requires = append([]*testFile{required}, f.requires...)
+}
+
 func (r *runner) stepPreprocessContents() error {
 	for _, f := range r.testFiles {
 		f.preprocessedContents = applyTextEdits(f.contents, f.info.fixes)
 	}
+	for _, f := range r.baseFiles {
+		f.preprocessedContents = applyTextEdits(f.contents, f.info.fixes)
+	}
 
 	return nil
 }
 
 func (r *runner) stepGenerateTestMain() error {
 	for _, f := range r.testFiles {
+		classes := make([]map[string]interface{}, len(f.classes))
+		for i, c := range f.classes {
+			for _, m := range c.TestMethods {
+				m.DataProviderCalls = m.DataProviderCalls[:0]
+				for _, provider := range m.DataProviders {
+					m.DataProviderCalls = append(m.DataProviderCalls, dataProviderCall(c, provider))
+				}
+			}
+			classes[i] = map[string]interface{}{
+				"Index":                 i,
+				"Name":                  c.Name,
+				"ClassName":             `\` + c.Name,
+				"TestMethods":           c.TestMethods,
+				"HasSetUpBeforeClass":   c.HasSetUpBeforeClass,
+				"HasTearDownAfterClass": c.HasTearDownAfterClass,
+				"BeforeHooks":           c.beforeHooks(),
+				"AfterHooks":            c.afterHooks(),
+			}
+		}
+		requires := make([]string, 0, len(f.mocks)+len(f.requires))
+		requires = append(requires, f.mocks...)
+		for _, required := range f.requires {
+			requires = append(requires, filepath.Join(r.buildDirTests, required.shortName))
+		}
+
+		f.suiteFilename = filepath.Join(r.buildDirSuites, fmt.Sprintf("%d.php", f.id))
+		f.mainFilename = filepath.Join(r.buildDirMains, fmt.Sprintf("%d.php", f.id))
+
 		var generated bytes.Buffer
 		templateData := map[string]interface{}{
-			"TestFilename":          filepath.Join(r.buildDirTests, f.shortName),
-			"TestClassName":         f.info.ClassName,
-			"TestMethods":           f.info.TestMethods,
-			"HasSetUpBeforeClass":   f.info.HasSetUpBeforeClass,
-			"HasTearDownAfterClass": f.info.HasTearDownAfterClass,
+			"ID":              f.id,
+			"RuntimeFilename": r.runtimeFilename,
+			"TestFilename":    filepath.Join(r.buildDirTests, f.shortName),
+			"ConfigBootstrap": r.configBootstrap(),
+			"Requires":        requires,
+			"Classes":         classes,
+		}
+		if err := testSuiteTemplate.Execute(&generated, templateData); err != nil {
+			return fmt.Errorf("%s: %w", f.fullName, err)
+		}
+		f.generatedSuite = generated.Bytes()
+
+		generated = bytes.Buffer{}
+		templateData = map[string]interface{}{
+			"ID":            f.id,
+			"SuiteFilename": f.suiteFilename,
+		}
+		if r.conf.ComposerRoot != "" {
+			templateData["Bootstrap"] = filepath.Join(r.conf.ComposerRoot, "vendor", "autoload.php")
 		}
 		if err := testMainTemplate.Execute(&generated, templateData); err != nil {
 			return fmt.Errorf("%s: %w", f.fullName, err)
@@ -249,40 +912,298 @@ func (r *runner) stepGenerateTestMain() error {
 		f.generatedMain = generated.Bytes()
 	}
 
+	if r.conf.SingleBinary {
+		r.combinedMainFilename = filepath.Join(r.buildDirMains, "all.php")
+		suites := make([]map[string]interface{}, len(r.testFiles))
+		for i, f := range r.testFiles {
+			suites[i] = map[string]interface{}{
+				"ID":       f.id,
+				"Filename": f.suiteFilename,
+			}
+		}
+		var generated bytes.Buffer
+		templateData := map[string]interface{}{
+			"Suites": suites,
+		}
+		if err := testCombinedMainTemplate.Execute(&generated, templateData); err != nil {
+			return err
+		}
+		r.combinedMain = generated.Bytes()
+	}
+
 	return nil
 }
 
-var testMainTemplate = template.Must(template.New("test_main").Parse(`<?php
-
-require_once '{{.TestFilename}}';
+// configBootstrap returns the phpunit.xml bootstrap file that should be required by the test suites.
+// The composer autoloader is skipped: it's already required by the PHP mains.
+func (r *runner) configBootstrap() string {
+	if r.phpunitConfig == nil {
+		return ""
+	}
+	bootstrap := r.phpunitConfig.bootstrapFilename()
+	if r.conf.ComposerRoot != "" && bootstrap == filepath.Join(r.conf.ComposerRoot, "vendor", "autoload.php") {
+		return ""
+	}
+	return bootstrap
+}
 
-use KPHPUnit\Framework\TestCase;
-use KPHPUnit\Framework\AssertionFailedException;
+// testSuiteTemplate defines a function that runs all tests from a single test file.
+// Suites are included by both per-file mains and a combined main.
+var testSuiteTemplate = template.Must(template.New("test_suite").Parse(`<?php
 
-function __kphpunit_main() {
-  {{if .HasSetUpBeforeClass}}{{.TestClassName}}::setUpBeforeClass();{{end}}
-  $test = new {{.TestClassName}}();
-  {{range .TestMethods}}
+require_once '{{.RuntimeFilename}}';
+{{- if .ConfigBootstrap}}
+require_once '{{.ConfigBootstrap}}';
+{{- end}}
+{{- range .Requires}}
+require_once '{{.}}';
+{{- end}}
+require_once '{{.TestFilename}}';
+{{range $c := .Classes}}
+/**
+ * Runs a single {{$c.Name}} test using a fresh test class instance, like PHPUnit does.
+ * After hooks are executed even if the test fails.
+ * Uncaught exceptions are reported as test errors.
+ */
+function __kphpunit_test_{{$.ID}}_{{$c.Index}}(string $name, callable $test_fn) {
+  $start = __kphpunit_test_started($name);
+  $test = new {{$c.ClassName}}();
+  try {
+    {{- range $c.BeforeHooks}}
+    $test->{{.}}();
+    {{- end}}
+    $test_fn($test);
+    __kphpunit_test_returned();
+  } catch (\KPHPUnit\Framework\AssertionFailedException $e) {
+    __kphpunit_assertion_failed();
+  } catch (\Throwable $e) {
+    __kphpunit_exception_thrown($e);
+  }
+  {{- if $c.AfterHooks}}
   try {
-    echo '["START","{{.}}"]' . "\n";
+    {{- range $c.AfterHooks}}
     $test->{{.}}();
-    fprintf(STDERR, '.');
-  } catch (AssertionFailedException $e) {
-    fprintf(STDERR, 'F');
+    {{- end}}
+  } catch (\KPHPUnit\Framework\AssertionFailedException $e) {
+    __kphpunit_assertion_failed();
+  } catch (\Throwable $e) {
+    __kphpunit_exception_thrown($e);
+  }
+  {{- end}}
+  __kphpunit_test_finished($name, $start);
+}
+{{end}}
+function __kphpunit_run_{{.ID}}(string $only_test = '') {
+  {{- range $c := .Classes}}
+  if (__kphpunit_class_selected($only_test, '{{$c.Name}}')) {
+  __kphpunit_event(['CLASS', '{{$c.Name}}']);
+  {{- if $c.HasSetUpBeforeClass}}
+  {{$c.ClassName}}::setUpBeforeClass();
+  {{- end}}
+  {{- range $m := $c.TestMethods}}
+  if (__kphpunit_test_selected($only_test, '{{$c.Name}}', '{{$m.Name}}')) {
+  {{- if $m.DataProviders}}
+  {{- range $m.DataProviderCalls}}
+  foreach ({{.}} as $data_name => $data_set) {
+    $data_set = array_values($data_set);
+    __kphpunit_test_{{$.ID}}_{{$c.Index}}(__kphpunit_data_set_name('{{$m.Name}}', $data_name), function({{$c.ClassName}} $test) use ($data_set) {
+      {{- template "test_call" $m}}
+    });
+  }
+  {{- end}}
+  {{- else}}
+  __kphpunit_test_{{$.ID}}_{{$c.Index}}('{{$m.Name}}', function({{$c.ClassName}} $test) {
+    {{- template "test_call" $m}}
+  });
+  {{- end}}
+  }
+  {{- end}}
+  {{- if $c.HasTearDownAfterClass}}
+  {{$c.ClassName}}::tearDownAfterClass();
+  {{- end}}
   }
   {{- end}}
-  echo '["FINISHED"]' . "\n";
-  {{if .HasTearDownAfterClass}}{{.TestClassName}}::tearDownAfterClass();{{end}}
+  __kphpunit_event(['FINISHED']);
+}
+
+{{- /*
+  test_call calls the test method.
+  Every expected exception class gets its own catch clause,
+  so subclasses of the expected exception are matched too.
+*/ -}}
+{{- define "test_call"}}
+    {{- if .ExpectedExceptions}}
+    try {
+      $test->{{.Name}}({{.CallArgs}});
+    {{- range .ExpectedExceptions}}
+    } catch (\{{.}} $e) {
+      __kphpunit_expected_exception_caught($e, '{{.}}');
+    {{- end}}
+    }
+    {{- else}}
+    $test->{{.Name}}({{.CallArgs}});
+    {{- end}}
+{{- end}}
+`))
+
+// dataProviderCall returns a PHP expression that calls the data provider method.
+func dataProviderCall(c *testClass, provider string) string {
+	if strings.Contains(provider, "::") {
+		return provider + "()"
+	}
+	if c.StaticMethods[provider] {
+		return `\` + c.Name + "::" + provider + "()"
+	}
+	return `(new \` + c.Name + "())->" + provider + "()"
+}
+
+// inheritTestClass returns a copy of the test class with the test methods
+// and hooks of its parents (from the closest to the farthest one).
+// parentFiles are the files that declare the parents.
+func inheritTestClass(c *testClass, parents []*testClass, parentFiles []*testFile) *testClass {
+	inherited := *c
+	inherited.TestMethods = append([]*testMethod{}, c.TestMethods...)
+	inherited.StaticMethods = make(map[string]bool)
+	for name := range c.StaticMethods {
+		inherited.StaticMethods[name] = true
+	}
+
+	methods := make(map[string]bool)
+	for _, m := range c.TestMethods {
+		methods[strings.ToLower(m.Name)] = true
+	}
+	for i, parent := range parents {
+		for _, m := range parent.TestMethods {
+			if methods[strings.ToLower(m.Name)] {
+				continue
+			}
+			methods[strings.ToLower(m.Name)] = true
+			// Methods are copied, because the data provider calls
+			// depend on the class they are called for.
+			copied := *m
+			if copied.File == "" {
+				copied.File = parentFiles[i].fullName
+			}
+			inherited.TestMethods = append(inherited.TestMethods, &copied)
+		}
+		for name := range parent.StaticMethods {
+			if _, ok := c.StaticMethods[name]; !ok {
+				inherited.StaticMethods[name] = true
+			}
+		}
+		inherited.HasSetUpBeforeClass = inherited.HasSetUpBeforeClass || parent.HasSetUpBeforeClass
+		inherited.HasTearDownAfterClass = inherited.HasTearDownAfterClass || parent.HasTearDownAfterClass
+		inherited.HasSetUp = inherited.HasSetUp || parent.HasSetUp
+		inherited.HasTearDown = inherited.HasTearDown || parent.HasTearDown
+		// Parent @before methods are called first, @after methods are called last.
+		inherited.BeforeMethods = appendNewNames(append([]string{}, parent.BeforeMethods...), inherited.BeforeMethods...)
+		inherited.AfterMethods = appendNewNames(inherited.AfterMethods, parent.AfterMethods...)
+	}
+	return &inherited
+}
+
+// appendNewNames appends the names that are not in the list yet.
+func appendNewNames(list []string, names ...string) []string {
+	for _, name := range names {
+		found := false
+		for _, existing := range list {
+			if existing == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// beforeHooks returns the methods to call before every test.
+// Like in PHPUnit, @before methods are called before setUp.
+func (c *testClass) beforeHooks() []string {
+	hooks := append([]string{}, c.BeforeMethods...)
+	if c.HasSetUp {
+		hooks = append(hooks, "setUp")
+	}
+	return hooks
+}
+
+// afterHooks returns the methods to call after every test.
+// Like in PHPUnit, @after methods are called after tearDown.
+func (c *testClass) afterHooks() []string {
+	var hooks []string
+	if c.HasTearDown {
+		hooks = append(hooks, "tearDown")
+	}
+	return append(hooks, c.AfterMethods...)
+}
+
+// testMainTemplate runs a single test suite.
+// The first argument is the event marker (see newEventMarker),
+// the second one can select a single "Class::method" test (see RunConfig.ProcessIsolation).
+// The same main is used to run tests with PHP, so it requires
+// the composer autoloader (KPHP handles the autoload on its own).
+var testMainTemplate = template.Must(template.New("test_main").Parse(`<?php
+{{if .Bootstrap}}
+#ifndef KPHP
+require_once '{{.Bootstrap}}';
+#endif
+{{end}}
+require_once '{{.SuiteFilename}}';
+
+__kphpunit_set_event_marker(isset($argv[1]) ? (string)$argv[1] : '');
+__kphpunit_run_{{.ID}}(isset($argv[2]) ? (string)$argv[2] : '');
+`))
+
+// testCombinedMainTemplate includes every test suite into a single program.
+// The first argument is the event marker, like for testMainTemplate.
+// The suite to run is selected by the second argument (a test file ID);
+// "all" runs every suite in order. The optional third argument
+// selects a single "Class::method" test, like the second argument of testMainTemplate does.
+var testCombinedMainTemplate = template.Must(template.New("test_combined_main").Parse(`<?php
+{{range .Suites}}
+require_once '{{.Filename}}';
+{{- end}}
+
+function __kphpunit_main() {
+  global $argv;
+  __kphpunit_set_event_marker(isset($argv[1]) ? (string)$argv[1] : '');
+  $suite = isset($argv[2]) ? (string)$argv[2] : 'all';
+  $only_test = isset($argv[3]) ? (string)$argv[3] : '';
+  switch ($suite) {
+  {{- range .Suites}}
+    case '{{.ID}}':
+      __kphpunit_run_{{.ID}}($only_test);
+      break;
+  {{- end}}
+    case 'all':
+    {{- range .Suites}}
+      __kphpunit_run_{{.ID}}();
+    {{- end}}
+      break;
+    default:
+      fprintf(STDERR, "unknown test suite: $suite\n");
+      exit(1);
+  }
 }
 
 __kphpunit_main();
 `))
 
 func (r *runner) stepWritePreprocessedTestFiles() error {
+	// Parent test cases can be declared in the test files that are not selected to run.
+	written := make(map[*testFile]bool)
 	for _, f := range r.testFiles {
-		filename := filepath.Join(r.buildDirTests, f.shortName)
-		if err := fileutil.WriteFile(filename, f.preprocessedContents); err != nil {
-			return err
+		for _, f := range append([]*testFile{f}, f.requires...) {
+			if written[f] {
+				continue
+			}
+			written[f] = true
+			filename := filepath.Join(r.buildDirTests, f.shortName)
+			if err := fileutil.WriteFile(filename, f.preprocessedContents); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -290,66 +1211,447 @@ func (r *runner) stepWritePreprocessedTestFiles() error {
 }
 
 func (r *runner) stepWriteTestMain() error {
+	if err := fileutil.WriteFile(r.runtimeFilename, []byte(runtimeSource)); err != nil {
+		return err
+	}
+
 	for _, f := range r.testFiles {
-		f.mainFilename = filepath.Join(r.buildDirMains, fmt.Sprintf("%d.php", f.id))
+		if err := fileutil.WriteFile(f.suiteFilename, f.generatedSuite); err != nil {
+			return err
+		}
 		if err := fileutil.WriteFile(f.mainFilename, f.generatedMain); err != nil {
 			return err
 		}
 	}
 
+	if r.combinedMainFilename != "" {
+		if err := fileutil.WriteFile(r.combinedMainFilename, r.combinedMain); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (r *runner) stepRunKphpTests() error {
-	testsTotal := 0
-	for _, f := range r.testFiles {
-		testsTotal += len(f.info.TestMethods)
+	if r.conf.SingleBinary {
+		r.runSingleBinary(r.buildCombinedMain, r.runTestFile)
+	} else {
+		r.runTestFiles(r.runTestFile)
 	}
+	return nil
+}
 
-	testsCompleted := 0
-	for _, f := range r.testFiles {
-		testsCompleted += len(f.info.TestMethods)
-
-		buildResult, err := kphpscript.Build(kphpscript.BuildConfig{
-			KPHPCommand:  r.conf.KphpCommand,
-			Script:       f.mainFilename,
-			ComposerRoot: r.conf.ComposerRoot,
-			OutputDir:    r.buildDir,
-			Workdir:      r.buildDir,
+// runSingleBinary runs every test file suite from the combined executable.
+// If it can't be built, the test files are built separately with fallback,
+// so the build error is reported for the file that broke the build.
+func (r *runner) runSingleBinary(build func() (string, error), fallback func(f *testFile, outputDir string) *testFileRun) {
+	executable, err := build()
+	if err == nil {
+		r.runTestFiles(func(f *testFile, outputDir string) *testFileRun {
+			return r.runTests(f, executable, []string{strconv.Itoa(f.id)})
 		})
-		if err != nil {
-			log.Printf("%s: build error: %v", f.fullName, err)
-			continue
+		return
+	}
+
+	log.Printf("single binary build error: %v", err)
+	log.Printf("falling back to the per-file builds")
+	r.runTestFiles(fallback)
+
+	var broken []string
+	for _, fileErr := range r.result.FileErrors {
+		if fileErr.Kind == BuildError {
+			broken = append(broken, fileErr.File)
 		}
+	}
+	if len(broken) == 0 {
+		// Every file can be built on its own, so they conflict with each other
+		// (like the same function declared in several test files).
+		log.Printf("every test file builds separately, the single binary build error is caused by their combination")
+		return
+	}
+	log.Printf("single binary build is broken by: %s", strings.Join(broken, ", "))
+}
 
-		runResult, err := kphpscript.Run(kphpscript.RunConfig{
-			Executable: buildResult.Executable,
-			Workdir:    r.buildDir,
-			Stderr:     r.conf.Output,
-		})
-		if err != nil {
-			log.Printf("%s: run error: %v", f.fullName, err)
-			continue
+// runTestFiles runs the test files with RunConfig.Jobs workers
+// and collects their results in the r.testFiles order.
+func (r *runner) runTestFiles(runFile func(f *testFile, outputDir string) *testFileRun) {
+	testsTotal := 0
+	for _, f := range r.testFiles {
+		testsTotal += f.testsCount()
+	}
+
+	numWorkers := r.conf.Jobs
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	if numWorkers > len(r.testFiles) {
+		numWorkers = len(r.testFiles)
+	}
+
+	// Every file result is delivered through its own channel,
+	// so we can report them in the stepSortTestFiles order
+	// no matter which worker finishes first.
+	results := make([]chan *testFileRun, len(r.testFiles))
+	for i := range results {
+		results[i] = make(chan *testFileRun, 1)
+	}
+	jobs := make(chan int)
+	for workerID := 0; workerID < numWorkers; workerID++ {
+		outputDir := filepath.Join(r.buildDir, "out", strconv.Itoa(workerID))
+		go func() {
+			for i := range jobs {
+				run := runFile(r.testFiles[i], outputDir)
+				if r.conf.VsPHP {
+					r.runPhpTests(r.testFiles[i], run)
+				}
+				results[i] <- run
+			}
+		}()
+	}
+	go func() {
+		for i := range r.testFiles {
+			jobs <- i
 		}
+		close(jobs)
+	}()
 
-		// 3. Parse output.
-		parsed, err := parseTestOutput(f, runResult.Stdout)
-		if err != nil {
-			log.Printf("%s: parse test output: %v", f.fullName, err)
+	testsCompleted := 0
+	for i, f := range r.testFiles {
+		testsCompleted += f.testsCount()
+
+		run := <-results[i]
+		r.conf.Output.Write(run.stderr)
+		r.reportTeamcity(f, run)
+		r.reportEvents(f, run)
+		r.result.Files = append(r.result.Files, FileResult{
+			File:      f.fullName,
+			BuildTime: run.buildTime,
+			RunTime:   run.runTime,
+		})
+		if run.err != nil {
+			fileErr := FileError{
+				File:  f.fullName,
+				Class: f.className(),
+				Kind:  run.errKind,
+				Err:   run.err,
+			}
+			r.result.FileErrors = append(r.result.FileErrors, fileErr)
+			r.result.NotRun += f.testsCount()
+			// The tests that pass with PHP, but can't be run with KPHP
+			// are the most important mismatches.
+			if r.conf.VsPHP && run.phpErr == nil {
+				r.result.Mismatches = append(r.result.Mismatches, compareWithFileError(run.phpParsed, fileErr)...)
+			}
 			continue
 		}
 
 		status := "OK"
-		if len(parsed.failures) != 0 {
+		if len(run.parsed.failures) != 0 || len(run.parsed.errors) != 0 {
 			status = "FAIL"
 		}
 		completed := float64(testsCompleted) / float64(testsTotal) * 100.0
 		fmt.Fprintf(r.conf.Output, " %d / %d (%2d%%) %s\n", testsCompleted, testsTotal, int(completed), status)
 
-		r.result.Failures = append(r.result.Failures, parsed.failures...)
-		r.result.Assertions += parsed.asserts
+		// A test method with a data provider is executed once per data set,
+		// so the tests number is known only after the run.
+		r.result.Tests += len(run.parsed.tests)
+		r.result.Failures = append(r.result.Failures, run.parsed.failures...)
+		r.result.Errors = append(r.result.Errors, run.parsed.errors...)
+		r.result.Skipped = append(r.result.Skipped, run.parsed.skipped...)
+		r.result.Incomplete = append(r.result.Incomplete, run.parsed.incomplete...)
+		r.result.Risky = append(r.result.Risky, run.parsed.risky...)
+		r.result.Results = append(r.result.Results, run.parsed.tests...)
+		r.result.Assertions += run.parsed.asserts
+
+		if r.conf.VsPHP {
+			if run.phpErr != nil {
+				r.result.FileErrors = append(r.result.FileErrors, FileError{
+					File:  f.fullName,
+					Class: f.className(),
+					Kind:  PHPRunError,
+					Err:   run.phpErr,
+				})
+			} else {
+				r.result.Mismatches = append(r.result.Mismatches, compareTestResults(run.phpParsed, run.parsed)...)
+			}
+		}
 	}
-	r.result.Tests = testsCompleted
+}
 
-	return nil
+// runPhpTests runs the same test file main with PHP.
+func (r *runner) runPhpTests(f *testFile, run *testFileRun) {
+	runResult, err := phpscript.Run(phpscript.RunConfig{
+		PHPCommand: r.conf.PhpCommand,
+		Script:     f.mainFilename,
+		ScriptArgs: []string{r.eventMarker},
+		Workdir:    r.buildDir,
+		Env:        r.env,
+	})
+	if err != nil {
+		run.phpErr = err
+		return
+	}
+	run.phpParsed, run.phpErr = parseTestOutput(f, r.eventMarker, runResult.Stdout)
+	if run.phpErr == nil {
+		r.fixErrorLocations(run.phpParsed)
+	}
+}
+
+// fixErrorLocations replaces the temp build dir paths in the test errors
+// with the paths inside the project root.
+func (r *runner) fixErrorLocations(res *testFileResult) {
+	sourceFilename := func(filename string) string {
+		if rel, err := filepath.Rel(r.buildDir, filename); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.Join(r.conf.ProjectRoot, rel)
+		}
+		return filename
+	}
+	for i := range res.errors {
+		res.errors[i].File = sourceFilename(res.errors[i].File)
+	}
+	for _, test := range res.tests {
+		if test.Error != nil {
+			test.Error.File = sourceFilename(test.Error.File)
+		}
+	}
+}
+
+// buildCombinedMain compiles all test files into a single executable.
+func (r *runner) buildCombinedMain() (string, error) {
+	outputDir := filepath.Join(r.buildDir, "out", "all")
+	if err := fileutil.MkdirAll(outputDir); err != nil {
+		return "", err
+	}
+	buildResult, err := r.buildExecutable("", r.combinedMainFilename, outputDir)
+	if err != nil {
+		return "", err
+	}
+	return buildResult.Executable, nil
+}
+
+// buildExecutable compiles the main script and reports the build events.
+// file is the test file being compiled, it's empty for the combined main.
+func (r *runner) buildExecutable(file, script, outputDir string) (*kphpscript.BuildResult, error) {
+	r.emit(event.Event{Action: event.BuildStart, File: file})
+	start := time.Now()
+	buildResult, err := kphpscript.Build(kphpscript.BuildConfig{
+		KPHPCommand:  r.conf.KphpCommand,
+		Script:       script,
+		ComposerRoot: r.conf.ComposerRoot,
+		OutputDir:    outputDir,
+		Workdir:      r.buildDir,
+		Cache:        r.conf.BuildCache,
+	})
+	buildEnd := event.Event{Action: event.BuildEnd, File: file, Elapsed: time.Since(start).Seconds()}
+	if err != nil {
+		buildEnd.Error = err.Error()
+	}
+	r.emit(buildEnd)
+	return buildResult, err
+}
+
+// reportTeamcity writes the test file results as TeamCity service messages.
+// Every test file gets its own flowId.
+func (r *runner) reportTeamcity(f *testFile, run *testFileRun) {
+	logger := r.logger.WithFlowID(strconv.Itoa(f.id))
+	classLocation := func(class string) string {
+		return fmt.Sprintf("php_qn://%s::\\%s", f.fullName, class)
+	}
+
+	if run.err != nil {
+		name := run.errKind.String()
+		suite := f.className()
+		location := "php_qn://" + f.fullName
+		if len(f.classes) != 0 {
+			location = classLocation(f.classes[0].Name)
+		}
+		if suite == "" {
+			suite = f.shortName
+		}
+		logger.TestSuiteStarted(suite, teamcity.LocationHint(location))
+		logger.TestStarted(name, teamcity.LocationHint(location))
+		logger.TestFailed(name, name, run.err.Error())
+		logger.TestFinished(name)
+		logger.TestSuiteFinished(suite, 0)
+		return
+	}
+
+	// Every test class is reported as a separate suite.
+	currentClass := ""
+	var suiteTime time.Duration
+	for _, test := range run.parsed.tests {
+		if test.Class != currentClass {
+			if currentClass != "" {
+				logger.TestSuiteFinished(currentClass, suiteTime)
+			}
+			currentClass = test.Class
+			suiteTime = 0
+			logger.TestSuiteStarted(currentClass, teamcity.LocationHint(classLocation(currentClass)))
+		}
+		suiteTime += test.Time
+		logger.TestStarted(test.Name, teamcity.LocationHint(classLocation(test.Class)+"::"+test.Name))
+		if test.Output != "" {
+			logger.TestStdOut(test.Name, test.Output)
+		}
+		if testErr := test.Error; testErr != nil {
+			logger.TestFailed(test.Name, failureMessage(testErr), failureText(testErr))
+		} else if failure := test.Failure; failure != nil {
+			var attrs []teamcity.Attr
+			if failure.Expected != "" || failure.Actual != "" {
+				attrs = teamcity.ComparisonFailed(failure.Expected, failure.Actual)
+			}
+			logger.TestFailed(test.Name, failureMessage(failure), failureText(failure), attrs...)
+		} else if skipped := test.Skipped; skipped != nil {
+			logger.TestIgnored(test.Name, skipped.Message)
+		} else if incomplete := test.Incomplete; incomplete != nil {
+			logger.TestIgnored(test.Name, incomplete.Message)
+		}
+		logger.TestFinished(test.Name, teamcity.Duration(test.Time))
+	}
+	if currentClass != "" {
+		logger.TestSuiteFinished(currentClass, suiteTime)
+	}
+}
+
+func (r *runner) emit(ev event.Event) {
+	if r.conf.Events != nil {
+		r.conf.Events.Encode(ev)
+	}
+}
+
+func (r *runner) reportEvents(f *testFile, run *testFileRun) {
+	if r.conf.Events == nil {
+		return
+	}
+
+	if run.err != nil {
+		r.emit(event.Event{
+			Action:  event.Error,
+			File:    f.fullName,
+			Class:   f.className(),
+			Reason:  run.errKind.String(),
+			Message: run.err.Error(),
+		})
+		return
+	}
+
+	for _, test := range run.parsed.tests {
+		ev := event.Event{File: f.fullName, Class: test.Class, Test: test.Name}
+		ev.Action = event.Start
+		r.emit(ev)
+		if test.Output != "" {
+			ev.Action = event.Output
+			ev.Output = test.Output
+			r.emit(ev)
+			ev.Output = ""
+		}
+		ev.Action = event.Pass
+		ev.Elapsed = test.Time.Seconds()
+		failure := test.Failure
+		switch {
+		case test.Error != nil:
+			ev.Action = event.Error
+			failure = test.Error
+		case failure != nil:
+			ev.Action = event.Fail
+		case test.Skipped != nil:
+			ev.Action = event.Skip
+			failure = test.Skipped
+		case test.Incomplete != nil:
+			ev.Action = event.Incomplete
+			failure = test.Incomplete
+		case test.Risky != nil:
+			ev.Action = event.Risky
+			failure = test.Risky
+		}
+		if failure != nil {
+			if failure.File != "" {
+				ev.File = failure.File
+			}
+			ev.Line = failure.Line
+			ev.Reason = failure.Reason
+			ev.Message = failure.Message
+			ev.Diff = failure.Diff
+		}
+		r.emit(ev)
+	}
+}
+
+type testFileRun struct {
+	buildTime time.Duration
+	runTime   time.Duration
+
+	stderr  []byte
+	parsed  *testFileResult
+	errKind FileErrorKind
+	err     error
+
+	phpParsed *testFileResult
+	phpErr    error
+}
+
+// runTestFile builds and runs a single test file.
+// It's executed concurrently, so it should not touch the shared runner state;
+// outputDir is owned by the calling worker.
+func (r *runner) runTestFile(f *testFile, outputDir string) *testFileRun {
+	if err := fileutil.MkdirAll(outputDir); err != nil {
+		return &testFileRun{errKind: BuildError, err: err}
+	}
+
+	buildResult, err := r.buildExecutable(f.fullName, f.mainFilename, outputDir)
+	if err != nil {
+		return &testFileRun{errKind: BuildError, err: err}
+	}
+
+	run := r.runTests(f, buildResult.Executable, nil)
+	run.buildTime = buildResult.Time
+	return run
+}
+
+// runTestExecutable runs the test executable once.
+// c and m are set if a single test method is run (see RunConfig.ProcessIsolation).
+func (r *runner) runTestExecutable(ctx context.Context, f *testFile, executable string, args []string, c *testClass, m *testMethod) *testFileRun {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stdout io.Writer
+	var watchdog *testWatchdog
+	if r.conf.TestTimeout > 0 {
+		watchdog = newTestWatchdog(r.conf.TestTimeout, r.eventMarker, cancel)
+		stdout = watchdog
+	}
+
+	runResult, err := kphpscript.Run(kphpscript.RunConfig{
+		Executable: executable,
+		Workdir:    r.buildDir,
+		ScriptArgs: append([]string{r.eventMarker}, args...),
+		Env:        r.env,
+		Stdout:     stdout,
+		Context:    ctx,
+	})
+	testTimedOut := watchdog != nil && watchdog.Stop()
+	if err != nil {
+		run := &testFileRun{stderr: runResult.Stderr, runTime: runResult.Time, errKind: RunError, err: err}
+		message := ""
+		switch {
+		case testTimedOut:
+			message = timeoutMessage("test", r.conf.TestTimeout)
+		case ctx.Err() == context.DeadlineExceeded:
+			message = timeoutMessage("test file", r.conf.FileTimeout)
+		case c != nil:
+			message = "The test process has crashed: " + err.Error()
+		}
+		if message != "" && !r.interruptedTestRun(f, run, runResult.Stdout, c, m, message) {
+			run.err = fmt.Errorf("%s: %v", message, err)
+		}
+		return run
+	}
+
+	parsed, err := parseTestOutput(f, r.eventMarker, runResult.Stdout)
+	if err != nil {
+		return &testFileRun{stderr: runResult.Stderr, runTime: runResult.Time, errKind: OutputError, err: err}
+	}
+	r.fixErrorLocations(parsed)
+
+	return &testFileRun{stderr: runResult.Stderr, runTime: runResult.Time, parsed: parsed}
 }
@@ -0,0 +1,268 @@
+package phpunit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VKCOM/ktest/event"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestRunTestFilesOrder(t *testing.T) {
+	var output bytes.Buffer
+	r := newRunner(&RunConfig{Jobs: 4, Output: &output})
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("/tests/Foo%dTest.php", i)
+		r.testFiles = append(r.testFiles, &testFile{
+			id:       i,
+			fullName: name,
+			classes: []*testClass{
+				{Name: fmt.Sprintf("Foo%dTest", i), TestMethods: []*testMethod{{Name: "testFoo"}}},
+			},
+		})
+	}
+
+	// The first files take longer, so the workers finish in the reverse order.
+	r.runTestFiles(func(f *testFile, outputDir string) *testFileRun {
+		time.Sleep(time.Duration(len(r.testFiles)-f.id) * 20 * time.Millisecond)
+		c := f.classes[0]
+		return &testFileRun{
+			stderr: []byte("."),
+			parsed: &testFileResult{
+				finished: true,
+				asserts:  1,
+				tests:    []TestResult{{Class: c.Name, Name: c.TestMethods[0].Name, File: f.fullName, Assertions: 1}},
+			},
+		}
+	})
+
+	wantOutput := ". 1 / 4 (25%) OK\n. 2 / 4 (50%) OK\n. 3 / 4 (75%) OK\n. 4 / 4 (100%) OK\n"
+	if output.String() != wantOutput {
+		t.Errorf("output mismatch:\nhave:\n%s\nwant:\n%s", output.String(), wantOutput)
+	}
+	var files, classes []string
+	for _, f := range r.result.Files {
+		files = append(files, f.File)
+	}
+	for _, test := range r.result.Results {
+		classes = append(classes, test.Class)
+	}
+	wantFiles := []string{"/tests/Foo0Test.php", "/tests/Foo1Test.php", "/tests/Foo2Test.php", "/tests/Foo3Test.php"}
+	if diff := cmp.Diff(wantFiles, files); diff != "" {
+		t.Errorf("files order mismatch (-want +have):\n%s", diff)
+	}
+	wantClasses := []string{"Foo0Test", "Foo1Test", "Foo2Test", "Foo3Test"}
+	if diff := cmp.Diff(wantClasses, classes); diff != "" {
+		t.Errorf("results order mismatch (-want +have):\n%s", diff)
+	}
+	if r.result.Tests != 4 || r.result.Assertions != 4 {
+		t.Errorf("tests=%d assertions=%d, want 4 and 4", r.result.Tests, r.result.Assertions)
+	}
+}
+
+func TestReportTeamcityFileErrorWithoutClasses(t *testing.T) {
+	var output bytes.Buffer
+	r := newRunner(&RunConfig{TeamcityOutput: true, Output: &output})
+	f := &testFile{fullName: "/tests/FooTest.php", shortName: "FooTest.php"}
+	r.reportTeamcity(f, &testFileRun{errKind: BuildError, err: errors.New("compilation failed")})
+
+	if !strings.Contains(output.String(), "testSuiteStarted name='FooTest.php' locationHint='php_qn:///tests/FooTest.php'") {
+		t.Errorf("the file error is not reported:\n%s", output.String())
+	}
+}
+
+func TestRunSingleBinaryFallback(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	r := newRunner(&RunConfig{Jobs: 2, Output: ioutil.Discard})
+	for i, name := range []string{"/tests/ATest.php", "/tests/BTest.php"} {
+		r.testFiles = append(r.testFiles, &testFile{
+			id:       i,
+			fullName: name,
+			classes:  []*testClass{{Name: "Test", TestMethods: []*testMethod{{Name: "testFoo"}}}},
+		})
+	}
+
+	buildErr := errors.New("BTest.php: syntax error")
+	r.runSingleBinary(
+		func() (string, error) { return "", errors.New("all.php: compilation failed") },
+		func(f *testFile, outputDir string) *testFileRun {
+			if f.fullName == "/tests/BTest.php" {
+				return &testFileRun{errKind: BuildError, err: buildErr}
+			}
+			return &testFileRun{parsed: &testFileResult{finished: true, tests: []TestResult{{Class: "Test", Name: "testFoo"}}}}
+		})
+
+	want := []FileError{{File: "/tests/BTest.php", Class: "Test", Kind: BuildError, Err: buildErr}}
+	if diff := cmp.Diff(want, r.result.FileErrors, cmpopts.EquateErrors()); diff != "" {
+		t.Errorf("file errors mismatch (-want +have):\n%s", diff)
+	}
+	if len(r.result.Results) != 1 {
+		t.Errorf("the files that can be built are not run: %d results", len(r.result.Results))
+	}
+	if !strings.Contains(logs.String(), "single binary build is broken by: /tests/BTest.php") {
+		t.Errorf("the broken file is not logged:\n%s", logs.String())
+	}
+}
+
+func TestCombinedMainTemplate(t *testing.T) {
+	var generated bytes.Buffer
+	err := testCombinedMainTemplate.Execute(&generated, map[string]interface{}{
+		"Suites": []map[string]interface{}{
+			{"ID": 0, "Filename": "/build/suites/0.php"},
+			{"ID": 3, "Filename": "/build/suites/3.php"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"require_once '/build/suites/0.php';\nrequire_once '/build/suites/3.php';\n",
+		"    case '0':\n      __kphpunit_run_0($only_test);\n      break;\n",
+		"    case '3':\n      __kphpunit_run_3($only_test);\n      break;\n",
+		"    case 'all':\n      __kphpunit_run_0();\n      __kphpunit_run_3();\n      break;\n",
+	} {
+		if !strings.Contains(generated.String(), want) {
+			t.Errorf("the combined main doesn't contain:\n%s\ngenerated:\n%s", want, generated.String())
+		}
+	}
+}
+
+// newTestRunner returns a runner with the "Class::method" tests, one test file per class.
+func newTestRunner(conf *RunConfig, tests ...string) *runner {
+	r := newRunner(conf)
+	classes := make(map[string]*testClass)
+	for _, test := range tests {
+		parts := strings.SplitN(test, "::", 2)
+		c := classes[parts[0]]
+		if c == nil {
+			c = &testClass{Name: parts[0]}
+			classes[parts[0]] = c
+			r.testFiles = append(r.testFiles, &testFile{
+				id:       len(r.testFiles),
+				fullName: "/tests/" + parts[0] + ".php",
+				classes:  []*testClass{c},
+			})
+		}
+		c.TestMethods = append(c.TestMethods, &testMethod{Name: parts[1]})
+	}
+	return r
+}
+
+// selectedTests returns the "Class::method" names of the tests to run, in order.
+func selectedTests(r *runner) []string {
+	var tests []string
+	for _, f := range r.testFiles {
+		for _, c := range f.classes {
+			for _, m := range c.TestMethods {
+				tests = append(tests, c.Name+"::"+m.Name)
+			}
+		}
+	}
+	return tests
+}
+
+func TestFilterTests(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []string
+		files  int
+	}{
+		{filter: "", want: []string{"ATest::testFoo", "ATest::testBar", "BTest::testFoo", "CTest::testBaz"}, files: 3},
+		{filter: "testFoo", want: []string{"ATest::testFoo", "BTest::testFoo"}, files: 2},
+		{filter: `^BTest::`, want: []string{"BTest::testFoo"}, files: 1},
+		{filter: "testQux", want: nil, files: 0},
+	}
+
+	for _, test := range tests {
+		r := newTestRunner(&RunConfig{Filter: test.filter},
+			"ATest::testFoo", "ATest::testBar", "BTest::testFoo", "CTest::testBaz")
+		if err := r.stepFilterTests(); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(test.want, selectedTests(r)); diff != "" {
+			t.Errorf("filter %q: tests mismatch (-want +have):\n%s", test.filter, diff)
+		}
+		// Files without the matching tests are not compiled.
+		if len(r.testFiles) != test.files {
+			t.Errorf("filter %q: %d test files are selected, want %d", test.filter, len(r.testFiles), test.files)
+		}
+	}
+
+	r := newTestRunner(&RunConfig{Filter: "("}, "ATest::testFoo")
+	if err := r.stepFilterTests(); err == nil {
+		t.Errorf("no error for an invalid filter")
+	}
+}
+
+func TestShuffleTestsSeedEvent(t *testing.T) {
+	var events bytes.Buffer
+	r := newTestRunner(&RunConfig{
+		Output:      ioutil.Discard,
+		Events:      event.NewEncoder(&events),
+		RandomOrder: true,
+		Seed:        42,
+	}, "FooTest::testA", "BarTest::testB")
+	if err := r.stepShuffleTests(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ev event.Event
+	if err := json.NewDecoder(&events).Decode(&ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Action != event.Seed || ev.Seed != 42 {
+		t.Errorf("event = %+v, want a seed event with seed 42", ev)
+	}
+}
+
+func TestShuffleTestsSameSeed(t *testing.T) {
+	tests := []string{
+		"ATest::testA1", "ATest::testA2", "ATest::testA3",
+		"BTest::testB1", "BTest::testB2",
+		"CTest::testC1", "CTest::testC2", "CTest::testC3", "CTest::testC4",
+		"DTest::testD1",
+	}
+	shuffled := func(seed int64) []string {
+		t.Helper()
+		r := newTestRunner(&RunConfig{Output: ioutil.Discard, RandomOrder: true, Seed: seed}, tests...)
+		if err := r.stepShuffleTests(); err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range r.testFiles {
+			if f.id != i {
+				t.Errorf("seed %d: file %s id is %d, want %d", seed, f.fullName, f.id, i)
+			}
+		}
+		return selectedTests(r)
+	}
+
+	first := shuffled(42)
+	if diff := cmp.Diff(first, shuffled(42)); diff != "" {
+		t.Errorf("the same seed gives a different order (-first +second):\n%s", diff)
+	}
+	if diff := cmp.Diff(tests, first, cmpopts.SortSlices(func(x, y string) bool { return x < y })); diff != "" {
+		t.Errorf("shuffled tests mismatch (-want +have):\n%s", diff)
+	}
+
+	// Some seed must change the order, otherwise nothing is shuffled.
+	changed := false
+	for seed := int64(1); seed <= 10 && !changed; seed++ {
+		changed = !cmp.Equal(tests, shuffled(seed))
+	}
+	if !changed {
+		t.Errorf("the tests order is the same for all seeds")
+	}
+}
@@ -0,0 +1,406 @@
+package phpunit
+
+// runtimeSource contains PHP functions that are shared by all generated test suites.
+//
+// The test protocol is a sequence of JSON arrays, one per line;
+// every array starts with an op name that is handled by parseTestOutput.
+// Events are written on their own lines prefixed by the event marker
+// that is given to the test main (see newEventMarker), so the tests can print anything.
+//
+// All assertions are implemented here (including the kphpunit ones,
+// which would print their results without the marker).
+// They throw an exception that is recognized by __kphpunit_is_assertion_failure.
+// markTestSkipped and markTestIncomplete interrupt the test the same way,
+// their exception is recognized by __kphpunit_is_test_mark.
+//
+// KPHP can't check instanceof against a class name stored in a variable,
+// so the exception expectations are matched by the exact class name here
+// and by the catch clauses generated for every test (see testSuiteTemplate).
+const runtimeSource = `<?php
+
+/**
+ * Writes a test protocol event, see parseTestOutput.
+ * The leading newline separates the event from the test output
+ * that doesn't end with a newline; it's not a part of the output.
+ * @param mixed[] $event
+ */
+function __kphpunit_event(array $event) {
+  global $__kphpunit_event_marker;
+  echo "\n" . $__kphpunit_event_marker . json_encode($event) . "\n";
+}
+
+/**
+ * Sets the event marker of the run, the test main gets it as the first argument.
+ */
+function __kphpunit_set_event_marker(string $marker) {
+  global $__kphpunit_event_marker;
+  $__kphpunit_event_marker = $marker;
+}
+
+// $only_test is the "Class::method" name of the only test to run,
+// an empty string selects all tests.
+function __kphpunit_class_selected(string $only_test, string $class): bool {
+  return $only_test === '' || strpos($only_test, $class . '::') === 0;
+}
+
+function __kphpunit_test_selected(string $only_test, string $class, string $method): bool {
+  return $only_test === '' || $only_test === $class . '::' . $method;
+}
+
+/** @param mixed $data_name */
+function __kphpunit_data_set_name(string $method, $data_name): string {
+  if (is_int($data_name)) {
+    return "$method with data set #$data_name";
+  }
+  return "$method with data set \"$data_name\"";
+}
+
+function __kphpunit_test_started(string $name): int {
+  global $__kphpunit_status, $__kphpunit_assertions, $__kphpunit_failure, $__kphpunit_mark;
+  $__kphpunit_status = '.';
+  $__kphpunit_assertions = 0;
+  $__kphpunit_failure = null;
+  $__kphpunit_mark = null;
+  __kphpunit_reset_expectations();
+  __kphpunit_event(['START', $name]);
+  return hrtime(true);
+}
+
+function __kphpunit_test_finished(string $name, int $start) {
+  global $__kphpunit_status, $__kphpunit_assertions;
+  // A passed test without assertions is risky, see parseTestOutput.
+  if ($__kphpunit_status === '.' && $__kphpunit_assertions === 0) {
+    $__kphpunit_status = 'R';
+  }
+  fprintf(STDERR, $__kphpunit_status);
+  __kphpunit_event(['END', $name, hrtime(true) - $start]);
+}
+
+function __kphpunit_set_status(string $status) {
+  global $__kphpunit_status;
+  if ($__kphpunit_status === '.' || $status === 'E') {
+    $__kphpunit_status = $status;
+  }
+}
+
+function __kphpunit_reset_expectations() {
+  global $__kphpunit_expected_exception, $__kphpunit_expected_message, $__kphpunit_expected_code, $__kphpunit_expectation_line;
+  $__kphpunit_expected_exception = '';
+  $__kphpunit_expected_message = null;
+  $__kphpunit_expected_code = null;
+  $__kphpunit_expectation_line = 0;
+}
+
+function __kphpunit_expect_exception(int $line, string $class) {
+  global $__kphpunit_expected_exception, $__kphpunit_expectation_line;
+  $__kphpunit_expected_exception = ltrim($class, '\\');
+  $__kphpunit_expectation_line = $line;
+}
+
+function __kphpunit_expect_exception_message(int $line, string $message) {
+  global $__kphpunit_expected_exception, $__kphpunit_expected_message, $__kphpunit_expectation_line;
+  if ($__kphpunit_expected_exception === '') {
+    $__kphpunit_expected_exception = 'Throwable';
+  }
+  $__kphpunit_expected_message = $message;
+  $__kphpunit_expectation_line = $line;
+}
+
+/** @param mixed $code */
+function __kphpunit_expect_exception_code(int $line, $code) {
+  global $__kphpunit_expected_exception, $__kphpunit_expected_code, $__kphpunit_expectation_line;
+  if ($__kphpunit_expected_exception === '') {
+    $__kphpunit_expected_exception = 'Throwable';
+  }
+  $__kphpunit_expected_code = $code;
+  $__kphpunit_expectation_line = $line;
+}
+
+function __kphpunit_assertion_passed() {
+  global $__kphpunit_assertions;
+  $__kphpunit_assertions++;
+  __kphpunit_event(['ASSERT_OK']);
+}
+
+function __kphpunit_assertion_failed() {
+  __kphpunit_reset_expectations();
+  __kphpunit_set_status('F');
+}
+
+// __kphpunit_test_returned is called when the test method returns without exceptions.
+function __kphpunit_test_returned() {
+  global $__kphpunit_expected_exception, $__kphpunit_expectation_line;
+  if ($__kphpunit_expected_exception !== '') {
+    __kphpunit_event(['EXCEPTION_NOT_THROWN', $__kphpunit_expected_exception, $__kphpunit_expectation_line]);
+    __kphpunit_set_status('F');
+  }
+  __kphpunit_reset_expectations();
+}
+
+// __kphpunit_expected_exception_caught is called from the catch clause
+// generated for the $expected_class exception expectation.
+function __kphpunit_expected_exception_caught(\Throwable $e, string $expected_class) {
+  global $__kphpunit_expected_exception;
+  if ($__kphpunit_expected_exception !== $expected_class || __kphpunit_is_assertion_failure($e) || __kphpunit_is_test_mark($e)) {
+    __kphpunit_exception_thrown($e);
+    return;
+  }
+  __kphpunit_assertion_passed();
+  __kphpunit_check_exception_details($e);
+}
+
+function __kphpunit_exception_thrown(\Throwable $e) {
+  global $__kphpunit_expected_exception, $__kphpunit_expectation_line;
+  if (__kphpunit_is_assertion_failure($e)) {
+    __kphpunit_assertion_failed();
+    return;
+  }
+  if (__kphpunit_is_test_mark($e)) {
+    __kphpunit_reset_expectations();
+    return;
+  }
+  $expected = $__kphpunit_expected_exception;
+  if ($expected === '') {
+    __kphpunit_event(['ERROR', get_class($e), $e->getMessage(), $e->getFile(), $e->getLine()]);
+    __kphpunit_set_status('E');
+    return;
+  }
+  if ($expected !== 'Throwable' && $expected !== get_class($e)) {
+    __kphpunit_event(['EXCEPTION_MISMATCH', $expected, get_class($e), $e->getMessage(), $__kphpunit_expectation_line]);
+    __kphpunit_assertion_failed();
+    return;
+  }
+  __kphpunit_assertion_passed();
+  __kphpunit_check_exception_details($e);
+}
+
+function __kphpunit_check_exception_details(\Throwable $e) {
+  global $__kphpunit_expected_message, $__kphpunit_expected_code, $__kphpunit_expectation_line;
+  $message = $__kphpunit_expected_message;
+  $code = $__kphpunit_expected_code;
+  $line = $__kphpunit_expectation_line;
+  __kphpunit_reset_expectations();
+  if ($message !== null) {
+    if (strpos($e->getMessage(), $message) === false) {
+      __kphpunit_event(['EXCEPTION_MESSAGE_FAILED', $message, $e->getMessage(), $line]);
+      __kphpunit_set_status('F');
+      return;
+    }
+    __kphpunit_assertion_passed();
+  }
+  if ($code !== null) {
+    if ($e->getCode() != $code) {
+      __kphpunit_event(['EXCEPTION_CODE_FAILED', $code, $e->getCode(), $line]);
+      __kphpunit_set_status('F');
+      return;
+    }
+    __kphpunit_assertion_passed();
+  }
+}
+
+function __kphpunit_is_assertion_failure(\Throwable $e): bool {
+  global $__kphpunit_failure;
+  return $__kphpunit_failure !== null && $__kphpunit_failure === $e;
+}
+
+function __kphpunit_is_test_mark(\Throwable $e): bool {
+  global $__kphpunit_mark;
+  return $__kphpunit_mark !== null && $__kphpunit_mark === $e;
+}
+
+function __kphpunit_mark_test_skipped(int $line, string $message = '') {
+  __kphpunit_mark_test('SKIPPED', 'S', $message, $line);
+}
+
+function __kphpunit_mark_test_incomplete(int $line, string $message = '') {
+  __kphpunit_mark_test('INCOMPLETE', 'I', $message, $line);
+}
+
+function __kphpunit_mark_test(string $op, string $status, string $message, int $line) {
+  global $__kphpunit_mark;
+  __kphpunit_event([$op, $message, $line]);
+  __kphpunit_set_status($status);
+  $__kphpunit_mark = new \Exception('kphpunit test marked as ' . strtolower($op));
+  throw $__kphpunit_mark;
+}
+
+/** @param mixed[] $failure */
+function __kphpunit_assert(bool $ok, array $failure) {
+  global $__kphpunit_failure;
+  if ($ok) {
+    __kphpunit_assertion_passed();
+    return;
+  }
+  __kphpunit_event($failure);
+  $__kphpunit_failure = new \Exception('kphpunit assertion failed');
+  throw $__kphpunit_failure;
+}
+
+function __kphpunit_fail(int $line, string $message = '') {
+  __kphpunit_assert(false, ['FAIL', $message, $line]);
+}
+
+/** @param mixed $actual */
+function __kphpunit_assert_true(int $line, $actual, string $message = '') {
+  __kphpunit_assert($actual === true, ['ASSERT_BOOL_FAILED', 'true', $actual, $message, $line]);
+}
+
+/** @param mixed $actual */
+function __kphpunit_assert_false(int $line, $actual, string $message = '') {
+  __kphpunit_assert($actual === false, ['ASSERT_BOOL_FAILED', 'false', $actual, $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_same(int $line, $expected, $actual, string $message = '') {
+  __kphpunit_assert($expected === $actual, ['ASSERT_SAME_FAILED', $expected, $actual, $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_not_same(int $line, $expected, $actual, string $message = '') {
+  __kphpunit_assert($expected !== $actual, ['ASSERT_NOT_SAME_FAILED', $expected, $actual, $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_equals(int $line, $expected, $actual, string $message = '') {
+  __kphpunit_assert($expected == $actual, ['ASSERT_EQUALS_FAILED', $expected, $actual, $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_not_equals(int $line, $expected, $actual, string $message = '') {
+  __kphpunit_assert($expected != $actual, ['ASSERT_NOT_EQUALS_FAILED', $expected, $actual, $message, $line]);
+}
+
+/** @param mixed $haystack */
+function __kphpunit_assert_count(int $line, int $expected, $haystack, string $message = '') {
+  $actual = count($haystack);
+  __kphpunit_assert($actual === $expected, ['ASSERT_COUNT_FAILED', $expected, $actual, $message, $line]);
+}
+
+/** @param mixed $haystack */
+function __kphpunit_assert_not_count(int $line, int $expected, $haystack, string $message = '') {
+  $actual = count($haystack);
+  __kphpunit_assert($actual !== $expected, ['ASSERT_NOT_COUNT_FAILED', $expected, $actual, $message, $line]);
+}
+
+function __kphpunit_assert_null(int $line, bool $is_null, string $message = '') {
+  __kphpunit_assert($is_null, ['ASSERT_NULL_FAILED', $message, $line]);
+}
+
+function __kphpunit_assert_not_null(int $line, bool $is_null, string $message = '') {
+  __kphpunit_assert(!$is_null, ['ASSERT_NOT_NULL_FAILED', $message, $line]);
+}
+
+/** @param mixed $actual */
+function __kphpunit_assert_empty(int $line, $actual, string $message = '') {
+  __kphpunit_assert(empty($actual), ['ASSERT_EMPTY_FAILED', $actual, $message, $line]);
+}
+
+/** @param mixed $actual */
+function __kphpunit_assert_not_empty(int $line, $actual, string $message = '') {
+  __kphpunit_assert(!empty($actual), ['ASSERT_NOT_EMPTY_FAILED', $actual, $message, $line]);
+}
+
+/** @param mixed $needle */
+function __kphpunit_assert_contains(int $line, $needle, array $haystack, string $message = '') {
+  __kphpunit_assert(in_array($needle, $haystack, true), ['ASSERT_CONTAINS_FAILED', $needle, $message, $line]);
+}
+
+/** @param mixed $needle */
+function __kphpunit_assert_not_contains(int $line, $needle, array $haystack, string $message = '') {
+  __kphpunit_assert(!in_array($needle, $haystack, true), ['ASSERT_NOT_CONTAINS_FAILED', $needle, $message, $line]);
+}
+
+/** @param mixed $key */
+function __kphpunit_assert_array_has_key(int $line, $key, array $array, string $message = '') {
+  __kphpunit_assert(array_key_exists($key, $array), ['ASSERT_ARRAY_HAS_KEY_FAILED', $key, $message, $line]);
+}
+
+/** @param mixed $key */
+function __kphpunit_assert_array_not_has_key(int $line, $key, array $array, string $message = '') {
+  __kphpunit_assert(!array_key_exists($key, $array), ['ASSERT_ARRAY_NOT_HAS_KEY_FAILED', $key, $message, $line]);
+}
+
+function __kphpunit_assert_string_contains_string(int $line, string $needle, string $haystack, string $message = '') {
+  $ok = $needle === '' || strpos($haystack, $needle) !== false;
+  __kphpunit_assert($ok, ['ASSERT_STRING_CONTAINS_FAILED', $needle, $haystack, $message, $line]);
+}
+
+function __kphpunit_assert_string_not_contains_string(int $line, string $needle, string $haystack, string $message = '') {
+  $ok = $needle !== '' && strpos($haystack, $needle) === false;
+  __kphpunit_assert($ok, ['ASSERT_STRING_NOT_CONTAINS_FAILED', $needle, $haystack, $message, $line]);
+}
+
+function __kphpunit_assert_string_starts_with(int $line, string $prefix, string $string, string $message = '') {
+  $ok = substr($string, 0, strlen($prefix)) === $prefix;
+  __kphpunit_assert($ok, ['ASSERT_STRING_STARTS_WITH_FAILED', $prefix, $string, $message, $line]);
+}
+
+function __kphpunit_assert_string_ends_with(int $line, string $suffix, string $string, string $message = '') {
+  $ok = $suffix === '' || substr($string, -strlen($suffix)) === $suffix;
+  __kphpunit_assert($ok, ['ASSERT_STRING_ENDS_WITH_FAILED', $suffix, $string, $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_equals_with_delta(int $line, $expected, $actual, float $delta, string $message = '') {
+  $ok = abs((float)$expected - (float)$actual) <= $delta;
+  __kphpunit_assert($ok, ['ASSERT_EQUALS_WITH_DELTA_FAILED', $expected, $actual, $delta, $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_greater_than(int $line, $expected, $actual, string $message = '') {
+  __kphpunit_assert($actual > $expected, ['ASSERT_COMPARISON_FAILED', $expected, $actual, 'greater than', $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_greater_than_or_equal(int $line, $expected, $actual, string $message = '') {
+  __kphpunit_assert($actual >= $expected, ['ASSERT_COMPARISON_FAILED', $expected, $actual, 'greater than or equal', $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_less_than(int $line, $expected, $actual, string $message = '') {
+  __kphpunit_assert($actual < $expected, ['ASSERT_COMPARISON_FAILED', $expected, $actual, 'less than', $message, $line]);
+}
+
+/**
+ * @param mixed $expected
+ * @param mixed $actual
+ */
+function __kphpunit_assert_less_than_or_equal(int $line, $expected, $actual, string $message = '') {
+  __kphpunit_assert($actual <= $expected, ['ASSERT_COMPARISON_FAILED', $expected, $actual, 'less than or equal', $message, $line]);
+}
+
+/** @param mixed $actual */
+function __kphpunit_assert_type(int $line, string $type, $actual, string $message = '') {
+  $actual_type = gettype($actual);
+  $ok = $actual_type === $type || ($type === 'float' && $actual_type === 'double') || ($type === 'int' && $actual_type === 'integer') || ($type === 'bool' && $actual_type === 'boolean');
+  __kphpunit_assert($ok, ['ASSERT_TYPE_FAILED', $type, $actual, $message, $line]);
+}
+
+function __kphpunit_assert_instance_of(int $line, string $class, bool $is_instance, string $message = '') {
+  __kphpunit_assert($is_instance, ['ASSERT_INSTANCE_OF_FAILED', $class, $message, $line]);
+}
+`
@@ -0,0 +1,51 @@
+<?php
+
+use PHPUnit\Framework\TestCase;
+
+class AssertionsTest extends TestCase {
+    public function testPassing() {
+        $this->assertCount(2, [1, 2]);
+        $this->assertNotCount(3, [1, 2]);
+        $this->assertEmpty([]);
+        $this->assertNotEmpty('x');
+        $this->assertNull(null);
+        $this->assertNotNull(new Exception());
+        $this->assertContains(2, [1, 2, 3]);
+        $this->assertNotContains('2', [1, 2, 3]);
+        $this->assertArrayHasKey('a', ['a' => 1]);
+        $this->assertArrayNotHasKey('b', ['a' => 1]);
+        $this->assertStringContainsString('ell', 'hello');
+        $this->assertStringNotContainsString('x', 'hello');
+        $this->assertStringStartsWith('he', 'hello');
+        $this->assertStringEndsWith('lo', 'hello');
+        $this->assertEqualsWithDelta(1.0, 1.05, 0.1);
+        $this->assertGreaterThan(1, 2);
+        $this->assertGreaterThanOrEqual(2, 2);
+        $this->assertLessThan(2, 1);
+        $this->assertLessThanOrEqual(2, 2);
+        $this->assertIsArray([]);
+        $this->assertIsInt(1);
+        $this->assertIsString('s');
+        $this->assertInstanceOf(LogicException::class, new InvalidArgumentException());
+    }
+
+    public function testCount() {
+        $this->assertCount(3, [1, 2], 'wrong count');
+    }
+
+    public function testArrayHasKey() {
+        $this->assertArrayHasKey('b', ['a' => 1]);
+    }
+
+    public function testStringContains() {
+        $this->assertStringContainsString('world', 'hello');
+    }
+
+    public function testGreaterThanOrEqual() {
+        $this->assertGreaterThanOrEqual(3, 2);
+    }
+
+    public function testInstanceOf() {
+        $this->assertInstanceOf(RuntimeException::class, new LogicException());
+    }
+}
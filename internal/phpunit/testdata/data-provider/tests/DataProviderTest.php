@@ -0,0 +1,20 @@
+<?php
+
+use PHPUnit\Framework\TestCase;
+
+class DataProviderTest extends TestCase {
+    /**
+     * @dataProvider provideSums
+     */
+    public function testSum(int $x, int $y, int $expected) {
+        $this->assertSame($expected, $x + $y);
+    }
+
+    public function provideSums() {
+        return [
+            [1, 2, 3],
+            [2, 2, 4],
+            'broken' => [1, 1, 3],
+        ];
+    }
+}
@@ -0,0 +1,36 @@
+<?php
+
+use PHPUnit\Framework\TestCase;
+
+class ExceptionsTest extends TestCase {
+    public function testExpected() {
+        $this->expectException(InvalidArgumentException::class);
+        $this->expectExceptionMessage('bad');
+        throw new InvalidArgumentException('bad argument');
+    }
+
+    public function testExpectedParent() {
+        $this->expectException(LogicException::class);
+        throw new InvalidArgumentException('subclass');
+    }
+
+    public function testNotThrown() {
+        $this->expectException(RuntimeException::class);
+    }
+
+    public function testWrongMessage() {
+        $this->expectExceptionMessage('expected');
+        throw new RuntimeException('actual message');
+    }
+
+    public function testCode() {
+        $this->expectException(RuntimeException::class);
+        $this->expectExceptionCode(42);
+        throw new RuntimeException('with code', 42);
+    }
+
+    public function testUncaught() {
+        $this->assertTrue(true);
+        throw new RuntimeException('unexpected');
+    }
+}
@@ -0,0 +1,7 @@
+<?php
+
+namespace Mocks;
+
+interface Clock {
+    public function hour(): int;
+}
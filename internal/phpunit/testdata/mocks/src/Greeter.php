@@ -0,0 +1,23 @@
+<?php
+
+namespace Mocks;
+
+class Greeter {
+    /** @var Clock */
+    private $clock;
+
+    public function __construct(Clock $clock) {
+        $this->clock = $clock;
+    }
+
+    public function greet(): string {
+        $hour = $this->clock->hour();
+        if ($hour < 6) {
+            return 'Good night';
+        }
+        if ($hour < 12) {
+            return 'Good morning';
+        }
+        return 'Good day';
+    }
+}
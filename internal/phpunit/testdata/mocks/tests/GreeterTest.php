@@ -0,0 +1,27 @@
+<?php
+
+use Mocks\Clock;
+use Mocks\Greeter;
+use PHPUnit\Framework\TestCase;
+
+class GreeterTest extends TestCase {
+    public function testStub() {
+        $clock = $this->createStub(Clock::class);
+        $clock->method('hour')->willReturn(9);
+        $greeter = new Greeter($clock);
+        $this->assertSame('Good morning', $greeter->greet());
+    }
+
+    public function testDefaultReturnValue() {
+        $clock = $this->createMock(Clock::class);
+        $greeter = new Greeter($clock);
+        $this->assertSame('Good night', $greeter->greet());
+    }
+
+    public function testException() {
+        $clock = $this->createMock(Clock::class);
+        $clock->method('hour')->willThrowException(new RuntimeException('no clock'));
+        $this->expectException(RuntimeException::class);
+        (new Greeter($clock))->greet();
+    }
+}
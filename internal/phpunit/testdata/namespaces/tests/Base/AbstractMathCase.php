@@ -0,0 +1,22 @@
+<?php
+
+namespace App\Tests\Base;
+
+use PHPUnit\Framework\TestCase;
+
+abstract class AbstractMathCase extends TestCase {
+    /** @var int */
+    protected $zero = -1;
+
+    protected function setUp(): void {
+        $this->zero = 0;
+    }
+
+    public function testZero() {
+        $this->assertSame(0, $this->zero);
+    }
+
+    public function testOverridden() {
+        $this->fail('parent method should not be called');
+    }
+}
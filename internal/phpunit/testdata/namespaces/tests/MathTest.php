@@ -0,0 +1,23 @@
+<?php
+
+namespace App\Tests;
+
+use App\Tests\Base\AbstractMathCase;
+
+class MathTest extends AbstractMathCase {
+    public function testOverridden() {
+        $this->assertSame(2, 1 + 1);
+    }
+}
+
+abstract class AbstractStringCase extends \PHPUnit\Framework\TestCase {
+    public function testConcat() {
+        $this->assertSame('ab', 'a' . 'b');
+    }
+}
+
+class StringTest extends AbstractStringCase {
+    public function testLength() {
+        $this->assertSame(3, strlen('abc'));
+    }
+}
@@ -0,0 +1,39 @@
+<?php
+
+use PHPUnit\Framework\TestCase;
+
+class SetUpTest extends TestCase {
+    /** @var string[] */
+    private $items = [];
+
+    /** @var string[] */
+    private static $tearDowns = [];
+
+    protected function setUp() {
+        $this->items[] = 'setUp';
+    }
+
+    protected function tearDown() {
+        self::$tearDowns[] = 'tearDown';
+    }
+
+    /** @before */
+    protected function addBefore() {
+        $this->items[] = 'before';
+    }
+
+    public function testFirst() {
+        $this->items[] = 'first';
+        $this->assertSame(['before', 'setUp', 'first'], $this->items);
+    }
+
+    public function testSecond() {
+        $this->assertSame(['before', 'setUp'], $this->items);
+        $this->assertSame(1, count(self::$tearDowns));
+        $this->fail('always fails');
+    }
+
+    public function testThird() {
+        $this->assertSame(2, count(self::$tearDowns));
+    }
+}
@@ -0,0 +1,23 @@
+<?php
+
+use PHPUnit\Framework\TestCase;
+
+class SkippedTest extends TestCase {
+    public function testSkipped() {
+        $this->markTestSkipped('no database');
+        $this->fail('unreachable');
+    }
+
+    public function testIncomplete() {
+        $this->assertTrue(true);
+        $this->markTestIncomplete();
+    }
+
+    public function testNothing() {
+        $sum = 1 + 1;
+    }
+
+    public function testPassed() {
+        $this->assertSame(2, 1 + 1);
+    }
+}
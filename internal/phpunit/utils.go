@@ -1,12 +1,19 @@
 package phpunit
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
 
+	"github.com/VKCOM/ktest/internal/phpsyntax"
 	"github.com/z7zmey/php-parser/pkg/ast"
+	"github.com/z7zmey/php-parser/pkg/token"
 )
 
 func astNameToString(name *ast.Name) string {
@@ -17,9 +24,215 @@ func astNameToString(name *ast.Name) string {
 	return strings.Join(parts, `\`)
 }
 
+// stringLiteral returns the contents of a simple quoted string literal argument.
+// An empty string is returned for any other expression.
+func stringLiteral(arg ast.Vertex) string {
+	if a, ok := arg.(*ast.Argument); ok {
+		arg = a.Expr
+	}
+	lit, ok := arg.(*ast.ScalarString)
+	if !ok || len(lit.Value) < 2 {
+		return ""
+	}
+	return string(lit.Value[1 : len(lit.Value)-1])
+}
+
+func hasModifier(modifiers []ast.Vertex, name string) bool {
+	for _, m := range modifiers {
+		ident, ok := m.(*ast.Identifier)
+		if ok && strings.EqualFold(string(ident.Value), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// classMethodTags returns the method doc comment tags merged with
+// the PHPUnit attributes, like #[DataProvider('provideValues')].
+func classMethodTags(n *ast.StmtClassMethod, attrs []phpsyntax.Attribute) map[string][]string {
+	tkn := n.FunctionTkn
+	if len(n.Modifiers) != 0 {
+		if ident, ok := n.Modifiers[0].(*ast.Identifier); ok {
+			tkn = ident.IdentifierTkn
+		}
+	}
+	return declTags(tkn, attrs)
+}
+
+// classTags returns the class doc comment tags merged with the PHPUnit attributes.
+func classTags(n *ast.StmtClass, attrs []phpsyntax.Attribute) map[string][]string {
+	tkn := n.ClassTkn
+	if len(n.Modifiers) != 0 {
+		if ident, ok := n.Modifiers[0].(*ast.Identifier); ok {
+			tkn = ident.IdentifierTkn
+		}
+	}
+	return declTags(tkn, attrs)
+}
+
+// declTags returns the tags of the declaration that starts with tkn.
+// The attributes are masked before parsing (see phpsyntax.MaskAttributes),
+// so the declaration attributes are the ones inside the whitespace before tkn.
+func declTags(tkn *token.Token, attrs []phpsyntax.Attribute) map[string][]string {
+	tags := parseDocTags(docComment(tkn))
+	if tkn == nil || tkn.Position == nil || len(tkn.FreeFloating) == 0 {
+		return tags
+	}
+	start := tkn.FreeFloating[0].Position.StartPos
+	for _, attr := range attrs {
+		if attr.Start >= start && attr.End <= tkn.Position.StartPos {
+			parseAttributeTags(attr.Text, tags)
+		}
+	}
+	return tags
+}
+
+// docComment returns the last doc comment that precedes the token.
+func docComment(tkn *token.Token) string {
+	if tkn == nil {
+		return ""
+	}
+	comment := ""
+	for _, ff := range tkn.FreeFloating {
+		if ff.ID == token.T_DOC_COMMENT {
+			comment = string(ff.Value)
+		}
+	}
+	return comment
+}
+
+// parseDocTags collects the doc comment tag values, like "@dataProvider provideValues".
+func parseDocTags(comment string) map[string][]string {
+	tags := make(map[string][]string)
+	for _, line := range strings.Split(comment, "\n") {
+		line = strings.TrimSpace(line)
+		line = strings.TrimPrefix(line, "/**")
+		line = strings.TrimSuffix(line, "*/")
+		line = strings.TrimSpace(strings.TrimPrefix(line, "*"))
+		if !strings.HasPrefix(line, "@") {
+			continue
+		}
+		fields := strings.Fields(line[len("@"):])
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			value = fields[1]
+		}
+		tags[fields[0]] = append(tags[fields[0]], value)
+	}
+	return tags
+}
+
+// attributeTags maps the PHPUnit attributes to the equivalent doc comment tags.
+var attributeTags = map[string]string{
+	"test":         "test",
+	"dataprovider": "dataProvider",
+	"group":        "group",
+	"before":       "before",
+	"after":        "after",
+	"small":        "small",
+	"medium":       "medium",
+	"large":        "large",
+}
+
+// parseAttributeTags adds the known attributes from the "#[A, B('x')]" group to the tags.
+// Only the first attribute argument is used; it should be a string literal.
+func parseAttributeTags(group string, tags map[string][]string) {
+	group = strings.TrimSpace(group)
+	group = strings.TrimSuffix(strings.TrimPrefix(group, "#["), "]")
+	for _, attr := range splitAttributes(group) {
+		name := attr
+		value := ""
+		if i := strings.IndexByte(attr, '('); i != -1 {
+			name = attr[:i]
+			args := splitAttributes(strings.TrimSuffix(strings.TrimSpace(attr[i+1:]), ")"))
+			if len(args) != 0 {
+				value = strings.Trim(trimNamedArg(args[0]), `'"`)
+			}
+		}
+		name = strings.TrimSpace(name)
+		if i := strings.LastIndexByte(name, '\\'); i != -1 {
+			name = name[i+1:]
+		}
+		if tag, ok := attributeTags[strings.ToLower(name)]; ok {
+			tags[tag] = append(tags[tag], value)
+		}
+	}
+}
+
+// trimNamedArg removes the "name:" prefix of a named argument.
+func trimNamedArg(arg string) string {
+	i := strings.IndexByte(arg, ':')
+	if i <= 0 || strings.HasPrefix(arg[i:], "::") {
+		return arg
+	}
+	for _, c := range arg[:i] {
+		if c != '_' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return arg
+		}
+	}
+	return strings.TrimSpace(arg[i+1:])
+}
+
+// splitAttributes splits the attribute group (or the argument list)
+// by the commas outside of the nested parentheses and string literals.
+func splitAttributes(group string) []string {
+	var attrs []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(group); i++ {
+		c := group[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			attrs = append(attrs, strings.TrimSpace(group[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(group[start:]); last != "" {
+		attrs = append(attrs, last)
+	}
+	return attrs
+}
+
+// paramCast returns a PHP type cast for the scalar parameter type, if any.
+func paramCast(v ast.Vertex) string {
+	p, ok := v.(*ast.Parameter)
+	if !ok {
+		return ""
+	}
+	typeName, ok := p.Type.(*ast.Name)
+	if !ok {
+		return ""
+	}
+	switch t := strings.ToLower(astNameToString(typeName)); t {
+	case "int", "float", "string", "bool", "array":
+		return "(" + t + ")"
+	default:
+		return ""
+	}
+}
+
 type testFiles struct {
 	scripts  []string
 	testdata []string
+
+	// support are other PHP files, like abstract test cases and helpers.
+	support []string
 }
 
 func findTestFiles(root string) (testFiles, error) {
@@ -37,6 +250,8 @@ func findTestFiles(root string) (testFiles, error) {
 		}
 		if strings.HasSuffix(info.Name(), "Test.php") {
 			out.scripts = append(out.scripts, path)
+		} else if strings.HasSuffix(info.Name(), ".php") && !isTestdataPath(root, path) {
+			out.support = append(out.support, path)
 		}
 		return nil
 	})
@@ -47,6 +262,16 @@ func findTestFiles(root string) (testFiles, error) {
 	return out, nil
 }
 
+// isTestdataPath reports whether the path is inside a testdata dir of the root.
+// The root itself can be inside testdata (like the ktest own test projects).
+func isTestdataPath(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return strings.Contains("/"+filepath.ToSlash(rel), "/testdata/")
+}
+
 func jsonString(v interface{}) string {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -54,3 +279,91 @@ func jsonString(v interface{}) string {
 	}
 	return string(b)
 }
+
+// jsonObject is a decoded JSON object that preserves the keys order,
+// so the PHP associative arrays are printed in the same order as they were defined.
+type jsonObject []jsonObjectField
+
+type jsonObjectField struct {
+	Key   string
+	Value interface{}
+}
+
+func (obj jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range obj {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// unmarshalJSONArray is like json.Unmarshal into []interface{},
+// but the objects are decoded as jsonObject.
+func unmarshalJSONArray(data []byte, out *[]interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+	array, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected a JSON array, found %s", jsonString(v))
+	}
+	*out = array
+	return nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('['):
+		array := []interface{}{}
+		for dec.More() {
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+		_, err := dec.Token()
+		return array, err
+	case json.Delim('{'):
+		obj := jsonObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, jsonObjectField{Key: key.(string), Value: v})
+		}
+		_, err := dec.Token()
+		return obj, err
+	default:
+		return tok, nil
+	}
+}
@@ -0,0 +1,43 @@
+package phpunit
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAttributeTags(t *testing.T) {
+	tests := []struct {
+		comment string
+		want    map[string][]string
+	}{
+		{
+			comment: `#[Test]`,
+			want:    map[string][]string{"test": {""}},
+		},
+		{
+			comment: `#[DataProvider('provideValues')]`,
+			want:    map[string][]string{"dataProvider": {"provideValues"}},
+		},
+		{
+			comment: `#[\PHPUnit\Framework\Attributes\Group("slow"), Test, Depends('testA')]`,
+			want:    map[string][]string{"group": {"slow"}, "test": {""}},
+		},
+		{
+			comment: `#[Group('a, b'), Group('c')]`,
+			want:    map[string][]string{"group": {"a, b", "c"}},
+		},
+		{
+			comment: "#[\n    DataProvider(methodName: 'provideValues'),\n    Group(Groups::SLOW),\n]",
+			want:    map[string][]string{"dataProvider": {"provideValues"}, "group": {"Groups::SLOW"}},
+		},
+	}
+
+	for _, test := range tests {
+		have := make(map[string][]string)
+		parseAttributeTags(test.comment, have)
+		if diff := cmp.Diff(test.want, have); diff != "" {
+			t.Errorf("parseAttributeTags(%q) mismatch (-want +have):\n%s", test.comment, diff)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package phpunit
+
+import (
+	"fmt"
+)
+
+// compareTestResults returns the tests that have different
+// pass/fail status, assertions count or failure reason.
+func compareTestResults(php, kphp *testFileResult) []TestMismatch {
+	var mismatches []TestMismatch
+
+	testKey := func(test *TestResult) string {
+		return test.Class + "::" + test.Name
+	}
+	phpTests := make(map[string]*TestResult, len(php.tests))
+	for i := range php.tests {
+		phpTests[testKey(&php.tests[i])] = &php.tests[i]
+	}
+	kphpTests := make(map[string]*TestResult, len(kphp.tests))
+	for i := range kphp.tests {
+		kphpTests[testKey(&kphp.tests[i])] = &kphp.tests[i]
+	}
+
+	addMismatch := func(test *TestResult, phpTest, kphpTest *TestResult) {
+		mismatches = append(mismatches, TestMismatch{
+			Name: test.Class + "::" + test.Name,
+			File: test.File,
+			PHP:  testVerdict(phpTest),
+			KPHP: testVerdict(kphpTest),
+		})
+	}
+
+	for i := range kphp.tests {
+		kphpTest := &kphp.tests[i]
+		phpTest := phpTests[testKey(kphpTest)]
+		if phpTest == nil || !sameVerdict(phpTest, kphpTest) {
+			addMismatch(kphpTest, phpTest, kphpTest)
+		}
+	}
+	for i := range php.tests {
+		phpTest := &php.tests[i]
+		if kphpTests[testKey(phpTest)] == nil {
+			addMismatch(phpTest, phpTest, nil)
+		}
+	}
+
+	return mismatches
+}
+
+// compareWithFileError reports every PHP test as a mismatch
+// when the KPHP test file failed to build or run.
+func compareWithFileError(php *testFileResult, fileErr FileError) []TestMismatch {
+	mismatches := make([]TestMismatch, 0, len(php.tests))
+	for i := range php.tests {
+		phpTest := &php.tests[i]
+		mismatches = append(mismatches, TestMismatch{
+			Name: phpTest.Class + "::" + phpTest.Name,
+			File: phpTest.File,
+			PHP:  testVerdict(phpTest),
+			KPHP: fmt.Sprintf("FILE ERROR (%s)", fileErr.Kind),
+		})
+	}
+	return mismatches
+}
+
+func sameVerdict(x, y *TestResult) bool {
+	if x.Assertions != y.Assertions {
+		return false
+	}
+	if (x.Skipped != nil) != (y.Skipped != nil) || (x.Incomplete != nil) != (y.Incomplete != nil) {
+		return false
+	}
+	if x.Error != nil || y.Error != nil {
+		return x.Error != nil && y.Error != nil && x.Error.Message == y.Error.Message
+	}
+	if x.Failure == nil || y.Failure == nil {
+		return x.Failure == nil && y.Failure == nil
+	}
+	return x.Failure.Reason == y.Failure.Reason &&
+		x.Failure.Message == y.Failure.Message &&
+		x.Failure.Line == y.Failure.Line
+}
+
+func testVerdict(test *TestResult) string {
+	if test == nil {
+		return "not executed"
+	}
+	assertions := "1 assertion"
+	if test.Assertions != 1 {
+		assertions = fmt.Sprintf("%d assertions", test.Assertions)
+	}
+	if test.Error != nil {
+		return fmt.Sprintf("ERROR (%s) at %s:%d: %s", assertions, test.Error.File, test.Error.Line, test.Error.Message)
+	}
+	if test.Skipped != nil {
+		return fmt.Sprintf("SKIPPED (%s) at line %d: %s", assertions, test.Skipped.Line, test.Skipped.Message)
+	}
+	if test.Incomplete != nil {
+		return fmt.Sprintf("INCOMPLETE (%s) at line %d: %s", assertions, test.Incomplete.Line, test.Incomplete.Message)
+	}
+	if test.Failure == nil {
+		return fmt.Sprintf("OK (%s)", assertions)
+	}
+	return fmt.Sprintf("FAIL (%s) at line %d: %s", assertions, test.Failure.Line, failureMessage(test.Failure))
+}
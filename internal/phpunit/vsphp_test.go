@@ -0,0 +1,133 @@
+package phpunit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompareTestResults(t *testing.T) {
+	pass := TestResult{Class: "FooTest", Name: "testFoo", File: "/tests/FooTest.php", Assertions: 2}
+	withFailure := func(test TestResult, reason string) TestResult {
+		test.Failure = &TestFailure{Reason: reason, Line: 10}
+		return test
+	}
+	withError := func(test TestResult, message string) TestResult {
+		test.Error = &TestFailure{Message: message, File: "/tests/FooTest.php", Line: 12}
+		return test
+	}
+	withAssertions := func(test TestResult, n int) TestResult {
+		test.Assertions = n
+		return test
+	}
+	skipped := pass
+	skipped.Skipped = &TestFailure{Message: "no database", Line: 7}
+
+	tests := []struct {
+		name string
+		php  []TestResult
+		kphp []TestResult
+		want []TestMismatch
+	}{
+		{
+			name: "same pass",
+			php:  []TestResult{pass},
+			kphp: []TestResult{pass},
+		},
+		{
+			name: "same failure",
+			php:  []TestResult{withFailure(pass, "Failed asserting that false is true")},
+			kphp: []TestResult{withFailure(pass, "Failed asserting that false is true")},
+		},
+		{
+			name: "status",
+			php:  []TestResult{pass},
+			kphp: []TestResult{withFailure(pass, "Failed asserting that false is true")},
+			want: []TestMismatch{{
+				Name: "FooTest::testFoo",
+				File: "/tests/FooTest.php",
+				PHP:  "OK (2 assertions)",
+				KPHP: "FAIL (2 assertions) at line 10: Failed asserting that false is true",
+			}},
+		},
+		{
+			name: "assertions count",
+			php:  []TestResult{pass},
+			kphp: []TestResult{withAssertions(pass, 1)},
+			want: []TestMismatch{{
+				Name: "FooTest::testFoo",
+				File: "/tests/FooTest.php",
+				PHP:  "OK (2 assertions)",
+				KPHP: "OK (1 assertion)",
+			}},
+		},
+		{
+			name: "failure reason",
+			php:  []TestResult{withFailure(pass, "Failed asserting that 1.0 is identical to 1")},
+			kphp: []TestResult{withFailure(pass, "Failed asserting that 1 is identical to 1")},
+			want: []TestMismatch{{
+				Name: "FooTest::testFoo",
+				File: "/tests/FooTest.php",
+				PHP:  "FAIL (2 assertions) at line 10: Failed asserting that 1.0 is identical to 1",
+				KPHP: "FAIL (2 assertions) at line 10: Failed asserting that 1 is identical to 1",
+			}},
+		},
+		{
+			name: "error message",
+			php:  []TestResult{withError(pass, "Exception: a")},
+			kphp: []TestResult{withError(pass, "Exception: b")},
+			want: []TestMismatch{{
+				Name: "FooTest::testFoo",
+				File: "/tests/FooTest.php",
+				PHP:  "ERROR (2 assertions) at /tests/FooTest.php:12: Exception: a",
+				KPHP: "ERROR (2 assertions) at /tests/FooTest.php:12: Exception: b",
+			}},
+		},
+		{
+			name: "skipped",
+			php:  []TestResult{skipped},
+			kphp: []TestResult{pass},
+			want: []TestMismatch{{
+				Name: "FooTest::testFoo",
+				File: "/tests/FooTest.php",
+				PHP:  "SKIPPED (2 assertions) at line 7: no database",
+				KPHP: "OK (2 assertions)",
+			}},
+		},
+		{
+			name: "not executed",
+			php:  []TestResult{pass},
+			want: []TestMismatch{{
+				Name: "FooTest::testFoo",
+				File: "/tests/FooTest.php",
+				PHP:  "OK (2 assertions)",
+				KPHP: "not executed",
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		have := compareTestResults(&testFileResult{tests: test.php}, &testFileResult{tests: test.kphp})
+		if diff := cmp.Diff(test.want, have); diff != "" {
+			t.Errorf("%s: mismatches (-want +have):\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestCompareWithFileError(t *testing.T) {
+	php := &testFileResult{tests: []TestResult{
+		{Class: "FooTest", Name: "testFoo", File: "/tests/FooTest.php", Assertions: 1},
+	}}
+	fileErr := FileError{File: "/tests/FooTest.php", Kind: RunError, Err: errors.New("segmentation fault")}
+
+	want := []TestMismatch{{
+		Name: "FooTest::testFoo",
+		File: "/tests/FooTest.php",
+		PHP:  "OK (1 assertion)",
+		KPHP: "FILE ERROR (run error)",
+	}}
+	if diff := cmp.Diff(want, compareWithFileError(php, fileErr)); diff != "" {
+		t.Errorf("mismatches (-want +have):\n%s", diff)
+	}
+}
@@ -3,30 +3,115 @@ package teamcity
 import (
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Logger struct {
 	writer io.Writer
+	flowID string
+}
+
+// Attr is an additional service message attribute.
+type Attr struct {
+	Name  string
+	Value string
 }
 
 func NewLogger(writer io.Writer) *Logger {
 	return &Logger{writer: writer}
 }
 
-func (l *Logger) TestSuiteStarted(name string) {
-	fmt.Fprintf(l.writer, "##teamcity[testSuiteStarted name='%s']\n", strings.TrimPrefix(name, "Benchmark"))
+// WithFlowID returns a logger that marks all messages with the given flowId,
+// so TeamCity can distinguish the concurrently running tests.
+func (l *Logger) WithFlowID(flowID string) *Logger {
+	return &Logger{writer: l.writer, flowID: flowID}
+}
+
+func Duration(d time.Duration) Attr {
+	return Attr{Name: "duration", Value: strconv.FormatInt(d.Milliseconds(), 10)}
+}
+
+func LocationHint(location string) Attr {
+	return Attr{Name: "locationHint", Value: location}
+}
+
+func (l *Logger) TestSuiteStarted(name string, attrs ...Attr) {
+	l.message("testSuiteStarted", name, attrs)
 }
 
 func (l *Logger) TestSuiteFinished(name string, duration time.Duration) {
-	fmt.Fprintf(l.writer, "##teamcity[testSuiteFinished name='%s' duration='%s']\n", strings.TrimPrefix(name, "Benchmark"), duration.String())
+	l.message("testSuiteFinished", name, []Attr{Duration(duration)})
+}
+
+func (l *Logger) TestStarted(name string, attrs ...Attr) {
+	l.message("testStarted", name, attrs)
+}
+
+func (l *Logger) TestFinished(name string, attrs ...Attr) {
+	l.message("testFinished", name, attrs)
 }
 
-func (l *Logger) TestStarted(name string) {
-	fmt.Fprintf(l.writer, "##teamcity[testStarted name='%s']\n", strings.TrimPrefix(name, "Benchmark"))
+// TestFailed reports a test failure.
+// If expected and actual values are known, use ComparisonFailed attributes instead of the message ones.
+func (l *Logger) TestFailed(name, message, details string, attrs ...Attr) {
+	attrs = append([]Attr{{"message", message}, {"details", details}}, attrs...)
+	l.message("testFailed", name, attrs)
 }
 
-func (l *Logger) TestFinished(name string) {
-	fmt.Fprintf(l.writer, "##teamcity[testFinished name='%s']\n", strings.TrimPrefix(name, "Benchmark"))
+// TestIgnored reports a skipped test.
+func (l *Logger) TestIgnored(name, message string) {
+	l.message("testIgnored", name, []Attr{{"message", message}})
+}
+
+// TestStdOut reports the test output.
+// It should be called between TestStarted and TestFinished.
+func (l *Logger) TestStdOut(name, out string) {
+	l.message("testStdOut", name, []Attr{{"out", out}})
+}
+
+// ComparisonFailed returns attributes that make TeamCity and IDE show the diff for a failed test.
+func ComparisonFailed(expected, actual string) []Attr {
+	return []Attr{
+		{"type", "comparisonFailure"},
+		{"expected", expected},
+		{"actual", actual},
+	}
+}
+
+func (l *Logger) message(messageName, name string, attrs []Attr) {
+	var sb strings.Builder
+	sb.WriteString("##teamcity[")
+	sb.WriteString(messageName)
+	writeAttr(&sb, "name", name)
+	for _, attr := range attrs {
+		writeAttr(&sb, attr.Name, attr.Value)
+	}
+	if l.flowID != "" {
+		writeAttr(&sb, "flowId", l.flowID)
+	}
+	sb.WriteString("]\n")
+	io.WriteString(l.writer, sb.String())
+}
+
+func writeAttr(sb *strings.Builder, name, value string) {
+	fmt.Fprintf(sb, " %s='%s'", name, Escape(value))
+}
+
+var escaper = strings.NewReplacer(
+	"|", "||",
+	"'", "|'",
+	"\n", "|n",
+	"\r", "|r",
+	"[", "|[",
+	"]", "|]",
+	"\u0085", "|x",
+	"\u2028", "|l",
+	"\u2029", "|p",
+)
+
+// Escape escapes the service message attribute value according to the TeamCity spec.
+func Escape(s string) string {
+	return escaper.Replace(s)
 }
@@ -0,0 +1,66 @@
+package teamcity
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{`plain`, `plain`},
+		{`it's`, `it|'s`},
+		{`a|b`, `a||b`},
+		{`[1, 2]`, `|[1, 2|]`},
+		{"line1\nline2\r", `line1|nline2|r`},
+		{"\u0085\u2028\u2029", `|x|l|p`},
+	}
+	for _, test := range tests {
+		have := Escape(test.s)
+		if have != test.want {
+			t.Errorf("escape(%q): have %q, want %q", test.s, have, test.want)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf).WithFlowID("1")
+	logger.TestStarted("testFoo", LocationHint("php_qn://FooTest.php::\\FooTest::testFoo"))
+	logger.TestStdOut("testFoo", "debug\n")
+	logger.TestFailed("testFoo", "Failed asserting that 'a' is identical to 'b'", "FooTest.php:10",
+		ComparisonFailed(`"b"`, `"a"`)...)
+	logger.TestFinished("testFoo", Duration(15*time.Millisecond))
+	logger.TestStarted("testBar")
+	logger.TestIgnored("testBar", "no database")
+	logger.TestFinished("testBar")
+
+	want := `##teamcity[testStarted name='testFoo' locationHint='php_qn://FooTest.php::\FooTest::testFoo' flowId='1']
+##teamcity[testStdOut name='testFoo' out='debug|n' flowId='1']
+##teamcity[testFailed name='testFoo' message='Failed asserting that |'a|' is identical to |'b|'' details='FooTest.php:10' type='comparisonFailure' expected='"b"' actual='"a"' flowId='1']
+##teamcity[testFinished name='testFoo' duration='15' flowId='1']
+##teamcity[testStarted name='testBar' flowId='1']
+##teamcity[testIgnored name='testBar' message='no database' flowId='1']
+##teamcity[testFinished name='testBar' flowId='1']
+`
+	if have := buf.String(); have != want {
+		t.Errorf("output mismatches:\nhave:\n%s\nwant:\n%s", have, want)
+	}
+}
+
+func TestLoggerSuite(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf)
+	logger.TestSuiteStarted("BenchmarkParserTest")
+	logger.TestSuiteFinished("BenchmarkParserTest", 1500*time.Millisecond)
+
+	want := `##teamcity[testSuiteStarted name='BenchmarkParserTest']
+##teamcity[testSuiteFinished name='BenchmarkParserTest' duration='1500']
+`
+	if have := buf.String(); have != want {
+		t.Errorf("output mismatches:\nhave:\n%s\nwant:\n%s", have, want)
+	}
+}